@@ -1,8 +1,16 @@
 #!/bin/bash -eu
 
-source /build-common.sh
+# the builder is the upstream Go image (fn61/buildkit-golang's Go is too old for go.mod's
+# "go 1.21"), so this does what buildkit-golang's build-common.sh did for us
 
 COMPILE_IN_DIRECTORY="cmd/workrecorder"
 BINARY_NAME="workrecorder"
 
-standardBuildProcess
+cd "$COMPILE_IN_DIRECTORY"
+
+go vet ./...
+go test ./...
+
+CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build \
+	-ldflags "-X github.com/function61/gokit/app/dynversion.Version=${FRIENDLY_REV_ID:-dev}" \
+	-o "../../rel/${BINARY_NAME}_linux-amd64"
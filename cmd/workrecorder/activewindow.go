@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgbutil"
+	"github.com/BurntSushi/xgbutil/ewmh"
+	"github.com/BurntSushi/xgbutil/icccm"
+)
+
+type activeWindow struct {
+	Title string // _NET_WM_NAME (or WM_NAME if window doesn't support EWMH)
+	Class string // class part of WM_CLASS (like "Firefox")
+}
+
+const noActiveWindowCaption = "(no active window)"
+
+// caption of the marker frame written when recording is paused
+const pausedCaption = "(recording paused)"
+
+// "Firefox: GitHub - Mozilla Firefox"
+func (a activeWindow) Caption() string {
+	if a.Class == "" && a.Title == "" {
+		return noActiveWindowCaption
+	}
+
+	// SRT captions are delimited by empty lines
+	return strings.ReplaceAll(fmt.Sprintf("%s: %s", a.Class, a.Title), "\n", " ")
+}
+
+// inverse of Caption()
+func parseActiveWindowCaption(caption string) activeWindow {
+	if caption == noActiveWindowCaption {
+		return activeWindow{}
+	}
+
+	class, title, _ := strings.Cut(caption, ": ")
+
+	return activeWindow{
+		Title: title,
+		Class: class,
+	}
+}
+
+// asks the window manager for the active window. the result is a zero value if there is no
+// active window (e.g. desktop is focused)
+func getActiveWindow(xutil *xgbutil.XUtil) (activeWindow, error) {
+	win, err := ewmh.ActiveWindowGet(xutil)
+	if err != nil {
+		return activeWindow{}, fmt.Errorf("_NET_ACTIVE_WINDOW: %w", err)
+	}
+
+	if win == 0 {
+		return activeWindow{}, nil
+	}
+
+	return getWindowInfo(xutil, win), nil
+}
+
+// title and class of a window. missing properties are left empty.
+func getWindowInfo(xutil *xgbutil.XUtil, win xproto.Window) activeWindow {
+	title, err := ewmh.WmNameGet(xutil, win)
+	if err != nil || title == "" { // not all windows support EWMH
+		title, _ = icccm.WmNameGet(xutil, win)
+	}
+
+	class := ""
+	if wmClass, err := icccm.WmClassGet(xutil, win); err == nil {
+		class = wmClass.Class
+	}
+
+	return activeWindow{
+		Title: title,
+		Class: class,
+	}
+}
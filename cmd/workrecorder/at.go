@@ -0,0 +1,315 @@
+package main
+
+// Going "back in time": extracts the frame that was on a screen at a given moment.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/os/osutil"
+	"github.com/spf13/cobra"
+)
+
+func atEntrypoint() *cobra.Command {
+	pngDir := ""
+
+	cmd := &cobra.Command{
+		Use:   "at <timestamp> [screen]",
+		Short: "Extracts screen(s) as of given moment as PNG",
+		Long: `Extracts screen(s) as of given moment as PNG.
+
+Timestamp is RFC 3339 (2021-06-28T12:34:56Z) or "2021-06-28 12:34:56" (in the configured time_zone).
+Without screen, extracts all screens that were recorded at the time.`,
+		Args: cobra.RangeArgs(1, 2),
+	}
+
+	resolveConfig := registerConfigFlags(cmd.Flags())
+
+	cmd.Flags().StringVarP(&pngDir, "png-dir", "o", ".", "Directory to write the PNG(s) to")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		rootLogger := logex.StandardLogger()
+
+		osutil.ExitIfError(func() error {
+			conf, err := resolveConfig()
+			if err != nil {
+				return err
+			}
+
+			at, err := parseTimestampArg(args[0], conf.Location())
+			if err != nil {
+				return err
+			}
+
+			screens := []ScreenId{}
+			if len(args) >= 2 {
+				screens = append(screens, ScreenId(args[1]))
+			} else {
+				screens, err = listScreens(conf.OutputDir)
+				if err != nil {
+					return err
+				}
+			}
+
+			return extractScreensAt(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				*conf,
+				at,
+				screens,
+				pngDir,
+				len(args) >= 2)
+		}())
+	}
+
+	return cmd
+}
+
+// if "screenExplicit", screen not having a frame is an error
+func extractScreensAt(
+	ctx context.Context,
+	conf Config,
+	at time.Time,
+	screens []ScreenId,
+	pngDir string,
+	screenExplicit bool,
+) error {
+	found := 0
+
+	for _, screen := range screens {
+		frame, cleanup, err := findFrameAt(ctx, conf, screen, at)
+		if err != nil {
+			if errors.Is(err, errNoFrameAt) && !screenExplicit {
+				continue
+			}
+
+			return err
+		}
+
+		pngPath := filepath.Join(pngDir, fmt.Sprintf("%s_%s.png", screen, frame.CaptureTime.Format("2006-01-02_15-04-05")))
+
+		err = extractFramePng(ctx, frame.PlaintextPath, frame.Offset, pngPath)
+		cleanup()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\t%s\t%s\n", screen, frame.CaptureTime.Format(time.RFC3339), pngPath)
+
+		found++
+	}
+
+	if found == 0 {
+		if gap := gapAt(ctx, conf, at); gap != nil {
+			recording := "recording"
+			if gap.Screen != "" {
+				recording = "recording of " + string(gap.Screen)
+			}
+
+			return fmt.Errorf("%w %s (%s was %s %s - %s)", errNoFrameAt, at.Format(time.RFC3339), recording, gap.Reason, gap.Start.Format(time.RFC3339), gap.End.Format(time.RFC3339))
+		}
+
+		return fmt.Errorf("%w %s", errNoFrameAt, at.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+var errNoFrameAt = errors.New("no recording at")
+
+// explains a missing recording. nil if there was no gap (or the index can't tell).
+func gapAt(ctx context.Context, conf Config, at time.Time) *recordingGap {
+	if _, err := os.Stat(indexPath(conf.OutputDir)); err != nil { // don't create one
+		return nil
+	}
+
+	index, err := openSegmentIndex(indexPath(conf.OutputDir), conf.IndexWindows)
+	if err != nil {
+		return nil
+	}
+	defer index.Close()
+
+	gaps, err := index.Gaps(ctx, at, at.Add(time.Second))
+	if err != nil || len(gaps) == 0 {
+		return nil
+	}
+
+	return &gaps[0]
+}
+
+type frameLocation struct {
+	Segment       segmentFile
+	PlaintextPath string        // segment's video, decrypted if it's encrypted. removed by the cleanup
+	Index         int           // frame number in segment
+	CaptureTime   time.Time     // exact time the frame was captured
+	Offset        time.Duration // from the start of the video
+}
+
+// finds the frame nearest to "at". the frame must be within one frame interval of "at" (or for
+// compacted segments, within the spacing of its frames). call the returned cleanup when done with
+// the frame's video.
+func findFrameAt(ctx context.Context, conf Config, screen ScreenId, at time.Time) (*frameLocation, func(), error) {
+	at = at.In(conf.Location()) // the day folders are in the configured time zone
+
+	segments, err := listSegmentsOfDay(conf.OutputDir, screen, at)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// latest segment that started before (or at) "at"
+	var segment *segmentFile
+	for idx := range segments {
+		if !segments[idx].Start.After(at) {
+			segment = &segments[idx]
+		}
+	}
+
+	if segment == nil {
+		return nil, nil, fmt.Errorf("%w %s for %s", errNoFrameAt, at.Format(time.RFC3339), screen)
+	}
+
+	// decrypted once for both finding the frame and extracting it
+	plaintextPath, cleanup, err := plaintextSegment(conf, *segment)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	frame, err := findFrameInSegment(ctx, conf, screen, at, *segment, plaintextPath)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return frame, cleanup, nil
+}
+
+// "plaintextPath" is the segment's video, decrypted if it's encrypted
+func findFrameInSegment(ctx context.Context, conf Config, screen ScreenId, at time.Time, segment segmentFile, plaintextPath string) (*frameLocation, error) {
+	// same arithmetic as when recording: segment's ticks are spaced by frame interval
+	// starting from the first tick up to the end of the segment's period
+	ticks := timestampsBetween(
+		segment.Start,
+		timeFloorMinutesAddNPeriod(segment.Start, conf.SegmentMinutes, 1),
+		conf.FrameInterval)
+
+	tickIdx := nearestTickIndex(ticks, at)
+
+	// the time subtitles tell us which frames actually made it into the video
+	timeTrack, err := extractSubtitleTrack(ctx, plaintextPath, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: time subtitles: %w", segment.Path, err)
+	}
+
+	if len(timeTrack) == 0 {
+		return nil, fmt.Errorf("%w %s for %s", errNoFrameAt, at.Format(time.RFC3339), screen)
+	}
+
+	frames, err := framesFromSubtitles(segment.Start, timeTrack, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if tickIdx >= len(frames) { // segment closed early
+		tickIdx = len(frames) - 1
+	}
+
+	// compacted segments have only some of the ticks' frames
+	tolerance := conf.FrameInterval
+	if !frames[tickIdx].Timestamp.Equal(ticks[tickIdx]) {
+		frameTimestamps := []time.Time{}
+		for _, frame := range frames {
+			frameTimestamps = append(frameTimestamps, frame.Timestamp)
+		}
+
+		tickIdx = nearestTickIndex(frameTimestamps, at)
+		tolerance = frameSpacingAt(frameTimestamps, tickIdx, conf.FrameInterval)
+	}
+
+	captureTime := frames[tickIdx].Timestamp
+
+	if distance := at.Sub(captureTime); distance >= tolerance || distance <= -tolerance {
+		return nil, fmt.Errorf("%w %s for %s (nearest frame %s)", errNoFrameAt, at.Format(time.RFC3339), screen, captureTime.Format(time.RFC3339))
+	}
+
+	return &frameLocation{
+		Segment:       segment,
+		PlaintextPath: plaintextPath,
+		Index:         tickIdx,
+		CaptureTime:   captureTime,
+		// middle of the frame's display time so we're not at the mercy of rounding
+		Offset: (timeTrack[tickIdx].Start + timeTrack[tickIdx].End) / 2,
+	}, nil
+}
+
+// time between the frame and its farthest neighbour, but at least "minimum"
+func frameSpacingAt(frameTimestamps []time.Time, idx int, minimum time.Duration) time.Duration {
+	spacing := minimum
+	for _, neighbour := range []int{idx - 1, idx + 1} {
+		if neighbour >= 0 && neighbour < len(frameTimestamps) {
+			if distance := absDuration(frameTimestamps[idx].Sub(frameTimestamps[neighbour])); distance > spacing {
+				spacing = distance
+			}
+		}
+	}
+
+	return spacing
+}
+
+// ticks must be sorted and non-empty
+func nearestTickIndex(ticks []time.Time, at time.Time) int {
+	nearest := 0
+	for idx, tick := range ticks {
+		if absDuration(at.Sub(tick)) < absDuration(at.Sub(ticks[nearest])) {
+			nearest = idx
+		}
+	}
+
+	return nearest
+}
+
+func extractFramePng(ctx context.Context, videoPath string, offset time.Duration, pngPath string) error {
+	ffmpeg := exec.CommandContext(
+		ctx,
+		"ffmpeg",
+		"-hide_banner",
+		"-loglevel", "error", // be less verbose
+		"-y", // overwrite
+		"-ss", fmt.Sprintf("%.3f", offset.Seconds()),
+		"-i", videoPath,
+		"-frames:v", "1",
+		pngPath,
+	)
+
+	ffmpeg.Stdout = os.Stdout
+	ffmpeg.Stderr = os.Stderr
+
+	return ffmpeg.Run()
+}
+
+// RFC 3339 or "2021-06-28 12:34:56" (in "loc")
+func parseTimestampArg(serialized string, loc *time.Location) (time.Time, error) {
+	if ts, err := time.Parse(time.RFC3339, serialized); err == nil {
+		return ts, nil
+	}
+
+	ts, err := time.ParseInLocation("2006-01-02 15:04:05", strings.Replace(serialized, "T", " ", 1), loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unsupported timestamp format: %s", serialized)
+	}
+
+	return ts, nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+
+	return d
+}
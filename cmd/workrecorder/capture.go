@@ -0,0 +1,301 @@
+package main
+
+// Screen capture backends. GetImage pulls every pixel through the X socket and converts them one by
+// one, which on 4K multi-monitor setups is the dominant CPU cost. With MIT-SHM the X server writes
+// the pixels straight into memory shared with us, and they're already in the order we want.
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+
+	"github.com/BurntSushi/xgb/shm"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgbutil"
+	"github.com/BurntSushi/xgbutil/xgraphics"
+	"github.com/function61/gokit/log/logex"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	captureBackendAuto     = "auto"     // MIT-SHM if the X server supports it (and is local), else GetImage
+	captureBackendShm      = "shm"      // MIT-SHM or fail
+	captureBackendGetImage = "getimage" // plain GetImage
+)
+
+var captureBackends = []string{captureBackendAuto, captureBackendShm, captureBackendGetImage}
+
+type screenCapturer interface {
+	// the output's area of the root window
+	Capture(output randrOutput) (*xgraphics.Image, error)
+	Close() error
+}
+
+func newScreenCapturer(xutil *xgbutil.XUtil, backend string, logl *logex.Leveled) (screenCapturer, error) {
+	if backend == captureBackendGetImage {
+		return &getImageCapturer{xutil}, nil
+	}
+
+	capturer, err := newShmCapturer(xutil, logl)
+	if err != nil {
+		if backend == captureBackendShm {
+			return nil, fmt.Errorf("MIT-SHM: %w", err)
+		}
+
+		logl.Info.Printf("MIT-SHM not available (%v), capturing with GetImage", err)
+
+		return &getImageCapturer{xutil}, nil
+	}
+
+	logl.Info.Println("capturing with MIT-SHM")
+
+	return capturer, nil
+}
+
+type getImageCapturer struct {
+	xutil *xgbutil.XUtil
+}
+
+func (g *getImageCapturer) Capture(output randrOutput) (*xgraphics.Image, error) {
+	// with multi-monitor setup X's root window spans multiple monitors, therefore we ask a specific
+	// rectangle inside it (whose location is specified by RANDR)
+	return newDrawableFromGeometry(g.xutil, xproto.Drawable(g.xutil.RootWin()), output.XRect())
+}
+
+func (g *getImageCapturer) Close() error {
+	return nil
+}
+
+type shmCapturer struct {
+	xutil    *xgbutil.XUtil
+	fallback *getImageCapturer
+	logl     *logex.Leveled
+
+	mu       sync.Mutex
+	segments map[ScreenId]*shmSegment // reused between captures
+	failed   bool                     // MIT-SHM stopped working. using fallback from now on.
+}
+
+func newShmCapturer(xutil *xgbutil.XUtil, logl *logex.Leveled) (*shmCapturer, error) {
+	if err := shm.Init(xutil.Conn()); err != nil {
+		return nil, err
+	}
+
+	if _, err := shm.QueryVersion(xutil.Conn()).Reply(); err != nil {
+		return nil, err
+	}
+
+	// the pixels are copied as-is
+	if xutil.Setup().ImageByteOrder != xproto.ImageOrderLSBFirst {
+		return nil, errors.New("X server's image byte order is not LSB first")
+	}
+
+	capturer := &shmCapturer{
+		xutil:    xutil,
+		fallback: &getImageCapturer{xutil},
+		logl:     logl,
+		segments: map[ScreenId]*shmSegment{},
+	}
+
+	// a remote X server has the extension but can't see our memory. better to find out now.
+	probe, err := newShmSegment(xutil, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := probe.Close(); err != nil {
+		return nil, err
+	}
+
+	return capturer, nil
+}
+
+func (s *shmCapturer) Capture(output randrOutput) (*xgraphics.Image, error) {
+	for {
+		segment, err := s.segmentFor(output)
+		if err != nil {
+			s.fail(err)
+		}
+
+		if segment == nil {
+			return s.fallback.Capture(output)
+		}
+
+		img, err := segment.Capture(s.xutil, output)
+		switch {
+		case err == nil:
+			return img, nil
+		case errors.Is(err, errShmSegmentClosed): // output's resolution changed meanwhile
+			continue
+		default:
+			s.fail(err)
+
+			return s.fallback.Capture(output)
+		}
+	}
+}
+
+func (s *shmCapturer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	errs := []error{}
+	for screen, segment := range s.segments {
+		errs = append(errs, segment.Close())
+		delete(s.segments, screen)
+	}
+
+	return errors.Join(errs...)
+}
+
+// segment sized for the output. re-made if the output's resolution changed. nil if MIT-SHM failed.
+func (s *shmCapturer) segmentFor(output randrOutput) (*shmSegment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failed {
+		return nil, nil
+	}
+
+	size := output.Rect().Dx() * output.Rect().Dy() * 4
+
+	segment, found := s.segments[output.ScreenId()]
+	if found && len(segment.data) == size {
+		return segment, nil
+	}
+
+	if found {
+		if err := segment.Close(); err != nil {
+			return nil, err
+		}
+
+		delete(s.segments, output.ScreenId())
+	}
+
+	segment, err := newShmSegment(s.xutil, size)
+	if err != nil {
+		return nil, err
+	}
+
+	s.segments[output.ScreenId()] = segment
+
+	return segment, nil
+}
+
+// falls back to GetImage for good, as a working capture beats a fast one
+func (s *shmCapturer) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.failed {
+		s.failed = true
+		s.logl.Error.Printf("MIT-SHM capture failed (%v), falling back to GetImage", err)
+	}
+}
+
+// shared memory that both we and the X server have attached
+type shmSegment struct {
+	mu     sync.Mutex // the recorder and a snapshot can capture the same output at the same time
+	xutil  *xgbutil.XUtil
+	seg    shm.Seg
+	data   []byte
+	closed bool // "data" is unmapped
+}
+
+var errShmSegmentClosed = errors.New("shared memory segment closed")
+
+func newShmSegment(xutil *xgbutil.XUtil, size int) (*shmSegment, error) {
+	id, err := unix.SysvShmGet(unix.IPC_PRIVATE, size, unix.IPC_CREAT|0600)
+	if err != nil {
+		return nil, fmt.Errorf("shmget: %w", err)
+	}
+
+	// once marked for removal, the segment goes away after both we and the X server have detached
+	// (even if we crash). Linux allows attaching to it after marking, but others don't.
+	removeSegment := func() {
+		_, _ = unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+	}
+
+	data, err := unix.SysvShmAttach(id, 0, 0)
+	if err != nil {
+		removeSegment()
+		return nil, fmt.Errorf("shmat: %w", err)
+	}
+
+	seg, err := shm.NewSegId(xutil.Conn())
+	if err != nil {
+		removeSegment()
+		_ = unix.SysvShmDetach(data)
+		return nil, err
+	}
+
+	// writable as the X server writes the screenshots into it
+	if err := shm.AttachChecked(xutil.Conn(), seg, uint32(id), false).Check(); err != nil {
+		removeSegment()
+		_ = unix.SysvShmDetach(data)
+		return nil, fmt.Errorf("attach: %w", err)
+	}
+
+	removeSegment()
+
+	return &shmSegment{
+		xutil: xutil,
+		seg:   seg,
+		data:  data,
+	}, nil
+}
+
+func (s *shmSegment) Capture(xutil *xgbutil.XUtil, output randrOutput) (*xgraphics.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, errShmSegmentClosed
+	}
+
+	rect := output.Rect()
+
+	reply, err := shm.GetImage(
+		xutil.Conn(),
+		xproto.Drawable(xutil.RootWin()),
+		int16(rect.Min.X),
+		int16(rect.Min.Y),
+		uint16(rect.Dx()),
+		uint16(rect.Dy()),
+		(1<<32)-1,
+		xproto.ImageFormatZPixmap,
+		s.seg,
+		0).Reply()
+	if err != nil {
+		return nil, err
+	}
+
+	// with 32 bits per pixel the data is BGRx, which is what xgraphics.Image has (the unused byte
+	// becomes alpha, same as with GetImage)
+	format := xgraphics.GetFormat(xutil, reply.Depth)
+	if format == nil || format.BitsPerPixel != 32 {
+		return nil, fmt.Errorf("unsupported pixel format for depth %d", reply.Depth)
+	}
+
+	if int(reply.Size) != len(s.data) {
+		return nil, fmt.Errorf("expected %d bytes of image; got %d", len(s.data), reply.Size)
+	}
+
+	img := xgraphics.New(xutil, image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	copy(img.Pix, s.data)
+
+	return img, nil
+}
+
+func (s *shmSegment) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// X server's attachment goes away with our connection anyway, so it not succeeding isn't fatal
+	shm.Detach(s.xutil.Conn(), s.seg)
+
+	s.closed = true
+
+	return unix.SysvShmDetach(s.data)
+}
@@ -0,0 +1,78 @@
+package main
+
+// these need an X server ($ xvfb-run go test -bench Capture)
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgbutil"
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestShmCaptureMatchesGetImage(t *testing.T) {
+	xutil, output := connectTestX(t)
+
+	shmCapturer, err := newShmCapturer(xutil, logex.Levels(logex.Discard))
+	if err != nil {
+		t.Skipf("MIT-SHM: %v", err)
+	}
+	defer shmCapturer.Close()
+
+	viaShm, err := shmCapturer.Capture(output)
+	assert.Ok(t, err)
+	assert.Assert(t, !shmCapturer.failed)
+
+	viaGetImage, err := (&getImageCapturer{xutil}).Capture(output)
+	assert.Ok(t, err)
+
+	assert.Assert(t, viaShm.Bounds() == viaGetImage.Bounds())
+	assert.Assert(t, bytes.Equal(viaShm.Pix, viaGetImage.Pix))
+}
+
+func BenchmarkCaptureGetImage(b *testing.B) {
+	xutil, output := connectTestX(b)
+
+	benchmarkCapture(b, &getImageCapturer{xutil}, output)
+}
+
+func BenchmarkCaptureShm(b *testing.B) {
+	xutil, output := connectTestX(b)
+
+	capturer, err := newShmCapturer(xutil, logex.Levels(logex.Discard))
+	if err != nil {
+		b.Skipf("MIT-SHM: %v", err)
+	}
+	defer capturer.Close()
+
+	benchmarkCapture(b, capturer, output)
+}
+
+func benchmarkCapture(b *testing.B, capturer screenCapturer, output randrOutput) {
+	b.SetBytes(int64(output.Rect().Dx() * output.Rect().Dy() * 4))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := capturer.Capture(output); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// skips if there's no X server
+func connectTestX(tb testing.TB) (*xgbutil.XUtil, randrOutput) {
+	xutil, err := connectX11()
+	if err != nil {
+		tb.Skipf("no X server: %v", err)
+	}
+	tb.Cleanup(xutil.Conn().Close)
+
+	outputs, err := getConnectedOutputs(xutil.Conn(), xproto.Setup(xutil.Conn()).DefaultScreen(xutil.Conn()).Root)
+	if err != nil || len(outputs) == 0 {
+		tb.Skipf("no connected outputs: %v", err)
+	}
+
+	return xutil, outputs[0]
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/function61/gokit/os/osutil"
+	"github.com/spf13/cobra"
+)
+
+func catEntrypoint() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "cat <segment>",
+		Aliases: []string{"decrypt"},
+		Short:   "Writes a segment's video to stdout (decrypting it if needed)",
+		Long: `Writes a segment's video to stdout (decrypting it if needed).
+
+Segment is a path to the file, or relative to the output dir ("DP-1/2021-06-28/12-15-00.mkv.age").
+
+Pipe it to other tools, like:
+
+    $ workrecorder cat DP-1/2021-06-28/12-15-00.mkv.age | mpv -`,
+		Args: cobra.ExactArgs(1),
+	}
+
+	resolveConfig := registerConfigFlags(cmd.Flags())
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		osutil.ExitIfError(func() error {
+			conf, err := resolveConfig()
+			if err != nil {
+				return err
+			}
+
+			return catSegment(*conf, args[0])
+		}())
+	}
+
+	return cmd
+}
+
+func catSegment(conf Config, segmentArg string) error {
+	segmentFilePath := resolveSegmentArg(conf.OutputDir, segmentArg)
+
+	segment := segmentFile{
+		Path:      segmentFilePath,
+		Encrypted: strings.HasSuffix(segmentFilePath, encryptedExtension),
+	}
+
+	identities := []age.Identity{}
+	if segment.Encrypted {
+		if conf.EncryptionIdentityFile == "" {
+			return fmt.Errorf("%s: %w", segment.Path, errNoEncryptionIdentity)
+		}
+
+		var err error
+		identities, err = loadEncryptionIdentities(conf.EncryptionIdentityFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+
+	if err := decryptSegment(segment, identities, output); err != nil {
+		return err
+	}
+
+	return output.Flush()
+}
@@ -0,0 +1,74 @@
+package main
+
+// The monotonic clock stops while the machine is suspended, but the wall clock doesn't. Stepping the
+// clock (NTP, or by hand) also moves only the wall clock. Either way the ticks of the segments in
+// progress are stale afterwards, so the segments are closed and new ones start aligned to the new
+// wall time.
+
+import (
+	"context"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+)
+
+const (
+	clockJumpCheckInterval = time.Second
+	clockJumpThreshold     = 2 * time.Second // NTP slews small differences gradually. steps and suspends are bigger.
+)
+
+// both clocks at one instant
+type clockSample struct {
+	Wall time.Time     // without monotonic reading
+	Mono time.Duration // since monotonicEpoch
+}
+
+var monotonicEpoch = time.Now()
+
+func sampleClocks() clockSample {
+	now := time.Now()
+
+	return clockSample{
+		Wall: now.Round(0), // strips the monotonic reading
+		Mono: now.Sub(monotonicEpoch),
+	}
+}
+
+// how much more the wall clock advanced than the monotonic clock since "earlier". negative if the
+// wall clock was set back.
+func (c clockSample) JumpSince(earlier clockSample) time.Duration {
+	return c.Wall.Sub(earlier.Wall) - (c.Mono - earlier.Mono)
+}
+
+// cuts the segments in progress when the wall clock jumps
+func cutSegmentsOnClockJumps(ctx context.Context, control *recordingControl, logl *logex.Leveled) error {
+	previous := sampleClocks()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(clockJumpCheckInterval):
+		}
+
+		current := sampleClocks()
+
+		jump := current.JumpSince(previous)
+		switch {
+		case jump > clockJumpThreshold:
+			logl.Info.Printf("wall clock jumped %s ahead (resumed from suspend?), cutting segments", jump.Round(time.Second))
+			control.Cut()
+		case jump < -clockJumpThreshold:
+			logl.Info.Printf("wall clock was set back %s, cutting segments", (-jump).Round(time.Second))
+			control.Cut()
+		}
+
+		previous = current
+	}
+}
+
+// whether a tick that's due now is too far in the past to be captured as if it was current.
+// waiting for a tick is measured on the monotonic clock, which stops during suspend.
+func tickStale(tick time.Time, now time.Time, interval time.Duration) bool {
+	return now.Sub(tick) > max(interval, clockJumpThreshold)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestClockJump(t *testing.T) {
+	at := func(wall string, mono time.Duration) clockSample {
+		wallTime, err := time.Parse(time.RFC3339, wall)
+		assert.Ok(t, err)
+
+		return clockSample{Wall: wallTime, Mono: mono}
+	}
+
+	before := at("2021-06-28T12:00:00Z", 100*time.Second)
+
+	// clocks in sync
+	assert.EqualString(t, at("2021-06-28T12:00:01Z", 101*time.Second).JumpSince(before).String(), "0s")
+
+	// suspended for an hour: monotonic clock didn't advance meanwhile
+	assert.EqualString(t, at("2021-06-28T13:00:01Z", 101*time.Second).JumpSince(before).String(), "1h0m0s")
+
+	// NTP stepped the clock back
+	assert.EqualString(t, at("2021-06-28T11:59:51Z", 101*time.Second).JumpSince(before).String(), "-10s")
+
+	// the real clocks agree with themselves
+	first := sampleClocks()
+	time.Sleep(10 * time.Millisecond)
+	jump := sampleClocks().JumpSince(first)
+	assert.Assert(t, jump < clockJumpThreshold && jump > -clockJumpThreshold)
+}
+
+func TestTickStale(t *testing.T) {
+	tick := time.Date(2021, 6, 28, 12, 0, 5, 0, time.UTC)
+
+	assert.Assert(t, !tickStale(tick, tick.Add(100*time.Millisecond), 5*time.Second))
+	assert.Assert(t, !tickStale(tick, tick.Add(5*time.Second), 5*time.Second))
+	assert.Assert(t, tickStale(tick, tick.Add(6*time.Second), 5*time.Second))
+	assert.Assert(t, tickStale(tick, tick.Add(time.Hour), 5*time.Second))
+
+	// short intervals get some leeway
+	assert.Assert(t, !tickStale(tick, tick.Add(1500*time.Millisecond), time.Second))
+}
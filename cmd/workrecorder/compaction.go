@@ -0,0 +1,517 @@
+package main
+
+// Old footage is rarely watched, so it gets compacted in tiers:
+//
+// 1. downsampled: segment re-encoded with lower resolution, frame rate and quality
+// 2. time-lapse: a day's segments merged into one video with only every Nth frame
+//
+// The compacted video is written next to the original and renamed over it, so a segment is
+// always either fully original or fully compacted. The tier is stored in the index and in the
+// video's metadata (so reindex can recover it).
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/os/osutil"
+)
+
+const (
+	segmentTierOriginal    = "original"
+	segmentTierDownsampled = "downsampled"
+	segmentTierTimelapse   = "timelapse"
+)
+
+// Matroska tag in the video's global metadata
+const segmentTierMetadataKey = "WORKRECORDER_TIER"
+
+type compactionRules struct {
+	DownsampleAfter     time.Duration // 0 = disabled
+	DownsampleFrameStep int
+	TimelapseAfter      time.Duration // 0 = disabled
+	TimelapseFrameStep  int
+}
+
+func (c compactionRules) Enabled() bool {
+	return c.DownsampleAfter != 0 || c.TimelapseAfter != 0
+}
+
+func compactionRulesFromConfig(conf Config) compactionRules {
+	return compactionRules{
+		DownsampleAfter:     conf.CompactionDownsampleAfter,
+		DownsampleFrameStep: conf.CompactionDownsampleFrameStep,
+		TimelapseAfter:      conf.CompactionTimelapseAfter,
+		TimelapseFrameStep:  conf.CompactionTimelapseFrameStep,
+	}
+}
+
+type compactionJob struct {
+	Tier      string
+	Sources   []segmentRecord // oldest first. the first one gets replaced, the rest removed
+	FrameStep int
+}
+
+type compactor struct {
+	conf       Config
+	encoder    encoderProfile
+	renderNode string          // empty if encoder doesn't need one
+	recipients []age.Recipient // nil = no encryption
+	index      *segmentIndex
+	ledger     *segmentLedger
+}
+
+// runs forever (until ctx canceled)
+func (c *compactor) CompactContinuously(ctx context.Context, logl *logex.Leveled) error {
+	rules := compactionRulesFromConfig(c.conf)
+
+	if !rules.Enabled() {
+		logl.Debug.Println("compaction disabled")
+		<-ctx.Done()
+		return nil
+	}
+
+	for {
+		// a failed round must not stop the recording, which shares our task runner
+		if err := c.Compact(ctx, rules, logl); err != nil && ctx.Err() == nil {
+			logl.Error.Printf("compaction failed, retrying in %s: %v", c.conf.CompactionCheckInterval, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(c.conf.CompactionCheckInterval):
+		}
+	}
+}
+
+func (c *compactor) Compact(ctx context.Context, rules compactionRules, logl *logex.Leveled) error {
+	segmentFiles, err := listSegments(c.conf.OutputDir)
+	if err != nil {
+		return err
+	}
+
+	// only indexed segments can be compacted, as we need their frames' metadata
+	segments := []segmentRecord{}
+	indexedByScreen := map[ScreenId]map[string]segmentRecord{}
+	for _, segmentFile := range segmentFiles {
+		if segmentFile.Encrypted && c.conf.EncryptionIdentityFile == "" {
+			continue // can't read it
+		}
+
+		indexed, found := indexedByScreen[segmentFile.Screen]
+		if !found {
+			indexed, err = c.index.Segments(ctx, segmentFile.Screen, time.Unix(0, 0), time.Now())
+			if err != nil {
+				return fmt.Errorf("index: %w", err)
+			}
+
+			indexedByScreen[segmentFile.Screen] = indexed
+		}
+
+		relativePath := segmentPathRelative(c.conf.OutputDir, segmentFile.Path)
+
+		segment, found := indexed[relativePath]
+		if !found {
+			logl.Debug.Printf("not compacting %s: not indexed", relativePath)
+			continue
+		}
+
+		segments = append(segments, segment)
+	}
+
+	for _, job := range planCompaction(segments, rules, time.Now()) {
+		if err := c.compactOne(ctx, job, logl); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			// one bad job (say, an unreadable segment) shouldn't hold back the others
+			logl.Error.Printf("compacting %s: %v", job.Sources[0].Path, err)
+		}
+	}
+
+	return nil
+}
+
+// decides what to compact. "segments" must be sorted by screen and start time.
+func planCompaction(segments []segmentRecord, rules compactionRules, now time.Time) []compactionJob {
+	jobs := []compactionJob{}
+	timelapsed := map[string]bool{}
+
+	if rules.TimelapseAfter != 0 {
+		// time-lapses are made of same codec's segments, because ffmpeg can't concat mixed codecs.
+		// existing time-lapses are never re-compacted.
+		type dayKey struct {
+			Screen ScreenId
+			Day    string
+			Codec  string
+		}
+
+		jobIdxByDay := map[dayKey]int{}
+		for _, segment := range segments {
+			dayEnd := nextMidnight(segment.Start)
+
+			if segment.Tier == segmentTierTimelapse || now.Sub(dayEnd) <= rules.TimelapseAfter {
+				continue
+			}
+
+			key := dayKey{segment.Screen, segment.Start.Format(segmentDateLayout), segment.Codec}
+
+			jobIdx, found := jobIdxByDay[key]
+			if !found {
+				jobs = append(jobs, compactionJob{Tier: segmentTierTimelapse, FrameStep: rules.TimelapseFrameStep})
+				jobIdx = len(jobs) - 1
+				jobIdxByDay[key] = jobIdx
+			}
+
+			jobs[jobIdx].Sources = append(jobs[jobIdx].Sources, segment)
+			timelapsed[segment.Path] = true
+		}
+	}
+
+	if rules.DownsampleAfter != 0 {
+		for _, segment := range segments {
+			if segment.Tier != segmentTierOriginal || timelapsed[segment.Path] || now.Sub(segment.Start) <= rules.DownsampleAfter {
+				continue
+			}
+
+			jobs = append(jobs, compactionJob{
+				Tier:      segmentTierDownsampled,
+				Sources:   []segmentRecord{segment},
+				FrameStep: rules.DownsampleFrameStep,
+			})
+		}
+	}
+
+	return jobs
+}
+
+// what compaction leaves free in the work dir for the segments being recorded
+const compactionWorkDirReserve = 512 * 1024 * 1024
+
+func (c *compactor) compactOne(ctx context.Context, job compactionJob, logl *logex.Leveled) error {
+	conf := c.conf
+
+	// encrypted sources are decrypted into the work dir, which is RAM by default and shared with the
+	// recording. a day's time-lapse can have gigabytes of sources, so we don't start if they don't fit.
+	if decryptBytes := compactionDecryptBytes(job.Sources); decryptBytes > 0 {
+		freeBytes, err := filesystemFreeBytes(conf.WorkDir)
+		if err != nil {
+			return err
+		}
+
+		if freeBytes-decryptBytes < compactionWorkDirReserve {
+			return fmt.Errorf("decrypting the sources needs %d bytes in work_dir but it has %d free (and %d are left for recording)", decryptBytes, freeBytes, compactionWorkDirReserve)
+		}
+	}
+
+	tempDir, err := os.MkdirTemp(conf.WorkDir, "workrecorder-compaction-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	frames := []frameMetadata{}
+	sourcePaths := []string{}
+	plaintextPaths := []string{} // same as sourcePaths unless encrypted
+	sizeBefore := int64(0)
+	var startLocation *time.Location
+	for _, source := range job.Sources {
+		sourceFile, err := parseSegmentPath(conf.OutputDir, filepath.Join(conf.OutputDir, source.Path))
+		if err != nil {
+			return err
+		}
+
+		if startLocation == nil {
+			startLocation = sourceFile.Start.Location()
+		}
+
+		plaintextPath, cleanup, err := plaintextSegment(conf, *sourceFile)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		sourceFrames, err := c.index.SegmentFrames(ctx, source.Path)
+		if err != nil {
+			return fmt.Errorf("index: %w", err)
+		}
+
+		if len(sourceFrames) != source.FrameCount {
+			return fmt.Errorf("%s: index has %d frame(s) but segment %d", source.Path, len(sourceFrames), source.FrameCount)
+		}
+
+		// the index has UTC, but the time subtitles are in the UTC offset of the output's start
+		// (the first source's), even if a DST transition falls within a time-lapse's day
+		for idx := range sourceFrames {
+			sourceFrames[idx].Timestamp = sourceFrames[idx].Timestamp.In(startLocation)
+		}
+
+		frames = append(frames, sourceFrames...)
+		sourcePaths = append(sourcePaths, sourceFile.Path)
+		plaintextPaths = append(plaintextPaths, plaintextPath)
+		sizeBefore += source.Size
+	}
+
+	// same selection as ffmpeg's "select" filter does
+	keptFrames := []frameMetadata{}
+	for idx, frame := range frames {
+		if idx%job.FrameStep == 0 {
+			keptFrames = append(keptFrames, frame)
+		}
+	}
+
+	if len(keptFrames) == 0 {
+		return nil
+	}
+
+	scaleFilter := fmt.Sprintf("scale=trunc(iw*%g/2)*2:trunc(ih*%g/2)*2", conf.CompactionDownsampleScale, conf.CompactionDownsampleScale)
+	if job.Tier == segmentTierTimelapse {
+		// sources might differ in resolution (some downsampled) but the output can't. this also
+		// means the time-lapse isn't scaled down further if its sources already were.
+		width, height, err := smallestVideoResolution(ctx, plaintextPaths)
+		if err != nil {
+			return err
+		}
+
+		scaleFilter = fmt.Sprintf("scale=%d:%d", width, height)
+	}
+
+	concatListPath := filepath.Join(tempDir, "sources.txt")
+	if err := writeFfmpegConcatInputFile(concatListPath, plaintextPaths); err != nil {
+		return err
+	}
+
+	videoOnlyPath := filepath.Join(tempDir, "video.mkv")
+
+	encoderInputArgs, encoderOutputArgs := c.encoder.Args(
+		c.renderNode,
+		conf.CompactionDownsampleQuality,
+		fmt.Sprintf(`select=not(mod(n\,%d))`, job.FrameStep),
+		fmt.Sprintf("setpts=N/(%d*TB)", conf.Fps), // close the holes left by dropped frames
+		scaleFilter)
+
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error", // be less verbose
+	}
+	args = append(args, encoderInputArgs...)
+	args = append(args,
+		"-f", "concat",
+		"-safe", "0", // needed for file list with absolute paths
+		"-i", concatListPath,
+		"-map", "0:v:0")
+	args = append(args, encoderOutputArgs...)
+	args = append(args,
+		"-r", fmt.Sprintf("%d/1", conf.Fps),
+		"-metadata", segmentTierMetadataKey+"="+job.Tier,
+		videoOnlyPath)
+
+	ffmpeg := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	ffmpeg.Stdout = os.Stdout
+	ffmpeg.Stderr = os.Stderr
+
+	if err := ffmpeg.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %w", err)
+	}
+
+	subtitleTracks, err := makeSubtitleTracks(conf.Fps, keptFrames, tempDir)
+	if err != nil {
+		return err
+	}
+
+	compactedPath := filepath.Join(tempDir, "compacted"+segmentExtension)
+
+	if err := muxSubtitles(ctx, videoOnlyPath, subtitleTracks, []string{segmentUtcOffsetMetadata(keptFrames[0].Timestamp)}, compactedPath); err != nil {
+		return err
+	}
+
+	// compacted segment replaces the first source (although encryption can change its extension)
+	outputPath := strings.TrimSuffix(sourcePaths[0], encryptedExtension)
+	if c.recipients != nil {
+		outputPath += encryptedExtension
+
+		if err := encryptFile(compactedPath, compactedPath+encryptedExtension, c.recipients); err != nil {
+			return fmt.Errorf("encrypt: %w", err)
+		}
+
+		compactedPath += encryptedExtension
+	}
+
+	segment, err := segmentRecordWithFileInfo(segmentRecord{
+		Screen:     job.Sources[0].Screen,
+		Path:       segmentPathRelative(conf.OutputDir, outputPath),
+		Start:      job.Sources[0].Start,
+		End:        job.Sources[len(job.Sources)-1].End,
+		FrameCount: len(keptFrames),
+		Codec:      c.encoder.Codec,
+		Tier:       job.Tier,
+	}, compactedPath)
+	if err != nil {
+		return err
+	}
+
+	if c.recipients != nil {
+		segment.Plaintext, err = sha256File(strings.TrimSuffix(compactedPath, encryptedExtension))
+		if err != nil {
+			return err
+		}
+	}
+
+	// copied next to the output first so the rename is atomic. the name doesn't parse as a
+	// segment, so a leftover one won't get mistaken for one.
+	outputTempPath := filepath.Join(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".compacting")
+
+	if err := osutil.MoveFile(compactedPath, outputTempPath); err != nil {
+		os.Remove(outputTempPath)
+		return err
+	}
+
+	if err := os.Rename(outputTempPath, outputPath); err != nil {
+		os.Remove(outputTempPath)
+		return err
+	}
+
+	removed := []string{}
+	for _, source := range job.Sources {
+		if source.Path != segment.Path {
+			removed = append(removed, source.Path)
+		}
+	}
+
+	if err := c.index.ReplaceSegments(ctx, removed, segment, keptFrames); err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+
+	for _, source := range job.Sources {
+		if err := c.ledger.RemoveSegment(source.Screen, source.Path, "compacted into "+job.Tier); err != nil {
+			return fmt.Errorf("ledger: %w", err)
+		}
+	}
+
+	if err := c.ledger.AddSegment(segment); err != nil {
+		return fmt.Errorf("ledger: %w", err)
+	}
+
+	for _, sourcePath := range sourcePaths {
+		if sourcePath == outputPath {
+			continue
+		}
+
+		// retention might have beaten us to it
+		if err := os.Remove(sourcePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	logl.Info.Printf(
+		"compacted %s into %s (%d segment(s), %d => %d frames, %d => %d bytes)",
+		job.Sources[0].Path,
+		job.Tier,
+		len(job.Sources),
+		len(frames),
+		len(keptFrames),
+		sizeBefore,
+		segment.Size)
+
+	return nil
+}
+
+func smallestVideoResolution(ctx context.Context, videoPaths []string) (int, int, error) {
+	smallestWidth, smallestHeight := 0, 0
+
+	for _, videoPath := range videoPaths {
+		width, height, err := probeVideoResolution(ctx, videoPath)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if smallestWidth == 0 || width*height < smallestWidth*smallestHeight {
+			smallestWidth, smallestHeight = width, height
+		}
+	}
+
+	return smallestWidth, smallestHeight, nil
+}
+
+func probeVideoResolution(ctx context.Context, videoPath string) (int, int, error) {
+	output, err := exec.CommandContext(
+		ctx,
+		"ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height",
+		"-of", "csv=p=0",
+		videoPath,
+	).Output()
+	if err != nil {
+		return 0, 0, fmt.Errorf("ffprobe: %w", err)
+	}
+
+	// "1920,1080"
+	widthSerialized, heightSerialized, _ := strings.Cut(strings.TrimSpace(string(output)), ",")
+
+	width, err := strconv.Atoi(widthSerialized)
+	if err != nil {
+		return 0, 0, fmt.Errorf("ffprobe width: %w", err)
+	}
+
+	height, err := strconv.Atoi(heightSerialized)
+	if err != nil {
+		return 0, 0, fmt.Errorf("ffprobe height: %w", err)
+	}
+
+	return width, height, nil
+}
+
+// segments without the tag are originals
+func probeSegmentTier(ctx context.Context, videoPath string) (string, error) {
+	tier, err := probeFormatTag(ctx, videoPath, segmentTierMetadataKey)
+	if err != nil {
+		return "", err
+	}
+
+	if tier != "" {
+		return tier, nil
+	}
+
+	return segmentTierOriginal, nil
+}
+
+// empty if the video doesn't have the tag
+func probeFormatTag(ctx context.Context, videoPath string, key string) (string, error) {
+	output, err := exec.CommandContext(
+		ctx,
+		"ffprobe",
+		"-v", "error",
+		"-show_entries", "format_tags="+key,
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		videoPath,
+	).Output()
+	if err != nil {
+		return "", fmt.Errorf("ffprobe: %w", err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// how many bytes decrypting the job's sources takes (age's overhead is negligible)
+func compactionDecryptBytes(sources []segmentRecord) int64 {
+	bytes := int64(0)
+	for _, source := range sources {
+		if strings.HasSuffix(source.Path, encryptedExtension) {
+			bytes += source.Size
+		}
+	}
+
+	return bytes
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestPlanCompaction(t *testing.T) {
+	now := time.Date(2021, 6, 28, 12, 0, 0, 0, time.UTC)
+
+	segment := func(screen ScreenId, start string, codec string, tier string) segmentRecord {
+		startTime, err := time.Parse("2006-01-02 15:04", start)
+		assert.Ok(t, err)
+
+		return segmentRecord{
+			Screen: screen,
+			Path:   string(screen) + "/" + start,
+			Start:  startTime,
+			Codec:  codec,
+			Tier:   tier,
+		}
+	}
+
+	// sorted by screen and start time
+	segments := []segmentRecord{
+		segment("DP-1", "2021-06-20 10:00", "hevc", segmentTierTimelapse),
+		segment("DP-1", "2021-06-24 10:00", "hevc", segmentTierDownsampled),
+		segment("DP-1", "2021-06-24 10:15", "hevc", segmentTierOriginal),
+		segment("DP-1", "2021-06-24 10:30", "av1", segmentTierOriginal),
+		segment("DP-1", "2021-06-26 09:00", "hevc", segmentTierOriginal),
+		segment("DP-1", "2021-06-26 09:15", "hevc", segmentTierDownsampled),
+		segment("DP-1", "2021-06-28 11:00", "hevc", segmentTierOriginal),
+		segment("HDMI-1", "2021-06-24 08:00", "hevc", segmentTierOriginal),
+	}
+
+	plan := func(rules compactionRules) string {
+		lines := []string{}
+		for _, job := range planCompaction(segments, rules, now) {
+			sources := []string{}
+			for _, source := range job.Sources {
+				sources = append(sources, source.Path)
+			}
+
+			lines = append(lines, job.Tier+": "+strings.Join(sources, ", "))
+		}
+
+		return strings.Join(lines, "\n")
+	}
+
+	assert.EqualString(t, plan(compactionRules{}), "")
+
+	assert.EqualString(t, plan(compactionRules{DownsampleAfter: 24 * time.Hour}), `downsampled: DP-1/2021-06-24 10:15
+downsampled: DP-1/2021-06-24 10:30
+downsampled: DP-1/2021-06-26 09:00
+downsampled: HDMI-1/2021-06-24 08:00`)
+
+	// days must have ended 48h ago. mixed codecs get their own time-lapses.
+	assert.EqualString(t, plan(compactionRules{TimelapseAfter: 48 * time.Hour}), `timelapse: DP-1/2021-06-24 10:00, DP-1/2021-06-24 10:15
+timelapse: DP-1/2021-06-24 10:30
+timelapse: HDMI-1/2021-06-24 08:00`)
+
+	// time-lapsed segments aren't also downsampled
+	assert.EqualString(t, plan(compactionRules{DownsampleAfter: 24 * time.Hour, TimelapseAfter: 48 * time.Hour}), `timelapse: DP-1/2021-06-24 10:00, DP-1/2021-06-24 10:15
+timelapse: DP-1/2021-06-24 10:30
+timelapse: HDMI-1/2021-06-24 08:00
+downsampled: DP-1/2021-06-26 09:00`)
+}
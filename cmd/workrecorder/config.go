@@ -0,0 +1,328 @@
+package main
+
+// Configuration is resolved in layers, later ones overriding earlier ones:
+//
+// 1. built-in defaults (see defaultConfig())
+// 2. YAML config file (--config or $WORKRECORDER_CONFIG)
+// 3. env vars ($WORKRECORDER_<FLAG NAME>, e.g. $WORKRECORDER_FRAME_INTERVAL)
+// 4. command line flags
+//
+// Env vars and flags share the same definitions (see bindConfigFlags()) so they can't drift apart.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	_ "time/tzdata" // the container image doesn't necessarily have the zone database
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	configEnvPrefix  = "WORKRECORDER_"
+	configPathEnvVar = configEnvPrefix + "CONFIG"
+)
+
+type Config struct {
+	OutputDir       string        `yaml:"output_dir"`        // where finished videos are stored
+	WorkDir         string        `yaml:"work_dir"`          // where segments are recorded until they're finished
+	FrameInterval   time.Duration `yaml:"frame_interval"`    // how often to snap a screenshot
+	SegmentMinutes  int           `yaml:"segment_minutes"`   // length of one video file
+	TimeZone        string        `yaml:"time_zone"`         // IANA zone ("Europe/Helsinki") for the day folders, filenames and time subtitles. "Local" = system's
+	Fps             int           `yaml:"fps"`               // playback frame rate of the videos
+	Quality         int           `yaml:"quality"`           // encoder's constant quality parameter (lower = better). 0 = encoder's default
+	Encoder         string        `yaml:"encoder"`           // encoder profile name or "auto"
+	CaptureBackend  string        `yaml:"capture_backend"`   // auto | shm | getimage
+	FfmpegInput     string        `yaml:"ffmpeg_input"`      // rawvideo | fifo
+	RenderNode      string        `yaml:"render_node"`       // explicit render node path. empty = auto-discover
+	RenderNodeMatch string        `yaml:"render_node_match"` // auto-discover by PCI vendor ID ("0x1002"), alias ("amd") or driver ("amdgpu")
+	ControlSocket   string        `yaml:"control_socket"`    // Unix socket for "ctl". empty = <output dir>/control.sock, "none" = disabled
+	IndexWindows    bool          `yaml:"index_windows"`     // store frames' active window classes and titles in the index (unencrypted even with encryption)
+
+	// pausing while nobody's looking
+	PauseWhenScreenInactive bool   `yaml:"pause_when_screen_inactive"` // pause while screensaver is on, displays are off or the screen is locked
+	LockerWindowClass       string `yaml:"locker_window_class"`        // regex for the screen locker's window class ("^i3lock$"). empty = don't look for one
+
+	// encryption at rest
+	EncryptionRecipientsFile string `yaml:"encryption_recipients_file"` // age recipients (public keys) to encrypt segments to. empty = no encryption
+	EncryptionIdentityFile   string `yaml:"encryption_identity_file"`   // age identity (private key) for reading encrypted segments
+
+	// redaction of sensitive windows
+	RedactWindows []string `yaml:"redact_windows"` // "class=<regex>" or "title=<regex>". matching windows are redacted from the recordings
+	RedactMode    string   `yaml:"redact_mode"`    // black | pixelate
+
+	// daily digests
+	DigestSigningKeyFile string `yaml:"digest_signing_key_file"` // Ed25519 private key (PKCS #8 PEM) to sign daily digests with. empty = unsigned
+	TimestampURL         string `yaml:"timestamp_url"`           // RFC 3161 timestamp authority to timestamp daily digests with. empty = no timestamps
+	TimestampCAFile      string `yaml:"timestamp_ca_file"`       // CA certificate(s) (PEM) to check the timestamp authority's certificate against
+
+	// retention. zero values disable the respective rule.
+	RetentionMaxAge            time.Duration `yaml:"retention_max_age"`              // delete segments older than this
+	RetentionMaxBytesPerScreen int64         `yaml:"retention_max_bytes_per_screen"` // delete oldest segments when a screen's recordings exceed this
+	RetentionMinFreeBytes      int64         `yaml:"retention_min_free_bytes"`       // delete oldest segments when output filesystem's free space drops below this
+	RetentionCheckInterval     time.Duration `yaml:"retention_check_interval"`       // how often to enforce the retention rules
+	RetentionDryRun            bool          `yaml:"retention_dry_run"`              // only log what would be pruned
+
+	// compaction of older footage. zero ages disable the respective tier.
+	CompactionDownsampleAfter     time.Duration `yaml:"compaction_downsample_after"`      // re-encode segments older than this
+	CompactionDownsampleScale     float64       `yaml:"compaction_downsample_scale"`      // resolution multiplier (0.5 = half width and height)
+	CompactionDownsampleFrameStep int           `yaml:"compaction_downsample_frame_step"` // keep every Nth frame
+	CompactionDownsampleQuality   int           `yaml:"compaction_downsample_quality"`    // encoder quality for re-encoding. 0 = encoder's default
+	CompactionTimelapseAfter      time.Duration `yaml:"compaction_timelapse_after"`       // merge days older than this into one time-lapse per screen
+	CompactionTimelapseFrameStep  int           `yaml:"compaction_timelapse_frame_step"`  // keep every Nth frame
+	CompactionCheckInterval       time.Duration `yaml:"compaction_check_interval"`        // how often to look for footage to compact
+}
+
+func defaultConfig() Config {
+	return Config{
+		OutputDir:      "/output",
+		WorkDir:        "/dev/shm",
+		FrameInterval:  5 * time.Second,
+		SegmentMinutes: 15,
+		TimeZone:       "UTC",
+		Fps:            2,
+		Quality:        0,
+		Encoder:        encoderAuto,
+		CaptureBackend: captureBackendAuto,
+		FfmpegInput:    ffmpegInputRawVideo,
+		IndexWindows:   true,
+
+		PauseWhenScreenInactive: true,
+
+		RedactWindows: []string{},
+		RedactMode:    redactModeBlack,
+
+		RetentionCheckInterval: 10 * time.Minute,
+
+		CompactionDownsampleScale:     0.5,
+		CompactionDownsampleFrameStep: 2,
+		CompactionTimelapseFrameStep:  12,
+		CompactionCheckInterval:       time.Hour,
+	}
+}
+
+func (c Config) Validate() error {
+	switch {
+	case c.OutputDir == "":
+		return errors.New("output_dir cannot be empty")
+	case c.WorkDir == "":
+		return errors.New("work_dir cannot be empty")
+	case c.SegmentMinutes <= 0 || 60%c.SegmentMinutes != 0:
+		// segments are aligned to the hour so they must divide the hour evenly
+		return fmt.Errorf("segment_minutes must divide an hour evenly; got %d", c.SegmentMinutes)
+	case !validTimeZone(c.TimeZone):
+		return fmt.Errorf("time_zone must be an IANA time zone name (like Europe/Helsinki), UTC or Local; got %s", c.TimeZone)
+	case c.FrameInterval < time.Second:
+		return fmt.Errorf("frame_interval must be at least 1s; got %s", c.FrameInterval)
+	case c.FrameInterval > time.Duration(c.SegmentMinutes)*time.Minute:
+		return fmt.Errorf("frame_interval %s is longer than a segment", c.FrameInterval)
+	case c.Fps <= 0:
+		return fmt.Errorf("fps must be positive; got %d", c.Fps)
+	case c.RetentionMaxAge < 0 || c.RetentionMaxBytesPerScreen < 0 || c.RetentionMinFreeBytes < 0:
+		return errors.New("retention limits cannot be negative")
+	case c.RetentionCheckInterval < time.Second:
+		return fmt.Errorf("retention_check_interval must be at least 1s; got %s", c.RetentionCheckInterval)
+	case c.CompactionDownsampleAfter < 0 || c.CompactionTimelapseAfter < 0:
+		return errors.New("compaction ages cannot be negative")
+	case c.CompactionDownsampleScale <= 0 || c.CompactionDownsampleScale > 1:
+		return fmt.Errorf("compaction_downsample_scale must be in (0, 1]; got %g", c.CompactionDownsampleScale)
+	case c.CompactionDownsampleFrameStep < 1 || c.CompactionTimelapseFrameStep < 1:
+		return errors.New("compaction frame steps must be at least 1")
+	case c.CompactionDownsampleQuality < 0:
+		return fmt.Errorf("compaction_downsample_quality cannot be negative; got %d", c.CompactionDownsampleQuality)
+	case c.CompactionCheckInterval < time.Second:
+		return fmt.Errorf("compaction_check_interval must be at least 1s; got %s", c.CompactionCheckInterval)
+	case c.RedactMode != redactModeBlack && c.RedactMode != redactModePixelate:
+		return fmt.Errorf("redact_mode must be one of %s; got %s", strings.Join(redactModes, ", "), c.RedactMode)
+	case c.TimestampURL != "" && !strings.HasPrefix(c.TimestampURL, "http://") && !strings.HasPrefix(c.TimestampURL, "https://"):
+		return fmt.Errorf("timestamp_url must be a http(s) URL; got %s", c.TimestampURL)
+	case !sliceContains(captureBackends, c.CaptureBackend):
+		return fmt.Errorf("capture_backend must be one of %s; got %s", strings.Join(captureBackends, ", "), c.CaptureBackend)
+	case !sliceContains(ffmpegInputs, c.FfmpegInput):
+		return fmt.Errorf("ffmpeg_input must be one of %s; got %s", strings.Join(ffmpegInputs, ", "), c.FfmpegInput)
+	case c.Quality < 0:
+		return fmt.Errorf("quality cannot be negative; got %d", c.Quality)
+	case c.Encoder != encoderAuto && encoderProfileByName(c.Encoder) == nil:
+		return fmt.Errorf("encoder must be %s or one of %s; got %s", encoderAuto, strings.Join(encoderNames(), ", "), c.Encoder)
+	}
+
+	if _, err := regexp.Compile(c.LockerWindowClass); err != nil {
+		return fmt.Errorf("locker_window_class: %w", err)
+	}
+
+	for _, rule := range c.RedactWindows {
+		if _, err := parseRedactionRule(rule); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// zone for the storage layout and the time subtitles
+func (c Config) Location() *time.Location {
+	loc, err := time.LoadLocation(c.TimeZone)
+	if err != nil { // shouldn't happen as the config was validated
+		return time.UTC
+	}
+
+	return loc
+}
+
+func validTimeZone(name string) bool {
+	_, err := time.LoadLocation(name)
+	return name != "" && err == nil // LoadLocation() takes "" as UTC
+}
+
+// logs each setting on its own line so the log stays greppable
+func (c Config) LogEffective(logl *logex.Leveled) error {
+	serialized, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(serialized)), "\n") {
+		logl.Info.Printf("config: %s", line)
+	}
+
+	return nil
+}
+
+// binds configuration flags to given config. the flags' defaults come from the config's current values.
+func bindConfigFlags(flags *pflag.FlagSet, conf *Config) {
+	flags.StringVar(&conf.OutputDir, "output-dir", conf.OutputDir, "Directory to store the videos in")
+	flags.StringVar(&conf.WorkDir, "work-dir", conf.WorkDir, "Directory to record segments in until they're finished (on disk, they survive a power loss)")
+	flags.DurationVar(&conf.FrameInterval, "frame-interval", conf.FrameInterval, "How often to take a screenshot")
+	flags.IntVar(&conf.SegmentMinutes, "segment-minutes", conf.SegmentMinutes, "Length of one video file in minutes (must divide an hour evenly)")
+	flags.StringVar(&conf.TimeZone, "time-zone", conf.TimeZone, "Time zone for the day folders, filenames and time subtitles (like Europe/Helsinki, or Local for the system's)")
+	flags.IntVar(&conf.Fps, "fps", conf.Fps, "Playback frame rate of the videos")
+	flags.IntVar(&conf.Quality, "quality", conf.Quality, "Encoder's constant quality parameter (lower = better quality). 0 = encoder's default")
+	flags.StringVar(&conf.RenderNode, "render-node", conf.RenderNode, "Render node to use for hardware encoding (default: auto-discover)")
+	flags.StringVar(&conf.RenderNodeMatch, "render-node-match", conf.RenderNodeMatch, "Auto-discover render node by PCI vendor ID, vendor (amd/intel/nvidia) or driver name")
+	flags.StringVar(&conf.Encoder, "encoder", conf.Encoder, "Encoder to use: "+encoderAuto+" or one of "+strings.Join(encoderNames(), ", "))
+	flags.StringVar(&conf.CaptureBackend, "capture-backend", conf.CaptureBackend, "How to capture the screens: "+strings.Join(captureBackends, ", "))
+	flags.StringVar(&conf.FfmpegInput, "ffmpeg-input", conf.FfmpegInput, "How frames are passed to FFmpeg: "+strings.Join(ffmpegInputs, ", "))
+	flags.StringVar(&conf.ControlSocket, "control-socket", conf.ControlSocket, "Unix socket for controlling the recorder with \"ctl\" (default: <output dir>/control.sock, \"none\" = disabled)")
+	flags.BoolVar(&conf.IndexWindows, "index-windows", conf.IndexWindows, "Store active window classes and titles in the index (it isn't encrypted even with encryption). Compaction makes the compacted segments' window subtitles from them")
+	flags.BoolVar(&conf.PauseWhenScreenInactive, "pause-when-screen-inactive", conf.PauseWhenScreenInactive, "Pause recording while screensaver is on, displays are off or the screen is locked")
+	flags.StringVar(&conf.LockerWindowClass, "locker-window-class", conf.LockerWindowClass, "Regex for the screen locker's window class (like ^i3lock$). Recording is paused while it's visible")
+	flags.StringVar(&conf.EncryptionRecipientsFile, "encryption-recipients-file", conf.EncryptionRecipientsFile, "File with age recipients (one per line) to encrypt segments to (default: no encryption)")
+	flags.StringVar(&conf.EncryptionIdentityFile, "encryption-identity-file", conf.EncryptionIdentityFile, "File with age identity for reading encrypted segments")
+	flags.StringArrayVar(&conf.RedactWindows, "redact-window", conf.RedactWindows, "Redact windows matching class=<regex> or title=<regex> (can be given many times)")
+	flags.StringVar(&conf.RedactMode, "redact-mode", conf.RedactMode, "How to redact windows: "+strings.Join(redactModes, ", "))
+	flags.StringVar(&conf.DigestSigningKeyFile, "digest-signing-key-file", conf.DigestSigningKeyFile, "Ed25519 private key (PKCS #8 PEM) to sign daily digests with (default: unsigned)")
+	flags.StringVar(&conf.TimestampURL, "timestamp-url", conf.TimestampURL, "RFC 3161 timestamp authority URL to timestamp daily digests with (default: no timestamps)")
+	flags.StringVar(&conf.TimestampCAFile, "timestamp-ca-file", conf.TimestampCAFile, "CA certificate(s) (PEM) to check the timestamp authority's certificate against")
+	flags.DurationVar(&conf.RetentionMaxAge, "retention-max-age", conf.RetentionMaxAge, "Delete segments older than this (0 = keep forever)")
+	flags.Int64Var(&conf.RetentionMaxBytesPerScreen, "retention-max-bytes-per-screen", conf.RetentionMaxBytesPerScreen, "Delete oldest segments when a screen's recordings exceed this many bytes (0 = no limit)")
+	flags.Int64Var(&conf.RetentionMinFreeBytes, "retention-min-free-bytes", conf.RetentionMinFreeBytes, "Delete oldest segments when output filesystem has less free bytes than this (0 = no limit)")
+	flags.DurationVar(&conf.RetentionCheckInterval, "retention-check-interval", conf.RetentionCheckInterval, "How often to enforce retention")
+	flags.BoolVar(&conf.RetentionDryRun, "retention-dry-run", conf.RetentionDryRun, "Only log what retention would prune")
+	flags.DurationVar(&conf.CompactionDownsampleAfter, "compaction-downsample-after", conf.CompactionDownsampleAfter, "Re-encode segments older than this with lower resolution, frame rate and quality (0 = never)")
+	flags.Float64Var(&conf.CompactionDownsampleScale, "compaction-downsample-scale", conf.CompactionDownsampleScale, "Resolution multiplier for downsampling")
+	flags.IntVar(&conf.CompactionDownsampleFrameStep, "compaction-downsample-frame-step", conf.CompactionDownsampleFrameStep, "Keep every Nth frame when downsampling")
+	flags.IntVar(&conf.CompactionDownsampleQuality, "compaction-downsample-quality", conf.CompactionDownsampleQuality, "Encoder quality for downsampling. 0 = encoder's default")
+	flags.DurationVar(&conf.CompactionTimelapseAfter, "compaction-timelapse-after", conf.CompactionTimelapseAfter, "Merge days older than this into one time-lapse per screen (0 = never)")
+	flags.IntVar(&conf.CompactionTimelapseFrameStep, "compaction-timelapse-frame-step", conf.CompactionTimelapseFrameStep, "Keep every Nth frame in time-lapses")
+	flags.DurationVar(&conf.CompactionCheckInterval, "compaction-check-interval", conf.CompactionCheckInterval, "How often to look for footage to compact")
+}
+
+// registers --config and the config flags. call the returned func (after flags are parsed)
+// to resolve the effective config.
+func registerConfigFlags(flags *pflag.FlagSet) func() (*Config, error) {
+	configPath := ""
+
+	flags.StringVarP(&configPath, "config", "c", "", "Path to YAML config file (also $"+configPathEnvVar+")")
+	defaults := defaultConfig()
+	bindConfigFlags(flags, &defaults) // values are read back in resolveConfig()
+
+	return func() (*Config, error) {
+		return resolveConfig(configPath, flags)
+	}
+}
+
+// resolves the effective config. "changedFlags" are the command line flags (only the ones
+// the user explicitly set are applied).
+func resolveConfig(configPath string, changedFlags *pflag.FlagSet) (*Config, error) {
+	conf := defaultConfig()
+
+	if configPath == "" {
+		configPath = os.Getenv(configPathEnvVar)
+	}
+
+	if configPath != "" {
+		if err := loadConfigFile(configPath, &conf); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", configPath, err)
+		}
+	}
+
+	// re-binding flags to our config so env vars and flags can be applied by flag name
+	target := pflag.NewFlagSet("config", pflag.ContinueOnError)
+	bindConfigFlags(target, &conf)
+
+	var err error
+	target.VisitAll(func(flag *pflag.Flag) {
+		if err != nil {
+			return
+		}
+
+		envVar := configEnvVarForFlag(flag.Name)
+
+		if value, found := os.LookupEnv(envVar); found {
+			if errSet := target.Set(flag.Name, value); errSet != nil {
+				err = fmt.Errorf("%s: %w", envVar, errSet)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	changedFlags.Visit(func(flag *pflag.Flag) {
+		if err != nil || target.Lookup(flag.Name) == nil { // not a config flag
+			return
+		}
+
+		// String() of a list isn't something Set() can parse back
+		if list, isList := flag.Value.(pflag.SliceValue); isList {
+			if errSet := target.Lookup(flag.Name).Value.(pflag.SliceValue).Replace(list.GetSlice()); errSet != nil {
+				err = fmt.Errorf("--%s: %w", flag.Name, errSet)
+			}
+
+			return
+		}
+
+		if errSet := target.Set(flag.Name, flag.Value.String()); errSet != nil {
+			err = fmt.Errorf("--%s: %w", flag.Name, errSet)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+
+	return &conf, nil
+}
+
+func loadConfigFile(path string, conf *Config) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// strict so typos in setting names don't go unnoticed
+	return yaml.UnmarshalStrict(content, conf)
+}
+
+// "frame-interval" => "WORKRECORDER_FRAME_INTERVAL"
+func configEnvVarForFlag(flagName string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+	"github.com/spf13/pflag"
+)
+
+func TestResolveConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "workrecorder.yaml")
+
+	assert.Ok(t, os.WriteFile(configPath, []byte("fps: 4\nframe_interval: 10s\nquality: 30\n"), 0600))
+
+	assert.Ok(t, os.Setenv("WORKRECORDER_QUALITY", "28"))
+	defer os.Unsetenv("WORKRECORDER_QUALITY")
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	bindConfigFlags(flags, &Config{})
+	assert.Ok(t, flags.Parse([]string{"--fps=3"}))
+
+	conf, err := resolveConfig(configPath, flags)
+	assert.Ok(t, err)
+
+	assert.EqualInt(t, conf.Fps, 3)                           // flag beats file
+	assert.EqualInt(t, conf.Quality, 28)                      // env beats file
+	assert.EqualString(t, conf.FrameInterval.String(), "10s") // file beats default
+	assert.EqualString(t, conf.OutputDir, "/output")          // default
+}
+
+func TestResolveConfigValidates(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	bindConfigFlags(flags, &Config{})
+	assert.Ok(t, flags.Parse([]string{"--segment-minutes=7"}))
+
+	_, err := resolveConfig("", flags)
+	assert.EqualString(t, err.Error(), "config: segment_minutes must divide an hour evenly; got 7")
+}
+
+func TestResolveConfigLists(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "workrecorder.yaml")
+
+	assert.Ok(t, os.WriteFile(configPath, []byte("redact_windows: [\"class=^KeePassXC$\"]\n"), 0600))
+
+	conf, err := resolveConfig(configPath, pflag.NewFlagSet("test", pflag.ContinueOnError))
+	assert.Ok(t, err)
+	assert.EqualString(t, strings.Join(conf.RedactWindows, " | "), "class=^KeePassXC$")
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	bindConfigFlags(flags, &Config{})
+	assert.Ok(t, flags.Parse([]string{"--redact-window=title=(?i)bank", "--redact-window=title=^a{1,3}$"}))
+
+	conf, err = resolveConfig(configPath, flags)
+	assert.Ok(t, err)
+	assert.EqualString(t, strings.Join(conf.RedactWindows, " | "), "title=(?i)bank | title=^a{1,3}$") // flag beats file
+}
+
+func TestResolveConfigTimeZone(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	bindConfigFlags(flags, &Config{})
+	assert.Ok(t, flags.Parse([]string{"--time-zone=Asia/Kolkata"}))
+
+	conf, err := resolveConfig("", flags)
+	assert.Ok(t, err)
+	assert.EqualString(t, conf.Location().String(), "Asia/Kolkata")
+	assert.EqualString(t, defaultConfig().Location().String(), "UTC")
+
+	flags = pflag.NewFlagSet("test", pflag.ContinueOnError)
+	bindConfigFlags(flags, &Config{})
+	assert.Ok(t, flags.Parse([]string{"--time-zone=Mars/Olympus_Mons"}))
+
+	_, err = resolveConfig("", flags)
+	assert.EqualString(t, err.Error(), "config: time_zone must be an IANA time zone name (like Europe/Helsinki), UTC or Local; got Mars/Olympus_Mons")
+}
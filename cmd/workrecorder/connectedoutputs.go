@@ -62,6 +62,10 @@ func getConnectedOutputs(X *xgb.Conn, root xproto.Window) ([]randrOutput, error)
 			continue
 		}
 
+		if outputInfo.Crtc == 0 { // connected but not enabled (e.g. lid closed or transient state while docking)
+			continue
+		}
+
 		// CRTC ("CRT Controller") is jargon for display controller.
 		// outputInfo.Crtcs "is the list of CRTCs that this output may be connected to"
 		// (= NOT currently connected to)
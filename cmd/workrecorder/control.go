@@ -0,0 +1,517 @@
+package main
+
+// Control socket for the running recorder: pausing, resuming, asking for status, taking a snapshot
+// right now and cutting the current segment. The protocol is one JSON request and one JSON response
+// (both newline-terminated) per connection, so it's scriptable with "socat" as well as "ctl".
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/os/osutil"
+)
+
+const (
+	controlCommandPause       = "pause"
+	controlCommandResume      = "resume"
+	controlCommandStatus      = "status"
+	controlCommandSnapshotNow = "snapshot-now"
+	controlCommandCutSegment  = "cut-segment"
+)
+
+var controlCommands = []string{
+	controlCommandPause,
+	controlCommandResume,
+	controlCommandStatus,
+	controlCommandSnapshotNow,
+	controlCommandCutSegment,
+}
+
+// control_socket value that disables the socket
+const controlSocketNone = "none"
+
+// snapshots are taken synchronously, so this has to cover capturing all screens
+const controlConnectionTimeout = 30 * time.Second
+
+const controlAcceptRetryInterval = time.Second
+
+const gapReasonPaused = "paused"
+
+type controlRequest struct {
+	Command  string `json:"command"`
+	Duration string `json:"duration,omitempty"` // for pause. Go duration ("15m"). empty = until resumed
+}
+
+type controlResponse struct {
+	Ok        bool             `json:"ok"`
+	Error     string           `json:"error,omitempty"`
+	Status    *recordingStatus `json:"status,omitempty"`
+	Snapshots []string         `json:"snapshots,omitempty"` // for snapshot-now. paths of the written files
+}
+
+type recordingStatus struct {
+	Paused      bool           `json:"paused"`
+	PausedSince *time.Time     `json:"paused_since,omitempty"`
+	PausedUntil *time.Time     `json:"paused_until,omitempty"` // nil = until resumed (or screen is active again)
+	AutoPause   string         `json:"auto_pause,omitempty"`   // screen inactivity reason, if that's (also) why we're paused
+	Screens     []screenStatus `json:"screens"`
+}
+
+type screenStatus struct {
+	Screen       ScreenId  `json:"screen"`
+	SegmentStart time.Time `json:"segment_start"` // zero if no segment in progress
+	Frames       int       `json:"frames"`        // frames in the current segment so far
+}
+
+// a period when nothing was recorded on purpose
+type recordingGap struct {
+	Start  time.Time
+	End    time.Time
+	Reason string   // gapReasonPaused | gapReasonFailing | screenInactive*
+	Screen ScreenId // empty = all screens
+}
+
+// state shared by the control socket and all screens' recorders
+type recordingControl struct {
+	mu            sync.Mutex
+	paused        bool   // by request
+	autoPause     string // reason screens are inactive. empty = they're not
+	pausedSince   time.Time
+	pauseReason   string      // what started the current pause (recorded with the gap)
+	pausedUntil   time.Time   // zero = until resumed
+	resumeTimer   *time.Timer // ends a pause with a duration
+	cutGeneration int         // incremented by each cut. recorders compare it to the one they started with
+	changed       chan struct{}
+	screens       map[ScreenId]screenStatus
+	onGap         func(recordingGap) // called when a pause ends
+}
+
+func newRecordingControl(onGap func(recordingGap)) *recordingControl {
+	return &recordingControl{
+		changed: make(chan struct{}),
+		screens: map[ScreenId]screenStatus{},
+		onGap:   onGap,
+	}
+}
+
+// closed when pause state or cut generation changes. get the channel before checking the state,
+// so a change between the two isn't missed.
+func (c *recordingControl) Changed() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.changed
+}
+
+// "duration" zero = until resumed. pausing while paused replaces the previous duration.
+func (c *recordingControl) Pause(duration time.Duration, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.pausedLocked() {
+		c.pausedSince = now
+		c.pauseReason = gapReasonPaused
+	}
+
+	c.paused = true
+
+	if c.resumeTimer != nil {
+		c.resumeTimer.Stop()
+		c.resumeTimer = nil
+	}
+
+	c.pausedUntil = time.Time{}
+	if duration > 0 {
+		until := now.Add(duration)
+		c.pausedUntil = until
+
+		c.resumeTimer = time.AfterFunc(duration, func() {
+			c.resumeIf(func() bool {
+				return c.pausedUntil.Equal(until) // not re-paused meanwhile
+			}, until)
+		})
+	}
+
+	c.notifyLocked()
+}
+
+// no-op if not paused. recording stays paused if the screens are inactive.
+func (c *recordingControl) Resume(now time.Time) {
+	c.resumeIf(func() bool { return true }, now)
+}
+
+func (c *recordingControl) resumeIf(condition func() bool, now time.Time) {
+	c.update(now, func() bool {
+		if !c.paused || !condition() {
+			return false
+		}
+
+		if c.resumeTimer != nil {
+			c.resumeTimer.Stop()
+			c.resumeTimer = nil
+		}
+
+		c.paused = false
+		c.pausedUntil = time.Time{}
+
+		return true
+	})
+}
+
+// pauses while "reason" is non-empty, regardless of pausing by request
+func (c *recordingControl) SetAutoPause(reason string, now time.Time) {
+	c.update(now, func() bool {
+		if reason == c.autoPause {
+			return false
+		}
+
+		if !c.pausedLocked() {
+			c.pausedSince = now
+			c.pauseReason = reason
+		}
+
+		c.autoPause = reason
+
+		return true
+	})
+}
+
+// "change" is called with the lock held and returns whether it changed anything
+func (c *recordingControl) update(now time.Time, change func() bool) {
+	gap, resumed := func() (recordingGap, bool) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		wasPaused := c.pausedLocked()
+
+		if !change() {
+			return recordingGap{}, false
+		}
+
+		c.notifyLocked()
+
+		if !wasPaused || c.pausedLocked() {
+			return recordingGap{}, false
+		}
+
+		gap := recordingGap{Start: c.pausedSince, End: now, Reason: c.pauseReason}
+
+		c.pausedSince = time.Time{}
+		c.pauseReason = ""
+
+		return gap, true
+	}()
+
+	// outside of the lock, as it does I/O
+	if resumed && c.onGap != nil {
+		c.onGap(gap)
+	}
+}
+
+func (c *recordingControl) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.pausedLocked()
+}
+
+func (c *recordingControl) pausedLocked() bool {
+	return c.paused || c.autoPause != ""
+}
+
+// makes recorders close their current segments and start new ones
+func (c *recordingControl) Cut() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cutGeneration++
+
+	c.notifyLocked()
+}
+
+func (c *recordingControl) CutGeneration() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cutGeneration
+}
+
+func (c *recordingControl) ReportScreen(status screenStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.screens[status.Screen] = status
+}
+
+func (c *recordingControl) ForgetScreen(screen ScreenId) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.screens, screen)
+}
+
+func (c *recordingControl) Status() recordingStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := recordingStatus{
+		Paused:    c.pausedLocked(),
+		AutoPause: c.autoPause,
+		Screens:   []screenStatus{},
+	}
+
+	if status.Paused {
+		pausedSince := c.pausedSince
+		status.PausedSince = &pausedSince
+
+		if !c.pausedUntil.IsZero() {
+			pausedUntil := c.pausedUntil
+			status.PausedUntil = &pausedUntil
+		}
+	}
+
+	for _, screen := range c.screens {
+		status.Screens = append(status.Screens, screen)
+	}
+
+	sort.Slice(status.Screens, func(i, j int) bool { return status.Screens[i].Screen < status.Screens[j].Screen })
+
+	return status
+}
+
+func (c *recordingControl) notifyLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// empty if disabled
+func controlSocketPath(conf Config) string {
+	switch conf.ControlSocket {
+	case controlSocketNone:
+		return ""
+	case "":
+		return filepath.Join(conf.OutputDir, "control.sock")
+	default:
+		return conf.ControlSocket
+	}
+}
+
+// "snapshot" takes a snapshot of each screen and returns the written files
+func serveControlSocket(
+	ctx context.Context,
+	socketPath string,
+	control *recordingControl,
+	snapshot func() ([]string, error),
+	logl *logex.Leveled,
+) error {
+	if err := removeStaleSocket(socketPath); err != nil {
+		return err
+	}
+
+	listener, err := listenUnixPrivate(socketPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socketPath)
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	logl.Info.Printf("listening on %s", socketPath)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			// like running out of file descriptors. might go away, and the recording goes on regardless.
+			logl.Error.Printf("accept: %v", err)
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(controlAcceptRetryInterval):
+			}
+
+			continue
+		}
+
+		go func() {
+			if err := handleControlConnection(conn, control, snapshot, logl); err != nil {
+				logl.Error.Printf("connection: %v", err)
+			}
+		}()
+	}
+}
+
+func handleControlConnection(
+	conn net.Conn,
+	control *recordingControl,
+	snapshot func() ([]string, error),
+	logl *logex.Leveled,
+) error {
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(controlConnectionTimeout)); err != nil {
+		return err
+	}
+
+	request := controlRequest{}
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		return err
+	}
+
+	response, err := handleControlRequest(request, control, snapshot, time.Now().UTC())
+	if err != nil {
+		response = &controlResponse{Ok: false, Error: err.Error()}
+	} else {
+		logl.Info.Printf("%s", request.Command)
+	}
+
+	return json.NewEncoder(conn).Encode(response)
+}
+
+func handleControlRequest(
+	request controlRequest,
+	control *recordingControl,
+	snapshot func() ([]string, error),
+	now time.Time,
+) (*controlResponse, error) {
+	response := &controlResponse{Ok: true}
+
+	switch request.Command {
+	case controlCommandPause:
+		duration := time.Duration(0)
+		if request.Duration != "" {
+			var err error
+			duration, err = time.ParseDuration(request.Duration)
+			if err != nil {
+				return nil, err
+			}
+
+			if duration <= 0 {
+				return nil, fmt.Errorf("pause duration must be positive; got %s", duration)
+			}
+		}
+
+		control.Pause(duration, now)
+	case controlCommandResume:
+		control.Resume(now)
+	case controlCommandStatus:
+	case controlCommandSnapshotNow:
+		snapshots, err := snapshot()
+		if err != nil {
+			return nil, fmt.Errorf("snapshot: %w", err)
+		}
+
+		response.Snapshots = snapshots
+	case controlCommandCutSegment:
+		control.Cut()
+	default:
+		return nil, fmt.Errorf("unknown command '%s'", request.Command)
+	}
+
+	status := control.Status()
+	response.Status = &status
+
+	return response, nil
+}
+
+// made in a private dir and renamed into place after chmod, so nobody can connect while it has umask's permissions
+func listenUnixPrivate(socketPath string) (net.Listener, error) {
+	// next to the socket, as it can't be renamed across filesystems. a leftover one isn't taken
+	// for a screen, as listScreens() skips dot-directories.
+	privateDir, err := os.MkdirTemp(filepath.Dir(socketPath), ".control-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(privateDir)
+
+	tempPath := filepath.Join(privateDir, "control.sock")
+
+	listener, err := net.Listen("unix", tempPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// the temp path is gone by the time the listener is closed
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tempPath, osutil.FileMode(osutil.OwnerRW, osutil.GroupNone, osutil.OtherNone)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	if err := os.Rename(tempPath, socketPath); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// a previous run that didn't exit cleanly leaves the socket behind. refuses to remove anything
+// else than a socket, in case the path is misconfigured.
+func removeStaleSocket(socketPath string) error {
+	info, err := os.Lstat(socketPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("control socket %s: exists and is not a socket", socketPath)
+	}
+
+	// is another instance using it?
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %s: in use (is another instance running?)", socketPath)
+	}
+
+	return os.Remove(socketPath)
+}
+
+// client side of the socket
+func sendControlRequest(socketPath string, request controlRequest) (*controlResponse, error) {
+	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("%w (is the recorder running?)", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(controlConnectionTimeout + 5*time.Second)); err != nil {
+		return nil, err
+	}
+
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return nil, err
+	}
+
+	response := controlResponse{}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	if !response.Ok {
+		return nil, errors.New(response.Error)
+	}
+
+	return &response, nil
+}
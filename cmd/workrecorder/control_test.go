@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestRecordingControlPause(t *testing.T) {
+	gaps := make(chan recordingGap, 1)
+	control := newRecordingControl(func(gap recordingGap) { gaps <- gap })
+
+	start := time.Date(2021, 6, 28, 12, 0, 0, 0, time.UTC)
+
+	changed := control.Changed()
+	control.Pause(0, start)
+	<-changed // would hang if not notified
+
+	assert.Assert(t, control.Paused())
+
+	// resuming while not paused is a no-op, pausing while paused keeps the original start
+	control.Pause(0, start.Add(time.Minute))
+	control.Resume(start.Add(10 * time.Minute))
+	control.Resume(start.Add(11 * time.Minute))
+
+	assert.Assert(t, !control.Paused())
+
+	gap := <-gaps
+	assert.EqualString(t, gap.Start.Format(time.RFC3339)+" - "+gap.End.Format(time.RFC3339), "2021-06-28T12:00:00Z - 2021-06-28T12:10:00Z")
+	assert.EqualString(t, gap.Reason, "paused")
+
+	// pause with a duration resumes by itself
+	control.Pause(10*time.Millisecond, time.Now())
+	<-gaps
+	assert.Assert(t, !control.Paused())
+
+	generation := control.CutGeneration()
+	control.Cut()
+	assert.EqualInt(t, control.CutGeneration(), generation+1)
+}
+
+func TestRecordingControlAutoPause(t *testing.T) {
+	gaps := []string{}
+	control := newRecordingControl(func(gap recordingGap) {
+		gaps = append(gaps, gap.Start.Format("15:04")+" - "+gap.End.Format("15:04")+" "+gap.Reason)
+	})
+
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2021, 6, 28, hour, minute, 0, 0, time.UTC)
+	}
+
+	control.SetAutoPause("screensaver", at(12, 0))
+	control.SetAutoPause("display off", at(12, 10))
+	control.SetAutoPause("", at(12, 30))
+
+	// resuming by request doesn't override the screen being locked
+	control.Pause(0, at(13, 0))
+	control.SetAutoPause("locked", at(13, 5))
+	control.Resume(at(13, 10))
+	assert.Assert(t, control.Paused())
+	assert.EqualString(t, control.Status().AutoPause, "locked")
+	control.SetAutoPause("", at(13, 20))
+	assert.Assert(t, !control.Paused())
+
+	assert.EqualString(t, strings.Join(gaps, "\n"), `12:00 - 12:30 screensaver
+13:00 - 13:20 paused`)
+}
+
+func TestControlSocket(t *testing.T) {
+	conf := defaultConfig()
+	conf.OutputDir = t.TempDir()
+
+	control := newRecordingControl(nil)
+	control.ReportScreen(screenStatus{
+		Screen:       "DP-1",
+		SegmentStart: time.Date(2021, 6, 28, 12, 0, 0, 0, time.UTC),
+		Frames:       42,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serveControlSocket(ctx, controlSocketPath(conf), control, func() ([]string, error) {
+			return []string{filepath.Join(conf.OutputDir, "DP-1/snapshots/2021-06-28/12-07-35.png")}, nil
+		}, logex.Levels(logex.Discard))
+	}()
+	defer func() {
+		cancel()
+		assert.Ok(t, <-served)
+	}()
+
+	ctlOutput := func(request controlRequest) string {
+		output := &bytes.Buffer{}
+
+		// the socket might not be listening yet
+		var err error
+		for attempt := 0; attempt < 100; attempt++ {
+			output.Reset()
+			if err = ctl(conf, request, output); err == nil {
+				break
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Ok(t, err)
+
+		return output.String()
+	}
+
+	assert.EqualString(t, ctlOutput(controlRequest{Command: "status"}), "recording\nDP-1\tsegment 2021-06-28T12:00:00Z\t42 frame(s)\n")
+
+	socketInfo, err := os.Stat(controlSocketPath(conf))
+	assert.Ok(t, err)
+	assert.EqualString(t, socketInfo.Mode().Perm().String(), "-rw-------")
+
+	privateDirs, err := filepath.Glob(filepath.Join(conf.OutputDir, ".control-*"))
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(privateDirs), 0)
+
+	assert.Matches(t, ctlOutput(controlRequest{Command: "pause", Duration: "1h"}), `^paused since .+ until .+\n`)
+	assert.Assert(t, control.Paused())
+
+	assert.Matches(t, ctlOutput(controlRequest{Command: "resume"}), `^recording\n`)
+
+	assert.EqualString(t, ctlOutput(controlRequest{Command: "snapshot-now"}), filepath.Join(conf.OutputDir, "DP-1/snapshots/2021-06-28/12-07-35.png")+"\n")
+
+	assert.EqualString(t, ctl(conf, controlRequest{Command: "pause", Duration: "-5m"}, &bytes.Buffer{}).Error(), "pause duration must be positive; got -5m0s")
+	assert.EqualString(t, ctl(conf, controlRequest{Command: "stop"}, &bytes.Buffer{}).Error(), "command must be one of pause, resume, status, snapshot-now, cut-segment; got stop")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/function61/gokit/os/osutil"
+	"github.com/spf13/cobra"
+)
+
+func ctlEntrypoint() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ctl <command> [duration]",
+		Short: "Controls the running recorder",
+		Long: `Controls the running recorder over its control socket.
+
+Commands:
+
+    pause [duration]  stop recording until resumed (or for duration, e.g. "15m")
+    resume            continue recording
+    status            show whether recording and each screen's current segment
+    snapshot-now      save a PNG of each screen right now
+    cut-segment       finish the current segments and start new ones`,
+		Args: cobra.RangeArgs(1, 2),
+	}
+
+	resolveConfig := registerConfigFlags(cmd.Flags())
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		osutil.ExitIfError(func() error {
+			conf, err := resolveConfig()
+			if err != nil {
+				return err
+			}
+
+			request := controlRequest{Command: args[0]}
+
+			if len(args) >= 2 {
+				if request.Command != controlCommandPause {
+					return fmt.Errorf("only %s takes a duration", controlCommandPause)
+				}
+
+				request.Duration = args[1]
+			}
+
+			return ctl(*conf, request, os.Stdout)
+		}())
+	}
+
+	return cmd
+}
+
+func ctl(conf Config, request controlRequest, output io.Writer) error {
+	if !sliceContains(controlCommands, request.Command) {
+		return fmt.Errorf("command must be one of %s; got %s", strings.Join(controlCommands, ", "), request.Command)
+	}
+
+	socketPath := controlSocketPath(conf)
+	if socketPath == "" {
+		return errors.New("control socket is disabled (control_socket: none)")
+	}
+
+	response, err := sendControlRequest(socketPath, request)
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range response.Snapshots {
+		fmt.Fprintln(output, snapshot)
+	}
+
+	if response.Status != nil && request.Command != controlCommandSnapshotNow {
+		printRecordingStatus(*response.Status, output)
+	}
+
+	return nil
+}
+
+func printRecordingStatus(status recordingStatus, output io.Writer) {
+	switch {
+	case !status.Paused:
+		fmt.Fprintln(output, "recording")
+	case status.AutoPause != "":
+		fmt.Fprintf(output, "paused since %s (%s)\n", status.PausedSince.Format(time.RFC3339), status.AutoPause)
+	case status.PausedUntil != nil:
+		fmt.Fprintf(output, "paused since %s until %s\n", status.PausedSince.Format(time.RFC3339), status.PausedUntil.Format(time.RFC3339))
+	default:
+		fmt.Fprintf(output, "paused since %s until resumed\n", status.PausedSince.Format(time.RFC3339))
+	}
+
+	for _, screen := range status.Screens {
+		if screen.SegmentStart.IsZero() {
+			fmt.Fprintf(output, "%s\tno segment in progress\n", screen.Screen)
+			continue
+		}
+
+		fmt.Fprintf(output, "%s\tsegment %s\t%d frame(s)\n", screen.Screen, screen.SegmentStart.Format(time.RFC3339), screen.Frames)
+	}
+}
+
+func sliceContains(items []string, item string) bool {
+	for _, candidate := range items {
+		if candidate == item {
+			return true
+		}
+	}
+
+	return false
+}
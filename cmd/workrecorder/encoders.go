@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+)
+
+const encoderAuto = "auto"
+
+// a GPU that can't do the codec fails right away, but initializing the device can take a moment
+const trialEncodeTimeout = 20 * time.Second
+
+// knows how to drive one ffmpeg encoder
+type encoderProfile struct {
+	Name            string // ffmpeg's name for the encoder
+	Codec           string // ffmpeg's name for the codec the encoder produces
+	NeedsRenderNode bool   // hardware encoders need a VA-API render node
+	DefaultQuality  int
+	// args that need to go before inputs (like hardware device initialization)
+	InputArgs func(renderNode string) []string
+	// filters the encoder needs at the end of the filter chain (format conversion, hardware upload)
+	Filters []string
+	// encoder args
+	CodecArgs func(quality int) []string
+}
+
+// in order of preference. hardware first, then the software encoders with the best
+// size/CPU usage tradeoff for screen content.
+var encoderProfiles = []encoderProfile{
+	{
+		Name:            "hevc_vaapi",
+		Codec:           "hevc",
+		NeedsRenderNode: true,
+		DefaultQuality:  24,
+		InputArgs: func(renderNode string) []string {
+			return []string{"-vaapi_device", renderNode} // looks like "/dev/dri/renderD129"
+		},
+		Filters: []string{"format=nv12", "hwupload", "scale_vaapi="},
+		CodecArgs: func(quality int) []string {
+			return []string{
+				"-c:v", "hevc_vaapi",
+				"-qp", strconv.Itoa(quality),
+			}
+		},
+	},
+	{
+		Name:           "libx265",
+		Codec:          "hevc",
+		DefaultQuality: 28,
+		InputArgs:      noInputArgs,
+		Filters:        softwareFilters(),
+		CodecArgs: func(quality int) []string {
+			return []string{
+				"-c:v", "libx265",
+				"-preset", "veryfast",
+				"-x265-params", "log-level=error", // x265 is chatty even with "-loglevel error"
+				"-crf", strconv.Itoa(quality),
+			}
+		},
+	},
+	{
+		Name:           "libsvtav1",
+		Codec:          "av1",
+		DefaultQuality: 35,
+		InputArgs:      noInputArgs,
+		Filters:        softwareFilters(),
+		CodecArgs: func(quality int) []string {
+			return []string{
+				"-c:v", "libsvtav1",
+				"-preset", "10",
+				"-crf", strconv.Itoa(quality),
+			}
+		},
+	},
+	{
+		Name:           "libvpx-vp9",
+		Codec:          "vp9",
+		DefaultQuality: 35,
+		InputArgs:      noInputArgs,
+		Filters:        softwareFilters(),
+		CodecArgs: func(quality int) []string {
+			return []string{
+				"-c:v", "libvpx-vp9",
+				"-deadline", "realtime",
+				"-cpu-used", "8",
+				"-row-mt", "1",
+				"-b:v", "0", // needed for constant quality mode
+				"-crf", strconv.Itoa(quality),
+			}
+		},
+	},
+	{
+		Name:           "libx264",
+		Codec:          "h264",
+		DefaultQuality: 23,
+		InputArgs:      noInputArgs,
+		Filters:        softwareFilters(),
+		CodecArgs: func(quality int) []string {
+			return []string{
+				"-c:v", "libx264",
+				"-preset", "veryfast",
+				"-crf", strconv.Itoa(quality),
+			}
+		},
+	},
+}
+
+// quality 0 means "use the encoder's default". "preFilters" (like scaling) run before the
+// encoder's own filters.
+func (e encoderProfile) Args(renderNode string, quality int, preFilters ...string) ([]string, []string) {
+	if quality == 0 {
+		quality = e.DefaultQuality
+	}
+
+	filters := append(append([]string{}, preFilters...), e.Filters...)
+
+	return e.InputArgs(renderNode), append([]string{"-vf", strings.Join(filters, ",")}, e.CodecArgs(quality)...)
+}
+
+func encoderProfileByName(name string) *encoderProfile {
+	for _, profile := range encoderProfiles {
+		if profile.Name == name {
+			profile := profile // pin
+			return &profile
+		}
+	}
+
+	return nil
+}
+
+// picks the wanted encoder (or with "auto" the most preferred one) that ffmpeg supports
+func selectEncoder(wanted string, ffmpegSupports map[string]bool, haveRenderNode bool) (*encoderProfile, error) {
+	usable := func(profile encoderProfile) error {
+		if !ffmpegSupports[profile.Name] {
+			return fmt.Errorf("encoder %s not supported by ffmpeg", profile.Name)
+		}
+
+		if profile.NeedsRenderNode && !haveRenderNode {
+			return fmt.Errorf("encoder %s needs a render node but none available", profile.Name)
+		}
+
+		return nil
+	}
+
+	if wanted != encoderAuto {
+		profile := encoderProfileByName(wanted)
+		if profile == nil {
+			return nil, fmt.Errorf("unknown encoder: %s", wanted)
+		}
+
+		if err := usable(*profile); err != nil {
+			return nil, err
+		}
+
+		return profile, nil
+	}
+
+	for _, profile := range encoderProfiles {
+		if usable(profile) == nil {
+			profile := profile // pin
+			return &profile, nil
+		}
+	}
+
+	return nil, fmt.Errorf("none of the encoders are usable: %s", strings.Join(encoderNames(), ", "))
+}
+
+// asks ffmpeg which encoders it was built with
+func ffmpegSupportedEncoders(ctx context.Context) (map[string]bool, error) {
+	output, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg -encoders: %w", err)
+	}
+
+	return parseFfmpegEncoders(string(output)), nil
+}
+
+// "ffmpeg -encoders" only tells what ffmpeg was built with. a hardware encoder is listed even if the
+// GPU can't encode the codec (like hevc_vaapi on a GPU without HEVC encoding), and then every
+// segment would fail. so hardware encoders are dropped from "ffmpegSupports" unless a short trial
+// encode on the render node succeeds.
+func trialEncodeHardwareEncoders(ctx context.Context, ffmpegSupports map[string]bool, renderNode string, logl *logex.Leveled) map[string]bool {
+	usable := map[string]bool{}
+	for name, supported := range ffmpegSupports {
+		usable[name] = supported
+	}
+
+	for _, profile := range encoderProfiles {
+		if !profile.NeedsRenderNode || !ffmpegSupports[profile.Name] {
+			continue
+		}
+
+		if err := trialEncode(ctx, profile, renderNode); err != nil {
+			logl.Info.Printf("encoder %s failed a trial encode on %s, not using it: %v", profile.Name, renderNode, err)
+			usable[profile.Name] = false
+		}
+	}
+
+	return usable
+}
+
+func trialEncode(ctx context.Context, profile encoderProfile, renderNode string) error {
+	ctx, cancel := context.WithTimeout(ctx, trialEncodeTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "ffmpeg", trialEncodeArgs(profile, renderNode)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// encodes a few generated frames, throwing away the result
+func trialEncodeArgs(profile encoderProfile, renderNode string) []string {
+	inputArgs, outputArgs := profile.Args(renderNode, 0)
+
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error",
+	}
+	args = append(args, inputArgs...)
+	args = append(args,
+		"-f", "lavfi",
+		"-i", "color=c=black:s=640x360:r=2",
+		"-frames:v", "2")
+	args = append(args, outputArgs...)
+	args = append(args,
+		"-f", "null",
+		"-")
+
+	return args
+}
+
+// parses output that looks like this:
+//
+//	Encoders:
+//	 V..... = Video
+//	 ...
+//	 ------
+//	 V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+//	 V....D hevc_vaapi           H.265/HEVC (VAAPI) (codec hevc)
+func parseFfmpegEncoders(output string) map[string]bool {
+	supported := map[string]bool{}
+
+	legendSeen := false
+
+	lines := bufio.NewScanner(strings.NewReader(output))
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+
+		if !legendSeen {
+			legendSeen = len(fields) == 1 && strings.HasPrefix(fields[0], "---")
+			continue
+		}
+
+		if len(fields) >= 2 && strings.HasPrefix(fields[0], "V") { // only interested in video encoders
+			supported[fields[1]] = true
+		}
+	}
+
+	return supported
+}
+
+func encoderNames() []string {
+	names := []string{}
+	for _, profile := range encoderProfiles {
+		names = append(names, profile.Name)
+	}
+
+	return names
+}
+
+// software encoders get raw RGB frames (BMP) which they can't consume directly
+func softwareFilters() []string {
+	return []string{"format=yuv420p"}
+}
+
+func noInputArgs(_ string) []string {
+	return nil
+}
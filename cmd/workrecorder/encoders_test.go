@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestParseFfmpegEncoders(t *testing.T) {
+	supported := parseFfmpegEncoders(`Encoders:
+ V..... = Video
+ A..... = Audio
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+ V....D hevc_vaapi           H.265/HEVC (VAAPI) (codec hevc)
+ A....D aac                  AAC (Advanced Audio Coding)
+`)
+
+	assert.Assert(t, supported["libx264"])
+	assert.Assert(t, supported["hevc_vaapi"])
+	assert.Assert(t, !supported["aac"])
+	assert.Assert(t, !supported["="])
+}
+
+func TestSelectEncoder(t *testing.T) {
+	ffmpegSupports := map[string]bool{
+		"hevc_vaapi": true,
+		"libx264":    true,
+		"libvpx-vp9": true,
+	}
+
+	selectedName := func(wanted string, haveRenderNode bool) string {
+		encoder, err := selectEncoder(wanted, ffmpegSupports, haveRenderNode)
+		if err != nil {
+			return err.Error()
+		}
+
+		return encoder.Name
+	}
+
+	assert.EqualString(t, selectedName("auto", true), "hevc_vaapi")
+	assert.EqualString(t, selectedName("auto", false), "libvpx-vp9")
+	assert.EqualString(t, selectedName("libx264", true), "libx264")
+	assert.EqualString(t, selectedName("libx265", true), "encoder libx265 not supported by ffmpeg")
+	assert.EqualString(t, selectedName("hevc_vaapi", false), "encoder hevc_vaapi needs a render node but none available")
+}
+
+func TestTrialEncodeArgs(t *testing.T) {
+	assert.EqualString(t, strings.Join(trialEncodeArgs(*encoderProfileByName("hevc_vaapi"), "/dev/dri/renderD129"), " "), "-hide_banner -loglevel error -vaapi_device /dev/dri/renderD129 -f lavfi -i color=c=black:s=640x360:r=2 -frames:v 2 -vf format=nv12,hwupload,scale_vaapi= -c:v hevc_vaapi -qp 24 -f null -")
+}
@@ -0,0 +1,149 @@
+package main
+
+// Finished segments can be encrypted to one or more age (https://age-encryption.org/) recipients
+// before they leave the work dir (RAM by default), so plaintext never touches persistent storage.
+// The recorder only needs the public keys. Reading the recordings back (at, serve, reindex,
+// compaction, cat) needs an identity.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+	"github.com/function61/gokit/os/osutil"
+)
+
+// one recipient per line, like age's "-R" (generate keys with $ age-keygen)
+func loadEncryptionRecipients(path string) ([]age.Recipient, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	recipients, err := age.ParseRecipients(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return recipients, nil
+}
+
+// like age's "-i"
+func loadEncryptionIdentities(path string) ([]age.Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return identities, nil
+}
+
+func encryptFile(plaintextPath string, ciphertextPath string, recipients []age.Recipient) error {
+	plaintext, err := os.Open(plaintextPath)
+	if err != nil {
+		return err
+	}
+	defer plaintext.Close()
+
+	ciphertext, err := os.OpenFile(ciphertextPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, osutil.FileMode(osutil.OwnerRW, osutil.GroupNone, osutil.OtherNone))
+	if err != nil {
+		return err
+	}
+	defer ciphertext.Close() // double close intentional
+
+	encrypter, err := age.Encrypt(ciphertext, recipients...)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(encrypter, plaintext); err != nil {
+		return err
+	}
+
+	if err := encrypter.Close(); err != nil { // writes the last chunk
+		return err
+	}
+
+	return ciphertext.Close()
+}
+
+// writes segment's plaintext to "output"
+func decryptSegment(segment segmentFile, identities []age.Identity, output io.Writer) error {
+	file, err := os.Open(segment.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if !segment.Encrypted {
+		_, err := io.Copy(output, file)
+		return err
+	}
+
+	decrypter, err := age.Decrypt(file, identities...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", segment.Path, err)
+	}
+
+	_, err = io.Copy(output, decrypter)
+	return err
+}
+
+// for tools that need the segment as a plaintext file. encrypted segments are decrypted into the
+// work dir. call the returned cleanup func when done with the file.
+func plaintextSegment(conf Config, segment segmentFile) (string, func(), error) {
+	if !segment.Encrypted {
+		return segment.Path, func() {}, nil
+	}
+
+	if conf.EncryptionIdentityFile == "" {
+		return "", nil, fmt.Errorf("%s: %w", segment.Path, errNoEncryptionIdentity)
+	}
+
+	identities, err := loadEncryptionIdentities(conf.EncryptionIdentityFile)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tempDir, err := os.MkdirTemp(conf.WorkDir, "workrecorder-decrypted-*")
+	if err != nil {
+		return "", nil, err
+	}
+
+	cleanup := func() {
+		os.RemoveAll(tempDir)
+	}
+
+	plaintextPath := filepath.Join(tempDir, "segment"+segmentExtension)
+
+	if err := func() error {
+		plaintext, err := os.Create(plaintextPath)
+		if err != nil {
+			return err
+		}
+		defer plaintext.Close() // double close intentional
+
+		if err := decryptSegment(segment, identities, plaintext); err != nil {
+			return err
+		}
+
+		return plaintext.Close()
+	}(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return plaintextPath, cleanup, nil
+}
+
+var errNoEncryptionIdentity = errors.New("segment is encrypted but encryption_identity_file not set")
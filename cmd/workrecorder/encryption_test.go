@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestEncryptAndDecryptSegment(t *testing.T) {
+	dir := t.TempDir()
+
+	alice, err := age.GenerateX25519Identity()
+	assert.Ok(t, err)
+	bob, err := age.GenerateX25519Identity()
+	assert.Ok(t, err)
+	mallory, err := age.GenerateX25519Identity()
+	assert.Ok(t, err)
+
+	recipientsPath := filepath.Join(dir, "recipients.txt")
+	assert.Ok(t, os.WriteFile(recipientsPath, []byte("# comments are allowed\n"+alice.Recipient().String()+"\n"+bob.Recipient().String()+"\n"), 0600))
+
+	recipients, err := loadEncryptionRecipients(recipientsPath)
+	assert.Ok(t, err)
+	assert.Assert(t, len(recipients) == 2)
+
+	plaintextPath := filepath.Join(dir, "12-15-00.mkv")
+	assert.Ok(t, os.WriteFile(plaintextPath, []byte("video"), 0600))
+
+	segment := segmentFile{Path: plaintextPath + encryptedExtension, Encrypted: true}
+	assert.Ok(t, encryptFile(plaintextPath, segment.Path, recipients))
+
+	ciphertext, err := os.ReadFile(segment.Path)
+	assert.Ok(t, err)
+	assert.Assert(t, !bytes.Contains(ciphertext, []byte("video")))
+
+	decrypt := func(identity age.Identity) (string, error) {
+		plaintext := &bytes.Buffer{}
+		err := decryptSegment(segment, []age.Identity{identity}, plaintext)
+		return plaintext.String(), err
+	}
+
+	for _, identity := range []age.Identity{alice, bob} {
+		plaintext, err := decrypt(identity)
+		assert.Ok(t, err)
+		assert.EqualString(t, plaintext, "video")
+	}
+
+	_, err = decrypt(mallory)
+	assert.Assert(t, err != nil)
+}
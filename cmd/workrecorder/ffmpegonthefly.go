@@ -6,33 +6,47 @@ package main
 // FIFOs we can make them block until more data comes available.
 //
 // tl;dr: we'll feed it with realtime data as it becomes available.
+//
+// The concat list is read in full when FFmpeg starts, so a frame's duration can't go in it. Instead
+// each FIFO item is a concat list of its own, with one image and its duration. That lets a frame
+// that stays on screen for many ticks be passed just once.
 
 import (
 	"context"
 	"errors"
 	"fmt"
+	"image"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/BurntSushi/xgbutil/xgraphics"
 	"github.com/function61/gokit/os/osutil"
+	"golang.org/x/image/bmp"
 	"golang.org/x/sys/unix"
 )
 
+// produce() can return this to end the input before "itemCount" items are produced
+var errEndInputEarly = errors.New("end input early")
+
+// returns number of items produced
 func ffmpegWithOnTheFlyInput(
 	ctx context.Context,
 	itemCount int,
 	tempDir string,
 	produce func(ffmpegInput io.Writer, idx int) error,
 	runFfmpeg func(concatFilename string) error,
-) error {
+) (int, error) {
 	fifo1 := filepath.Join(tempDir, "fifo1")
 	fifo2 := filepath.Join(tempDir, "fifo2")
 
 	if err := coalesce(mkfifo(fifo1), mkfifo(fifo2)); err != nil {
-		return err
+		return 0, err
 	}
 
 	// ffmpeg seems to open the next file while the old is open (or there is some other
@@ -55,7 +69,7 @@ func ffmpegWithOnTheFlyInput(
 
 		return writeFfmpegConcatInputFile(ffmpegInputFile, ffmpegInputFifos)
 	}(); err != nil {
-		return err
+		return 0, err
 	}
 
 	done := make(chan error, 1)
@@ -80,11 +94,135 @@ func ffmpegWithOnTheFlyInput(
 
 	for idx := 0; idx < itemCount; idx++ {
 		if err := feedIntoFifo(fifoByIndex(idx), idx); err != nil {
+			if err != errEndInputEarly {
+				return idx, err
+			}
+
+			// ffmpeg has opened the FIFO we just closed without writing anything to it. it fails
+			// to probe the empty input, which it treats as end of input and finalizes the output.
+			errFfmpeg := <-done
+
+			if idx == 0 { // ffmpeg fails on no input at all, which is expected
+				return 0, nil
+			}
+
+			return idx, errFfmpeg
+		}
+	}
+
+	return itemCount, <-done
+}
+
+// the "fifo" pipeline. "produce" runs in its own goroutine, as here FFmpeg pulls the frames.
+func encodeFramesViaFifos(
+	ctx context.Context,
+	fps int,
+	maxFrames int,
+	tempDir string,
+	produce func(emit frameEmitter) error,
+	ffmpegArgs func(inputArgs []string) []string,
+) error {
+	frames := make(chan capturedFrame)
+	consumerGone := make(chan struct{})
+	produced := make(chan error, 1)
+
+	go func() {
+		defer close(frames)
+
+		produced <- produce(func(frame capturedFrame) error {
+			select {
+			case frames <- frame:
+				return nil
+			case <-consumerGone:
+				return errors.New("FFmpeg quit before all frames were passed")
+			}
+		})
+	}()
+
+	frameFiles := []string{}
+	var previousImage *xgraphics.Image
+
+	_, errFfmpeg := ffmpegWithOnTheFlyInput(ctx, maxFrames, tempDir, func(ffmpegItem io.Writer, idx int) error {
+		frame, ok := <-frames
+		if !ok {
+			return errEndInputEarly
+		}
+
+		// the last frame is emitted in two parts. no need to write it twice.
+		if frame.Image != previousImage {
+			imagePath := filepath.Join(tempDir, fmt.Sprintf("frame-%d.bmp", idx))
+
+			// PNG uses quite a lot of CPU (it would have to get decoded back anyway), so pass it as BMP
+			// without compression
+			if err := writeBmp(imagePath, frame.Image); err != nil {
+				return err
+			}
+
+			frameFiles = append(frameFiles, imagePath)
+			previousImage = frame.Image
+		}
+
+		duration := time.Duration(frame.Ticks) * time.Second / time.Duration(fps)
+		if err := writeFrameItem(ffmpegItem, filepath.Base(frameFiles[len(frameFiles)-1]), duration); err != nil {
 			return err
 		}
+
+		// ffmpeg might still have the previous one open
+		if len(frameFiles) > 2 {
+			if err := os.Remove(frameFiles[0]); err != nil {
+				return err
+			}
+
+			frameFiles = frameFiles[1:]
+		}
+
+		return nil
+	}, func(concatFilename string) error {
+		ffmpeg := exec.CommandContext(ctx, "ffmpeg", ffmpegArgs([]string{
+			"-f", "concat",
+			"-safe", "0", // needed for file list with absolute paths
+			"-i", concatFilename,
+		})...)
+
+		ffmpeg.Stdout = os.Stdout
+		ffmpeg.Stderr = os.Stderr
+
+		return ffmpeg.Run()
+	})
+
+	close(consumerGone)
+	errProduce := <-produced
+
+	if errFfmpeg != nil {
+		return errFfmpeg
+	}
+
+	return errProduce
+}
+
+// FIFO item for a frame shown for "duration". relative to the FIFO, so the image has to be in the
+// same directory (nested concat lists aren't opened with "-safe 0").
+func writeFrameItem(ffmpegItem io.Writer, imageFilename string, duration time.Duration) error {
+	_, err := fmt.Fprintf(
+		ffmpegItem,
+		"ffconcat version 1.0\nfile '%s'\nduration %s\n",
+		imageFilename,
+		strconv.FormatFloat(duration.Seconds(), 'f', 6, 64))
+	return err
+}
+
+func writeBmp(path string, img image.Image) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, osutil.FileMode(osutil.OwnerRW, osutil.GroupNone, osutil.OtherNone))
+	if err != nil {
+		return err
+	}
+	defer file.Close() // double close intentional
+
+	if err := bmp.Encode(file, img); err != nil {
+		return err
 	}
 
-	return <-done
+	return file.Close()
 }
 
 func writeFfmpegConcatInputFile(filePath string, filenames []string) error {
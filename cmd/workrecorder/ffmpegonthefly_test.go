@@ -0,0 +1,20 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestWriteFrameItem(t *testing.T) {
+	item := &bytes.Buffer{}
+
+	// 7 ticks at 3 fps
+	assert.Ok(t, writeFrameItem(item, "frame-12.bmp", 7*time.Second/3))
+	assert.EqualString(t, item.String(), `ffconcat version 1.0
+file 'frame-12.bmp'
+duration 2.333333
+`)
+}
@@ -0,0 +1,139 @@
+package main
+
+// How the captured frames get to FFmpeg. The capture loop emits each changed frame with the number
+// of ticks it stays on screen, and the pipeline turns those into FFmpeg's input:
+//
+// - rawvideo: BGRA pixels streamed to FFmpeg's stdin in a minimal Matroska container that carries
+//   each frame's timestamp. No files, no image encoding.
+// - fifo: BMP files fed through FIFOs of a concat list (see ffmpegonthefly.go)
+
+import (
+	"context"
+	"errors"
+	"hash/maphash"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/BurntSushi/xgbutil/xgraphics"
+)
+
+const (
+	ffmpegInputRawVideo = "rawvideo"
+	ffmpegInputFifo     = "fifo"
+)
+
+var ffmpegInputs = []string{ffmpegInputRawVideo, ffmpegInputFifo}
+
+// a changed frame and for how many ticks it's on screen
+type capturedFrame struct {
+	Image *xgraphics.Image
+	Ticks int
+}
+
+// passes a frame on to the encoder
+type frameEmitter func(frame capturedFrame) error
+
+// a frame whose duration isn't known until the next changed frame (or the end of input)
+type heldFrame struct {
+	capturedFrame
+	Hash   uint64 // of the pixels
+	Marker bool   // pause marker (not a screenshot)
+}
+
+// for telling whether the screen changed. not cryptographic, but collisions are practically
+// impossible for consecutive frames.
+func hashPixels(pixels []byte) uint64 {
+	return maphash.Bytes(pixelHashSeed, pixels)
+}
+
+var pixelHashSeed = maphash.MakeSeed()
+
+// "produce" emits the frames. "ffmpegArgs" makes FFmpeg's arguments around the given input args.
+func encodeFrames(
+	ctx context.Context,
+	pipeline string,
+	fps int,
+	maxFrames int,
+	tempDir string,
+	produce func(emit frameEmitter) error,
+	ffmpegArgs func(inputArgs []string) []string,
+) error {
+	switch pipeline {
+	case ffmpegInputFifo:
+		return encodeFramesViaFifos(ctx, fps, maxFrames, tempDir, produce, ffmpegArgs)
+	case ffmpegInputRawVideo:
+		return encodeFramesAsRawVideo(ctx, fps, produce, ffmpegArgs)
+	default:
+		return errors.New("unsupported ffmpeg_input: " + pipeline)
+	}
+}
+
+func encodeFramesAsRawVideo(
+	ctx context.Context,
+	fps int,
+	produce func(emit frameEmitter) error,
+	ffmpegArgs func(inputArgs []string) []string,
+) error {
+	var ffmpeg *exec.Cmd
+	var ffmpegInput io.WriteCloser
+	var video *mkvRawVideoWriter
+	ticksSoFar := 0
+
+	// started on the first frame, as without frames there's no video to make
+	startFfmpeg := func(img *xgraphics.Image) error {
+		ffmpeg = exec.CommandContext(ctx, "ffmpeg", ffmpegArgs([]string{
+			"-f", "matroska",
+			"-i", "pipe:0",
+		})...)
+
+		ffmpeg.Stdout = os.Stdout
+		ffmpeg.Stderr = os.Stderr
+
+		var err error
+		ffmpegInput, err = ffmpeg.StdinPipe()
+		if err != nil {
+			return err
+		}
+
+		if err := ffmpeg.Start(); err != nil {
+			return err
+		}
+
+		video, err = newMkvRawVideoWriter(ffmpegInput, img.Rect.Dx(), img.Rect.Dy())
+		return err
+	}
+
+	errProduce := produce(func(frame capturedFrame) error {
+		if ffmpeg == nil {
+			if err := startFfmpeg(frame.Image); err != nil {
+				return err
+			}
+		}
+
+		timestamp := time.Duration(ticksSoFar) * time.Second / time.Duration(fps)
+		ticksSoFar += frame.Ticks
+
+		// xgraphics.Image is BGRA without padding between rows
+		return video.WriteFrame(timestamp, frame.Image.Pix)
+	})
+
+	if ffmpeg == nil {
+		return errProduce
+	}
+
+	// EOF makes FFmpeg finalize the output
+	errClose := ffmpegInput.Close()
+	errFfmpeg := ffmpeg.Wait()
+
+	if errFfmpeg != nil { // likely also the reason for failing to write
+		return errFfmpeg
+	}
+
+	if errProduce != nil {
+		return errProduce
+	}
+
+	return errClose
+}
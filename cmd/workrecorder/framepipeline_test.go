@@ -0,0 +1,19 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestHashPixels(t *testing.T) {
+	pixels := bytes.Repeat([]byte{0x20, 0x40, 0x60, 0xff}, 1920*1080)
+
+	before := hashPixels(pixels)
+	assert.Assert(t, hashPixels(append([]byte{}, pixels...)) == before)
+
+	pixels[4*(1920*540+960)] ^= 0x01 // one pixel in the middle changes slightly
+
+	assert.Assert(t, hashPixels(pixels) != before)
+}
@@ -0,0 +1,418 @@
+package main
+
+// Index of recorded segments and their frames, stored in SQLite. The directory layout
+// (<screen>/<date>/<time>.mkv) is the source of truth - the index can be rebuilt from it
+// with the "reindex" command.
+//
+// The index isn't encrypted even if the segments are, so the frames' active windows (class and
+// title) are stored only if the config's index_windows allows.
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// each entry migrates the schema one version forward. the schema version is tracked in SQLite's
+// "user_version". never change an existing entry, only add new ones.
+var indexMigrations = []string{
+	`
+CREATE TABLE segments (
+	id          INTEGER PRIMARY KEY,
+	screen      TEXT    NOT NULL,
+	path        TEXT    NOT NULL UNIQUE, -- relative to output dir
+	start_time  INTEGER NOT NULL,        -- Unix seconds
+	end_time    INTEGER NOT NULL,        -- Unix seconds (exclusive)
+	frame_count INTEGER NOT NULL,
+	codec       TEXT    NOT NULL,
+	size        INTEGER NOT NULL,
+	sha256      TEXT    NOT NULL
+);
+
+CREATE INDEX segments_screen_start ON segments (screen, start_time);
+
+CREATE TABLE frames (
+	segment_id          INTEGER NOT NULL REFERENCES segments (id) ON DELETE CASCADE,
+	timestamp           INTEGER NOT NULL, -- Unix seconds
+	active_window_class TEXT    NOT NULL,
+	active_window_title TEXT    NOT NULL,
+	user_idle_ms        INTEGER           -- NULL if unknown
+);
+
+CREATE INDEX frames_segment ON frames (segment_id);
+CREATE INDEX frames_timestamp ON frames (timestamp);
+`,
+	`ALTER TABLE segments ADD COLUMN tier TEXT NOT NULL DEFAULT 'original';`,
+	`ALTER TABLE frames ADD COLUMN redacted_windows INTEGER NOT NULL DEFAULT 0;`,
+	`
+ALTER TABLE frames ADD COLUMN paused INTEGER NOT NULL DEFAULT 0; -- marker frame
+
+CREATE TABLE gaps (
+	id         INTEGER PRIMARY KEY,
+	start_time INTEGER NOT NULL, -- Unix seconds
+	end_time   INTEGER NOT NULL, -- Unix seconds (exclusive)
+	reason     TEXT    NOT NULL
+);
+
+CREATE INDEX gaps_start ON gaps (start_time);
+`,
+	`ALTER TABLE gaps ADD COLUMN screen TEXT NOT NULL DEFAULT ''; -- empty = all screens`,
+	`ALTER TABLE segments ADD COLUMN truncated TEXT NOT NULL DEFAULT ''; -- why the segment ended early. empty if it didn't`,
+}
+
+type segmentRecord struct {
+	Screen     ScreenId
+	Path       string    // relative to output dir
+	Start      time.Time // first frame's timestamp
+	End        time.Time // exclusive
+	FrameCount int
+	Codec      string
+	Size       int64
+	Sha256     string // hex
+	Plaintext  string // hex. SHA-256 of the unencrypted file if the stored one is encrypted. not indexed
+	Tier       string // segmentTierOriginal | segmentTierDownsampled | segmentTierTimelapse
+	Truncated  string // why the segment ended early (segmentTruncated*). empty if it didn't
+}
+
+type segmentIndex struct {
+	db      *sql.DB
+	windows bool // whether to store frames' active windows
+}
+
+func indexPath(outputDir string) string {
+	return filepath.Join(outputDir, "index.db")
+}
+
+// "windows" = whether to store frames' active windows (readers don't care)
+func openSegmentIndex(path string, windows bool) (*segmentIndex, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	// all screens' recorders write concurrently. SQLite only supports one writer anyway.
+	db.SetMaxOpenConns(1)
+
+	if err := migrateIndex(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("index schema: %w", err)
+	}
+
+	return &segmentIndex{db, windows}, nil
+}
+
+func migrateIndex(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	// indexes from before the schema was versioned have migration 1's tables, but no version
+	if version == 0 {
+		var unversionedTables int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'segments'`).Scan(&unversionedTables); err != nil {
+			return err
+		}
+
+		if unversionedTables > 0 {
+			version = 1
+		}
+	}
+
+	for ; version < len(indexMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(indexMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+
+		// PRAGMA doesn't support placeholders
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *segmentIndex) Close() error {
+	return s.db.Close()
+}
+
+func (s *segmentIndex) Clear(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM segments`) // frames get deleted by cascade
+	return err
+}
+
+// replaces segment (and its frames) if it already exists
+func (s *segmentIndex) AddSegment(ctx context.Context, segment segmentRecord, frames []frameMetadata) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op if committed
+
+	if err := s.addSegment(ctx, tx, segment, frames); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *segmentIndex) addSegment(ctx context.Context, tx *sql.Tx, segment segmentRecord, frames []frameMetadata) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM segments WHERE path = ?`, segment.Path); err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO segments
+		(screen, path, start_time, end_time, frame_count, codec, size, sha256, tier, truncated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		string(segment.Screen),
+		segment.Path,
+		segment.Start.Unix(),
+		segment.End.Unix(),
+		segment.FrameCount,
+		segment.Codec,
+		segment.Size,
+		segment.Sha256,
+		segment.Tier,
+		segment.Truncated)
+	if err != nil {
+		return err
+	}
+
+	segmentId, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	insertFrame, err := tx.PrepareContext(ctx, `INSERT INTO frames
+		(segment_id, timestamp, active_window_class, active_window_title, user_idle_ms, redacted_windows, paused)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insertFrame.Close()
+
+	for _, frame := range frames {
+		var userIdleMs sql.NullInt64
+		if frame.UserIdle != userIdleUnknown {
+			userIdleMs = sql.NullInt64{Int64: frame.UserIdle.Milliseconds(), Valid: true}
+		}
+
+		window := frame.ActiveWindow
+		if !s.windows {
+			window = activeWindow{}
+		}
+
+		if _, err := insertFrame.ExecContext(
+			ctx,
+			segmentId,
+			frame.Timestamp.Unix(),
+			window.Class,
+			window.Title,
+			userIdleMs,
+			frame.RedactedWindows,
+			frame.Paused,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *segmentIndex) RemoveSegment(ctx context.Context, path string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM segments WHERE path = ?`, path) // frames get deleted by cascade
+	return err
+}
+
+// segments (keyed by path) of a screen starting in [from, to)
+func (s *segmentIndex) Segments(ctx context.Context, screen ScreenId, from time.Time, to time.Time) (map[string]segmentRecord, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT path, start_time, end_time, frame_count, codec, size, sha256, tier, truncated
+		FROM segments WHERE screen = ? AND start_time >= ? AND start_time < ?`,
+		string(screen),
+		from.Unix(),
+		to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segments := map[string]segmentRecord{}
+	for rows.Next() {
+		segment := segmentRecord{Screen: screen}
+		var startUnix, endUnix int64
+		if err := rows.Scan(
+			&segment.Path,
+			&startUnix,
+			&endUnix,
+			&segment.FrameCount,
+			&segment.Codec,
+			&segment.Size,
+			&segment.Sha256,
+			&segment.Tier,
+			&segment.Truncated,
+		); err != nil {
+			return nil, err
+		}
+
+		segment.Start = time.Unix(startUnix, 0).UTC()
+		segment.End = time.Unix(endUnix, 0).UTC()
+
+		segments[segment.Path] = segment
+	}
+
+	return segments, rows.Err()
+}
+
+// frames of a segment in capture order. empty if segment is not indexed.
+func (s *segmentIndex) SegmentFrames(ctx context.Context, path string) ([]frameMetadata, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT frames.timestamp, frames.active_window_class, frames.active_window_title, frames.user_idle_ms, frames.redacted_windows, frames.paused
+		FROM frames INNER JOIN segments ON segments.id = frames.segment_id
+		WHERE segments.path = ?
+		ORDER BY frames.rowid`,
+		path)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	frames := []frameMetadata{}
+	for rows.Next() {
+		var timestampUnix int64
+		var userIdleMs sql.NullInt64
+		frame := frameMetadata{UserIdle: userIdleUnknown}
+		if err := rows.Scan(
+			&timestampUnix,
+			&frame.ActiveWindow.Class,
+			&frame.ActiveWindow.Title,
+			&userIdleMs,
+			&frame.RedactedWindows,
+			&frame.Paused,
+		); err != nil {
+			return nil, err
+		}
+
+		frame.Timestamp = time.Unix(timestampUnix, 0).UTC()
+		if userIdleMs.Valid {
+			frame.UserIdle = time.Duration(userIdleMs.Int64) * time.Millisecond
+		}
+
+		frames = append(frames, frame)
+	}
+
+	return frames, rows.Err()
+}
+
+func (s *segmentIndex) AddGap(ctx context.Context, gap recordingGap) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO gaps (start_time, end_time, reason, screen) VALUES (?, ?, ?, ?)`,
+		gap.Start.Unix(),
+		gap.End.Unix(),
+		gap.Reason,
+		gap.Screen)
+	return err
+}
+
+// gaps overlapping [from, to), oldest first
+func (s *segmentIndex) Gaps(ctx context.Context, from time.Time, to time.Time) ([]recordingGap, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT start_time, end_time, reason, screen FROM gaps WHERE start_time < ? AND end_time > ? ORDER BY start_time`,
+		to.Unix(),
+		from.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	gaps := []recordingGap{}
+	for rows.Next() {
+		var startUnix, endUnix int64
+		gap := recordingGap{}
+		if err := rows.Scan(&startUnix, &endUnix, &gap.Reason, &gap.Screen); err != nil {
+			return nil, err
+		}
+
+		gap.Start = time.Unix(startUnix, 0).UTC()
+		gap.End = time.Unix(endUnix, 0).UTC()
+
+		gaps = append(gaps, gap)
+	}
+
+	return gaps, rows.Err()
+}
+
+// atomically replaces "replaced" segments with "segment" (e.g. many segments compacted into one)
+func (s *segmentIndex) ReplaceSegments(ctx context.Context, replaced []string, segment segmentRecord, frames []frameMetadata) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op if committed
+
+	for _, path := range replaced {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM segments WHERE path = ?`, path); err != nil {
+			return err
+		}
+	}
+
+	if err := s.addSegment(ctx, tx, segment, frames); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// "/output/DP-1/2021-06-28/12-15-00.mkv" => "DP-1/2021-06-28/12-15-00.mkv"
+func segmentPathRelative(outputDir string, segmentPath string) string {
+	relative, err := filepath.Rel(outputDir, segmentPath)
+	if err != nil { // shouldn't happen as segment paths are derived from output dir
+		return segmentPath
+	}
+
+	return relative
+}
+
+// fills in segment's size and hash from the file
+func segmentRecordWithFileInfo(segment segmentRecord, filePath string) (segmentRecord, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return segment, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return segment, err
+	}
+
+	segment.Size = size
+	segment.Sha256 = hex.EncodeToString(hash.Sum(nil))
+
+	return segment, nil
+}
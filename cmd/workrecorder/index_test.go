@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestOpenUnversionedIndex(t *testing.T) {
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "index.db")
+
+	// schema of indexes created before it was versioned
+	oldDb, err := sql.Open("sqlite", "file:"+path)
+	assert.Ok(t, err)
+
+	_, err = oldDb.Exec(`
+CREATE TABLE IF NOT EXISTS segments (
+	id          INTEGER PRIMARY KEY,
+	screen      TEXT    NOT NULL,
+	path        TEXT    NOT NULL UNIQUE, -- relative to output dir
+	start_time  INTEGER NOT NULL,        -- Unix seconds
+	end_time    INTEGER NOT NULL,        -- Unix seconds (exclusive)
+	frame_count INTEGER NOT NULL,
+	codec       TEXT    NOT NULL,
+	size        INTEGER NOT NULL,
+	sha256      TEXT    NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS segments_screen_start ON segments (screen, start_time);
+
+CREATE TABLE IF NOT EXISTS frames (
+	segment_id          INTEGER NOT NULL REFERENCES segments (id) ON DELETE CASCADE,
+	timestamp           INTEGER NOT NULL, -- Unix seconds
+	active_window_class TEXT    NOT NULL,
+	active_window_title TEXT    NOT NULL,
+	user_idle_ms        INTEGER           -- NULL if unknown
+);
+
+CREATE INDEX IF NOT EXISTS frames_segment ON frames (segment_id);
+CREATE INDEX IF NOT EXISTS frames_timestamp ON frames (timestamp);
+
+INSERT INTO segments (id, screen, path, start_time, end_time, frame_count, codec, size, sha256)
+VALUES (1, 'DP-1', 'DP-1/2021-06-28/12-00-00.mkv', 1624881600, 1624882500, 1, 'h264', 123, 'abc');
+
+INSERT INTO frames (segment_id, timestamp, active_window_class, active_window_title, user_idle_ms)
+VALUES (1, 1624881600, 'Firefox', 'Example', 1500);
+`)
+	assert.Ok(t, err)
+	assert.Ok(t, oldDb.Close())
+
+	index, err := openSegmentIndex(path, true)
+	assert.Ok(t, err)
+	defer index.Close()
+
+	var version int
+	assert.Ok(t, index.db.QueryRow(`PRAGMA user_version`).Scan(&version))
+	assert.EqualInt(t, version, len(indexMigrations))
+
+	start := time.Date(2021, 6, 28, 12, 0, 0, 0, time.UTC)
+
+	segments, err := index.Segments(ctx, "DP-1", start, start.Add(time.Hour))
+	assert.Ok(t, err)
+	assert.EqualString(t, fmt.Sprintf("%v", segments), "map[DP-1/2021-06-28/12-00-00.mkv:{DP-1 DP-1/2021-06-28/12-00-00.mkv 2021-06-28 12:00:00 +0000 UTC 2021-06-28 12:15:00 +0000 UTC 1 h264 123 abc  original }]")
+
+	frames, err := index.SegmentFrames(ctx, "DP-1/2021-06-28/12-00-00.mkv")
+	assert.Ok(t, err)
+	assert.EqualString(t, fmt.Sprintf("%v", frames), "[{2021-06-28 12:00:00 +0000 UTC {Example Firefox} 1.5s 0 false}]")
+
+	// tables of later migrations are there
+	assert.Ok(t, index.AddGap(ctx, recordingGap{Screen: "DP-1", Start: start, End: start.Add(time.Minute), Reason: "test"}))
+}
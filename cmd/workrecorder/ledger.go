@@ -0,0 +1,517 @@
+package main
+
+// Each screen has an append-only ledger of its segments at <output dir>/<screen>/ledger.jsonl.
+// Every line is a JSON entry holding the SHA-256 of the previous line, so entries can't be modified,
+// removed or reordered without breaking the chain. Removals (retention, compaction) are entries too,
+// so a segment that was removed on purpose can be told apart from one that went missing.
+//
+// After each day (of the day folders, so in the configured time zone) the day's segments are
+// summarized into a Merkle root (the "daily digest"), optionally signed with an Ed25519 key, at
+// <output dir>/<screen>/digests/<YYYY-MM-DD>.json.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/os/osutil"
+)
+
+const (
+	ledgerEntrySegment = "segment"
+	ledgerEntryRemove  = "remove"
+)
+
+type ledgerEntry struct {
+	Seq       int64  `json:"seq"`                 // starts from 1
+	Prev      string `json:"prev"`                // SHA-256 (hex) of the previous line. empty for the first entry
+	Time      int64  `json:"time"`                // Unix seconds when appended
+	Type      string `json:"type"`                // ledgerEntrySegment | ledgerEntryRemove
+	Path      string `json:"path"`                // relative to output dir
+	Start     int64  `json:"start,omitempty"`     // Unix seconds. segments only
+	End       int64  `json:"end,omitempty"`       // Unix seconds. segments only
+	Size      int64  `json:"size,omitempty"`      // segments only
+	Sha256    string `json:"sha256,omitempty"`    // of the stored file. segments only
+	Plaintext string `json:"plaintext,omitempty"` // SHA-256 of the unencrypted file. encrypted segments only
+	Tier      string `json:"tier,omitempty"`      // segments only
+	Truncated string `json:"truncated,omitempty"` // segments only. why the segment ended early
+	Reason    string `json:"reason,omitempty"`    // removals only
+}
+
+type ledgerLine struct {
+	Entry ledgerEntry
+	Hash  string // SHA-256 (hex) of the line, which the next entry refers to
+}
+
+type ledgerHead struct {
+	Seq  int64
+	Hash string
+}
+
+// safe for concurrent use
+type segmentLedger struct {
+	outputDir string
+	heads     map[ScreenId]ledgerHead // lazily loaded
+	mu        sync.Mutex
+}
+
+func newSegmentLedger(outputDir string) *segmentLedger {
+	return &segmentLedger{
+		outputDir: outputDir,
+		heads:     map[ScreenId]ledgerHead{},
+	}
+}
+
+func ledgerPath(outputDir string, screen ScreenId) string {
+	return screen.ReadyPath(outputDir, "ledger.jsonl")
+}
+
+func (l *segmentLedger) AddSegment(segment segmentRecord) error {
+	return l.append(segment.Screen, ledgerEntry{
+		Type:      ledgerEntrySegment,
+		Path:      segment.Path,
+		Start:     segment.Start.Unix(),
+		End:       segment.End.Unix(),
+		Size:      segment.Size,
+		Sha256:    segment.Sha256,
+		Plaintext: segment.Plaintext,
+		Tier:      segment.Tier,
+		Truncated: segment.Truncated,
+	})
+}
+
+// for redoing an AddSegment() that might or might not have happened
+func (l *segmentLedger) AddSegmentIfMissing(segment segmentRecord) error {
+	lines, err := l.Lines(segment.Screen)
+	if err != nil {
+		return err
+	}
+
+	if live, found := liveSegmentsFromLedger(lines)[segment.Path]; found && live.Sha256 == segment.Sha256 {
+		return nil
+	}
+
+	return l.AddSegment(segment)
+}
+
+func (l *segmentLedger) RemoveSegment(screen ScreenId, path string, reason string) error {
+	return l.append(screen, ledgerEntry{
+		Type:   ledgerEntryRemove,
+		Path:   path,
+		Reason: reason,
+	})
+}
+
+func (l *segmentLedger) Lines(screen ScreenId) ([]ledgerLine, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return readLedger(l.outputDir, screen)
+}
+
+func (l *segmentLedger) append(screen ScreenId, entry ledgerEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	head, found := l.heads[screen]
+	if !found {
+		lines, err := readLedger(l.outputDir, screen)
+		if err != nil {
+			return err
+		}
+
+		if len(lines) > 0 {
+			last := lines[len(lines)-1]
+			head = ledgerHead{Seq: last.Entry.Seq, Hash: last.Hash}
+		}
+	}
+
+	entry.Seq = head.Seq + 1
+	entry.Prev = head.Hash
+	entry.Time = time.Now().Unix()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(
+		ledgerPath(l.outputDir, screen),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		osutil.FileMode(osutil.OwnerRW, osutil.GroupR, osutil.OtherNone))
+	if err != nil {
+		return err
+	}
+	defer file.Close() // double close intentional
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	l.heads[screen] = ledgerHead{Seq: entry.Seq, Hash: ledgerLineHash(line)}
+
+	return nil
+}
+
+// empty if ledger doesn't exist
+func readLedger(outputDir string, screen ScreenId) ([]ledgerLine, error) {
+	content, err := os.ReadFile(ledgerPath(outputDir, screen))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []ledgerLine{}, nil
+		}
+
+		return nil, err
+	}
+
+	lines := []ledgerLine{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		entry := ledgerEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("ledger %s line %d: %w", screen, len(lines)+1, err)
+		}
+
+		lines = append(lines, ledgerLine{
+			Entry: entry,
+			Hash:  ledgerLineHash(scanner.Bytes()),
+		})
+	}
+
+	return lines, scanner.Err()
+}
+
+func ledgerLineHash(line []byte) string {
+	hash := sha256.Sum256(line)
+	return hex.EncodeToString(hash[:])
+}
+
+// problems with the hash chain (empty if intact)
+func verifyLedgerChain(lines []ledgerLine) []string {
+	problems := []string{}
+
+	previous := ledgerHead{}
+	for _, line := range lines {
+		if line.Entry.Seq != previous.Seq+1 {
+			problems = append(problems, fmt.Sprintf("ledger entry %d: expected seq %d (entries removed or reordered)", line.Entry.Seq, previous.Seq+1))
+		}
+
+		if line.Entry.Prev != previous.Hash {
+			problems = append(problems, fmt.Sprintf("ledger entry %d: doesn't chain to previous entry (entries modified, removed or reordered)", line.Entry.Seq))
+		}
+
+		previous = ledgerHead{Seq: line.Entry.Seq, Hash: line.Hash}
+	}
+
+	return problems
+}
+
+// replays the ledger into segments that should currently exist, keyed by path
+func liveSegmentsFromLedger(lines []ledgerLine) map[string]ledgerEntry {
+	live := map[string]ledgerEntry{}
+
+	for _, line := range lines {
+		switch line.Entry.Type {
+		case ledgerEntrySegment:
+			live[line.Entry.Path] = line.Entry
+		case ledgerEntryRemove:
+			delete(live, line.Entry.Path)
+		}
+	}
+
+	return live
+}
+
+type dailyDigest struct {
+	Screen     ScreenId        `json:"screen"`
+	Day        string          `json:"day"`                // "2021-06-28", the day folder (in the configured time zone)
+	Segments   []digestSegment `json:"segments,omitempty"` // the Merkle tree's leaves in order. left out of proofs
+	Root       string          `json:"root"`               // hex
+	LedgerSeq  int64           `json:"ledger_seq"`         // ledger's head when the digest was made
+	LedgerHead string          `json:"ledger_head"`        // hash of ledger's head entry
+	Signature  string          `json:"signature,omitempty"`
+}
+
+type digestSegment struct {
+	Path      string `json:"path"`
+	Sha256    string `json:"sha256"`
+	Plaintext string `json:"plaintext,omitempty"` // SHA-256 of the unencrypted file. encrypted segments only
+}
+
+// the leaf binds the segment's hash to its path (= screen and time). for encrypted segments also
+// the plaintext's hash, so the decrypted recording can be proven (and not just the ciphertext).
+func (d digestSegment) Leaf() []byte {
+	if d.Plaintext != "" {
+		return []byte(d.Path + "\n" + d.Sha256 + "\n" + d.Plaintext)
+	}
+
+	return []byte(d.Path + "\n" + d.Sha256)
+}
+
+// what gets signed
+func (d dailyDigest) SignedMessage() []byte {
+	return []byte(fmt.Sprintf(
+		"workrecorder daily digest v1\nscreen %s\nday %s\nroot %s\nledger %d %s\n",
+		d.Screen,
+		d.Day,
+		d.Root,
+		d.LedgerSeq,
+		d.LedgerHead))
+}
+
+func (d dailyDigest) VerifySignature(publicKey ed25519.PublicKey) error {
+	signature, err := base64.StdEncoding.DecodeString(d.Signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, d.SignedMessage(), signature) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+func digestPath(outputDir string, screen ScreenId, day string) string {
+	return screen.ReadyPath(outputDir, filepath.Join("digests", day+".json"))
+}
+
+// digest over the day's original recordings (compacted versions are derived from them) in
+// ledger order. "signingKey" is optional.
+func makeDailyDigest(screen ScreenId, day string, lines []ledgerLine, signingKey ed25519.PrivateKey) dailyDigest {
+	digest := dailyDigest{
+		Screen:   screen,
+		Day:      day,
+		Segments: []digestSegment{},
+	}
+
+	leaves := [][]byte{}
+	for _, line := range lines {
+		entry := line.Entry
+
+		if entry.Type != ledgerEntrySegment || entry.Tier != segmentTierOriginal || segmentPathDay(entry.Path) != day {
+			continue
+		}
+
+		segment := digestSegment{Path: entry.Path, Sha256: entry.Sha256, Plaintext: entry.Plaintext}
+
+		digest.Segments = append(digest.Segments, segment)
+		leaves = append(leaves, segment.Leaf())
+	}
+
+	digest.Root = hex.EncodeToString(merkleRoot(leaves))
+
+	if len(lines) > 0 {
+		digest.LedgerSeq = lines[len(lines)-1].Entry.Seq
+		digest.LedgerHead = lines[len(lines)-1].Hash
+	}
+
+	if signingKey != nil {
+		digest.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, digest.SignedMessage()))
+	}
+
+	return digest
+}
+
+func readDailyDigest(path string) (*dailyDigest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := &dailyDigest{}
+	if err := json.Unmarshal(content, digest); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return digest, nil
+}
+
+// runs forever (until ctx canceled)
+func writeDailyDigestsContinuously(ctx context.Context, conf Config, ledger *segmentLedger, signingKey ed25519.PrivateKey, logl *logex.Leveled) error {
+	for {
+		// failures are retried soon. they must not stop the recording, which shares our task runner.
+		retrySoon := false
+
+		if err := writeMissingDailyDigests(conf, ledger, signingKey, time.Now(), logl); err != nil {
+			logl.Error.Printf("writing daily digests: %v", err)
+			retrySoon = true
+		}
+
+		if conf.TimestampURL != "" {
+			timestampsPending, err := timestampDailyDigests(ctx, conf, logl)
+			if err != nil {
+				logl.Error.Printf("timestamping daily digests: %v", err)
+			}
+
+			retrySoon = retrySoon || timestampsPending || err != nil
+		}
+
+		// the last segment of the day finishes a moment after midnight
+		nextCheck := nextMidnight(time.Now().In(conf.Location())).Add(dailyDigestGrace)
+
+		if retry := time.Now().Add(timestampRetryInterval); retrySoon && retry.Before(nextCheck) {
+			nextCheck = retry
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Until(nextCheck)):
+		}
+	}
+}
+
+// how long after midnight we wait for the day's last segments to finish
+const dailyDigestGrace = 5 * time.Minute
+
+func writeMissingDailyDigests(conf Config, ledger *segmentLedger, signingKey ed25519.PrivateKey, now time.Time, logl *logex.Leveled) error {
+	screens, err := listScreens(conf.OutputDir)
+	if err != nil {
+		return err
+	}
+
+	for _, screen := range screens {
+		lines, err := ledger.Lines(screen)
+		if err != nil {
+			return err
+		}
+
+		for _, day := range completedLedgerDays(lines, now) {
+			path := digestPath(conf.OutputDir, screen, day)
+
+			if _, err := os.Stat(path); err == nil || !os.IsNotExist(err) {
+				continue // already made (or stat failed)
+			}
+
+			digest := makeDailyDigest(screen, day, lines, signingKey)
+
+			if err := writeDailyDigest(path, digest); err != nil {
+				return err
+			}
+
+			logl.Info.Printf("daily digest %s/%s: %d segment(s), root %s", screen, day, len(digest.Segments), digest.Root)
+		}
+	}
+
+	return nil
+}
+
+// days (as in the day folders, sorted) that have original segments in the ledger and are over
+func completedLedgerDays(lines []ledgerLine, now time.Time) []string {
+	days := map[string]bool{}
+	for _, line := range lines {
+		if line.Entry.Type != ledgerEntrySegment || line.Entry.Tier != segmentTierOriginal {
+			continue
+		}
+
+		dayEnd, err := segmentDayEnd(line.Entry.Path)
+		if err != nil {
+			continue // not a segment path
+		}
+
+		if now.Sub(dayEnd) >= dailyDigestGrace {
+			days[segmentPathDay(line.Entry.Path)] = true
+		}
+	}
+
+	sorted := []string{}
+	for day := range days {
+		sorted = append(sorted, day)
+	}
+	sort.Strings(sorted)
+
+	return sorted
+}
+
+func writeDailyDigest(path string, digest dailyDigest) error {
+	serialized, err := json.MarshalIndent(digest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return err
+	}
+
+	// never overwrites an existing digest
+	return writeFileExclusive(path, append(serialized, '\n'))
+}
+
+// PKCS #8 PEM, like from $ openssl genpkey -algorithm ed25519
+func loadDigestSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPemFile(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	ed25519Key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+
+	return ed25519Key, nil
+}
+
+// PKIX PEM, like from $ openssl pkey -pubout
+func loadDigestPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPemFile(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	ed25519Key, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+
+	return ed25519Key, nil
+}
+
+func readPemFile(path string, expectedType string) (*pem.Block, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != expectedType {
+		return nil, fmt.Errorf("%s: expected PEM %s", path, expectedType)
+	}
+
+	return block, nil
+}
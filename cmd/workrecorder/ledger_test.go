@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestLedgerAndDigestVerification(t *testing.T) {
+	conf := defaultConfig()
+	conf.OutputDir = t.TempDir()
+
+	publicKey, signingKey, err := ed25519.GenerateKey(nil)
+	assert.Ok(t, err)
+
+	ledger := newSegmentLedger(conf.OutputDir)
+
+	addSegment := func(start string, content string) string {
+		startTime, err := time.Parse(time.RFC3339, start)
+		assert.Ok(t, err)
+
+		path := segmentPath(conf.OutputDir, "DP-1", startTime, false)
+		assert.Ok(t, os.MkdirAll(filepath.Dir(path), 0700))
+		assert.Ok(t, os.WriteFile(path, []byte(content), 0600))
+
+		segment, err := segmentRecordWithFileInfo(segmentRecord{
+			Screen: "DP-1",
+			Path:   segmentPathRelative(conf.OutputDir, path),
+			Start:  startTime,
+			End:    startTime.Add(15 * time.Minute),
+			Tier:   segmentTierOriginal,
+		}, path)
+		assert.Ok(t, err)
+
+		assert.Ok(t, ledger.AddSegment(segment))
+
+		return path
+	}
+
+	first := addSegment("2021-06-28T12:00:00Z", "first")
+	second := addSegment("2021-06-28T12:15:00Z", "second")
+	addSegment("2021-06-29T08:00:00Z", "next day")
+
+	now := time.Date(2021, 6, 30, 0, 0, 0, 0, time.UTC) // 2021-06-29 is not over, as its last segment could be finishing
+
+	assert.Ok(t, writeMissingDailyDigests(conf, ledger, signingKey, now, logex.Levels(logex.Discard)))
+
+	verify := func() string {
+		problems, notes, err := verifyScreen(conf, "DP-1", publicKey, now)
+		assert.Ok(t, err)
+
+		return strings.Join(append(problems, notes...), "\n")
+	}
+
+	assert.EqualString(t, verify(), "")
+
+	// removals recorded in the ledger are fine, but the ones of digested segments are pointed out
+	assert.Ok(t, os.Remove(first))
+	assert.Ok(t, ledger.RemoveSegment("DP-1", "DP-1/2021-06-28/12-00-00.mkv", "retention: older than 1h"))
+
+	assert.EqualString(t, verify(), "digest 2021-06-28: DP-1/2021-06-28/12-00-00.mkv removed after it was digested (ledger entry 4: retention: older than 1h)")
+
+	// .. but others aren't
+	assert.Ok(t, os.WriteFile(second, []byte("tampered"), 0600))
+
+	assert.EqualString(t, verify(), `DP-1/2021-06-28/12-15-00.mkv: modified (SHA-256 d121be3103007b41edf96f8262925f8c7d61894afe9a041843b631f69445bc57, ledger says 16367aacb67a4a017c8da8ab95682ccb390863780f7114dda0a0e0c55644c7c4)
+digest 2021-06-28: DP-1/2021-06-28/12-00-00.mkv removed after it was digested (ledger entry 4: retention: older than 1h)`)
+
+	assert.Ok(t, os.Remove(second))
+
+	assert.EqualString(t, verify(), `DP-1/2021-06-28/12-15-00.mkv: missing
+digest 2021-06-28: DP-1/2021-06-28/12-00-00.mkv removed after it was digested (ledger entry 4: retention: older than 1h)`)
+
+	// rewriting history breaks the chain and the digest
+	ledgerContent, err := os.ReadFile(ledgerPath(conf.OutputDir, "DP-1"))
+	assert.Ok(t, err)
+	assert.Ok(t, os.WriteFile(ledgerPath(conf.OutputDir, "DP-1"), []byte(strings.Replace(string(ledgerContent), "16367aacb67a4a017c8da8ab95682ccb390863780f7114dda0a0e0c55644c7c4", "d121be3103007b41edf96f8262925f8c7d61894afe9a041843b631f69445bc57", 1)), 0600))
+
+	assert.EqualString(t, verify(), `ledger entry 3: doesn't chain to previous entry (entries modified, removed or reordered)
+DP-1/2021-06-28/12-15-00.mkv: missing
+digest 2021-06-28: root 29a8d5385c7ce61e72368813580b6dd91a03386ca51b3b83045112c4dccac0e5 doesn't match ledger's 5a415923e5739de23b9323a8991666e510d0cbe5ae7476ed3324fea066de721f`)
+}
+
+func TestVerifyTamperedDigestLedgerSeq(t *testing.T) {
+	conf := defaultConfig()
+	conf.OutputDir = t.TempDir()
+
+	ledger := newSegmentLedger(conf.OutputDir)
+
+	startTime := time.Date(2021, 6, 28, 12, 0, 0, 0, time.UTC)
+
+	path := segmentPath(conf.OutputDir, "DP-1", startTime, false)
+	assert.Ok(t, os.MkdirAll(filepath.Dir(path), 0700))
+	assert.Ok(t, os.WriteFile(path, []byte("first"), 0600))
+
+	segment, err := segmentRecordWithFileInfo(segmentRecord{
+		Screen: "DP-1",
+		Path:   segmentPathRelative(conf.OutputDir, path),
+		Start:  startTime,
+		End:    startTime.Add(15 * time.Minute),
+		Tier:   segmentTierOriginal,
+	}, path)
+	assert.Ok(t, err)
+	assert.Ok(t, ledger.AddSegment(segment))
+
+	now := time.Date(2021, 6, 30, 0, 0, 0, 0, time.UTC)
+
+	assert.Ok(t, writeMissingDailyDigests(conf, ledger, nil, now, logex.Levels(logex.Discard)))
+
+	tamper := func(ledgerSeq int64, ledgerHead string) string {
+		digest, err := readDailyDigest(digestPath(conf.OutputDir, "DP-1", "2021-06-28"))
+		assert.Ok(t, err)
+
+		digest.LedgerSeq = ledgerSeq
+		digest.LedgerHead = ledgerHead
+
+		digestJson, err := json.Marshal(digest)
+		assert.Ok(t, err)
+		assert.Ok(t, os.WriteFile(digestPath(conf.OutputDir, "DP-1", "2021-06-28"), digestJson, 0600))
+
+		problems, _, err := verifyScreen(conf, "DP-1", nil, now)
+		assert.Ok(t, err)
+
+		return strings.Join(problems, "\n")
+	}
+
+	// an empty head would match the lookup of a seq that isn't in the ledger
+	assert.EqualString(t, tamper(-1, ""), "digest 2021-06-28: refers to ledger entry -1 that doesn't match the ledger")
+	assert.EqualString(t, tamper(0, ""), "digest 2021-06-28: refers to ledger entry 0 that doesn't match the ledger")
+	assert.EqualString(t, tamper(2, ""), "digest 2021-06-28: refers to ledger entry 2 that doesn't match the ledger")
+}
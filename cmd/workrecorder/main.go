@@ -2,25 +2,27 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
-	"io"
+	"image"
+	"image/png"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"time"
 
+	"filippo.io/age"
 	"github.com/BurntSushi/xgb/randr"
 	"github.com/BurntSushi/xgb/xproto"
 	"github.com/BurntSushi/xgbutil"
+	"github.com/BurntSushi/xgbutil/xgraphics"
 	"github.com/function61/gokit/app/dynversion"
 	"github.com/function61/gokit/log/logex"
 	"github.com/function61/gokit/os/osutil"
 	"github.com/function61/gokit/os/systemdinstaller"
 	"github.com/function61/gokit/sync/taskrunner"
 	"github.com/spf13/cobra"
-	"golang.org/x/image/bmp"
 )
 
 func main() {
@@ -29,15 +31,34 @@ func main() {
 		Short:   "Work recorder",
 		Version: dynversion.Version,
 		Args:    cobra.NoArgs,
-		Run: func(cmd *cobra.Command, args []string) {
-			rootLogger := logex.StandardLogger()
+	}
+
+	resolveConfig := registerConfigFlags(app.Flags())
+
+	app.Run = func(cmd *cobra.Command, args []string) {
+		rootLogger := logex.StandardLogger()
+
+		osutil.ExitIfError(func() error {
+			conf, err := resolveConfig()
+			if err != nil {
+				return err
+			}
 
-			osutil.ExitIfError(logic(
+			return logic(
 				osutil.CancelOnInterruptOrTerminate(rootLogger),
-				rootLogger))
-		},
+				*conf,
+				rootLogger)
+		}())
 	}
 
+	app.AddCommand(reindexEntrypoint())
+	app.AddCommand(atEntrypoint())
+	app.AddCommand(serveEntrypoint())
+	app.AddCommand(catEntrypoint())
+	app.AddCommand(verifyEntrypoint())
+	app.AddCommand(proveEntrypoint())
+	app.AddCommand(ctlEntrypoint())
+
 	app.AddCommand(&cobra.Command{
 		Use:   "install",
 		Short: "Installs as a system service",
@@ -62,61 +83,258 @@ func main() {
 	osutil.ExitIfError(app.Execute())
 }
 
-func logic(ctx context.Context, logger *log.Logger) error {
-	renderer, err := func() (string, error) {
-		renderersDir := "/dev/dri"
+func logic(ctx context.Context, conf Config, logger *log.Logger) error {
+	logl := logex.Levels(logger)
+
+	if err := conf.LogEffective(logl); err != nil {
+		return err
+	}
+
+	ffmpegEncoders, err := ffmpegSupportedEncoders(ctx)
+	if err != nil {
+		return err
+	}
+
+	renderer := ""
+
+	// not having a render node is not an error, unless we end up choosing a hardware encoder or
+	// the user asked for one in particular
+	node, errRenderer := resolveRenderNode(conf.RenderNode, conf.RenderNodeMatch, logl)
+	switch {
+	case errRenderer == nil:
+		renderer = node.Path
+	case conf.RenderNode != "" || conf.RenderNodeMatch != "":
+		return errRenderer
+	default:
+		logl.Debug.Printf("no render node: %v", errRenderer)
+	}
+
+	if errRenderer == nil {
+		ffmpegEncoders = trialEncodeHardwareEncoders(ctx, ffmpegEncoders, renderer, logl)
+	}
+
+	encoder, err := selectEncoder(conf.Encoder, ffmpegEncoders, errRenderer == nil)
+	if err != nil {
+		if errRenderer != nil {
+			return fmt.Errorf("%w (render node: %v)", err, errRenderer)
+		}
+
+		return err
+	}
+
+	logl.Info.Printf("using encoder %s", encoder.Name)
 
-		renderers, err := os.ReadDir(renderersDir)
+	var recipients []age.Recipient // nil = no encryption
+	if conf.EncryptionRecipientsFile != "" {
+		recipients, err = loadEncryptionRecipients(conf.EncryptionRecipientsFile)
 		if err != nil {
-			return "", err
+			return err
 		}
 
-		if len(renderers) != 1 {
-			return "", fmt.Errorf("expected only one renderer in %s", renderersDir)
+		logl.Info.Printf("encrypting segments to %d recipient(s)", len(recipients))
+	}
+
+	redactor, err := newRedactor(conf.RedactWindows, conf.RedactMode)
+	if err != nil {
+		return err
+	}
+
+	var signingKey ed25519.PrivateKey // nil = unsigned digests
+	if conf.DigestSigningKeyFile != "" {
+		signingKey, err = loadDigestSigningKey(conf.DigestSigningKeyFile)
+		if err != nil {
+			return err
 		}
+	}
 
-		return filepath.Join(renderersDir, renderers[0].Name()), nil
-	}()
+	xutil, err := connectX11()
 	if err != nil {
 		return err
 	}
+	// last, as everything uses it. also ends the goroutine waiting for X events.
+	defer xutil.Conn().Close()
+
+	screensaverAvailable := initScreensaver(xutil, logl)
 
-	xutil, connectedOutputs, err := connectX11AndGetConnectedOutputs()
+	capturer, err := newScreenCapturer(xutil, conf.CaptureBackend, logl)
 	if err != nil {
 		return err
 	}
+	defer capturer.Close()
 
-	tasks := taskrunner.New(ctx, logger)
+	index, err := openSegmentIndex(indexPath(conf.OutputDir), conf.IndexWindows)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	ledger := newSegmentLedger(conf.OutputDir)
 
-	for _, connectedOutput := range connectedOutputs {
-		connectedOutput := connectedOutput // pin
+	control := newRecordingControl(func(gap recordingGap) {
+		logl.Info.Printf("recording resumed after %s (%s)", gap.End.Sub(gap.Start).Round(time.Second), gap.Reason)
+
+		if err := index.AddGap(ctx, gap); err != nil {
+			logl.Error.Printf("index: %v", err)
+		}
+	})
+
+	rec := &recorder{
+		conf:       conf,
+		encoder:    *encoder,
+		renderNode: renderer,
+		recipients: recipients,
+		redactor:   redactor,
+		control:    control,
+		capturer:   capturer,
+		xutil:      xutil,
+		index:      index,
+		ledger:     ledger,
+
+		screensaverAvailable: screensaverAvailable,
+	}
 
-		tasks.Start(string(connectedOutput.ScreenId()), func(ctx context.Context) error {
-			return recordOneScreenContinuously(
+	// before recording, so the segments are in order in the index and the ledger
+	if err := rec.recoverInterruptedSegments(ctx, logex.Levels(logex.Prefix("recovery", logger))); err != nil {
+		return err
+	}
+
+	tasks := taskrunner.New(ctx, logger)
+
+	tasks.Start("outputs", func(ctx context.Context) error {
+		return recordConnectedOutputs(ctx, xutil, func(ctx context.Context, output randrOutput, stop <-chan struct{}) error {
+			return rec.recordOneScreenContinuously(
 				ctx,
-				connectedOutput,
-				renderer,
-				xutil,
-				logex.Levels(logex.Prefix(string(connectedOutput.ScreenId()), logger)))
+				output,
+				stop,
+				logex.Levels(logex.Prefix(string(output.ScreenId()), logger)))
+		}, logl)
+	})
+
+	if socketPath := controlSocketPath(conf); socketPath != "" {
+		tasks.Start("control", func(ctx context.Context) error {
+			controlLogl := logex.Levels(logex.Prefix("control", logger))
+
+			if err := serveControlSocket(ctx, socketPath, control, func() ([]string, error) {
+				return rec.SnapshotConnectedOutputs(controlLogl)
+			}, controlLogl); err != nil {
+				// the recording is more important than being able to control it
+				controlLogl.Error.Printf("control socket unavailable, recording without it: %v", err)
+			}
+
+			<-ctx.Done() // stopping early would stop the other tasks too
+			return nil
 		})
 	}
 
+	tasks.Start("clock", func(ctx context.Context) error {
+		return cutSegmentsOnClockJumps(ctx, control, logex.Levels(logex.Prefix("clock", logger)))
+	})
+
+	if conf.PauseWhenScreenInactive {
+		screenStateLogl := logex.Levels(logex.Prefix("screenstate", logger))
+
+		detector, err := newScreenStateDetector(xutil, screensaverAvailable, conf.LockerWindowClass, screenStateLogl)
+		if err != nil {
+			return err
+		}
+
+		tasks.Start("screenstate", func(ctx context.Context) error {
+			return pauseWhileScreensInactive(ctx, detector, control, screenStateLogl)
+		})
+	}
+
+	tasks.Start("retention", func(ctx context.Context) error {
+		return enforceRetentionContinuously(ctx, conf, index, ledger, logex.Levels(logex.Prefix("retention", logger)))
+	})
+
+	tasks.Start("compaction", func(ctx context.Context) error {
+		return (&compactor{
+			conf:       conf,
+			encoder:    *encoder,
+			renderNode: renderer,
+			recipients: recipients,
+			index:      index,
+			ledger:     ledger,
+		}).CompactContinuously(ctx, logex.Levels(logex.Prefix("compaction", logger)))
+	})
+
+	tasks.Start("digests", func(ctx context.Context) error {
+		return writeDailyDigestsContinuously(ctx, conf, ledger, signingKey, logex.Levels(logex.Prefix("digests", logger)))
+	})
+
 	return tasks.Wait()
 }
 
-func recordOneScreenContinuously(
+// shared by all screens' recording
+type recorder struct {
+	conf       Config
+	encoder    encoderProfile
+	renderNode string          // empty if encoder doesn't need one
+	recipients []age.Recipient // nil = no encryption
+	redactor   *redactor       // nil = no redaction
+	control    *recordingControl
+	capturer   screenCapturer
+	xutil      *xgbutil.XUtil
+	index      *segmentIndex
+	ledger     *segmentLedger
+
+	screensaverAvailable bool // for user idle times
+}
+
+// returns nil after "stop" is closed or "ctx" is cancelled (and the current segment is finished)
+func (r *recorder) recordOneScreenContinuously(
 	ctx context.Context,
 	connectedOutput randrOutput,
-	renderer string,
-	xutil *xgbutil.XUtil,
+	stop <-chan struct{},
 	logl *logex.Leveled,
 ) error {
+	defer r.control.ForgetScreen(connectedOutput.ScreenId())
+
+	failures := recordingFailures{}
+
 	for {
-		nextTick, err := recordOneScreen(ctx, connectedOutput, renderer, xutil, logl)
+		// no use starting a segment while paused
+		for {
+			changed := r.control.Changed()
+			if !r.control.Paused() {
+				break
+			}
+
+			select {
+			case <-stop:
+				return nil
+			case <-ctx.Done():
+				return nil
+			case <-changed:
+			}
+		}
+
+		nextTick, err := r.recordOneScreen(ctx, connectedOutput, stop, logl)
 		if err != nil {
-			return err
+			if ctx.Err() != nil { // shutting down
+				return err
+			}
+
+			r.control.ReportScreen(screenStatus{Screen: connectedOutput.ScreenId()})
+
+			if errGiveUp := r.recordingFailed(ctx, connectedOutput, err, &failures, stop, logl); errGiveUp != nil {
+				return errGiveUp
+			}
+
+			select {
+			case <-stop:
+				return nil
+			case <-ctx.Done():
+				return nil
+			default:
+				continue
+			}
 		}
 
+		failures.Succeeded()
+
+		r.control.ReportScreen(screenStatus{Screen: connectedOutput.ScreenId()}) // between segments
+
 		/* if we make one one minute videos with 15 seconds between frames, it's 4 frames/minute at:
 
 		0 seconds
@@ -126,132 +344,598 @@ func recordOneScreenContinuously(
 
 		we're done at 45 second mark, so need sleep w/ nextTick amount (refers to next minute's 0 seconds)
 		*/
-		time.Sleep(time.Until(nextTick))
+		select {
+		case <-stop:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Until(nextTick)):
+		}
+	}
+}
+
+// salvages the failed segment and waits before retrying (or until "stop" is closed). returns an
+// error if the recording shouldn't be retried.
+func (r *recorder) recordingFailed(
+	ctx context.Context,
+	connectedOutput randrOutput,
+	err error,
+	failures *recordingFailures,
+	stop <-chan struct{},
+	logl *logex.Leveled,
+) error {
+	failedAt := time.Now().UTC()
+
+	backoff, errGiveUp := failures.Failed(err, failedAt)
+	if errGiveUp != nil {
+		return errGiveUp
+	}
+
+	logl.Error.Printf("recording failed (%d in a row), retrying in %s: %v", failures.Count(), backoff, err)
+
+	// the failed segment's work dir is unlocked now
+	if err := r.recoverInterruptedSegments(ctx, logl); err != nil {
+		logl.Error.Printf("recovery: %v", err)
+	}
+
+	select {
+	case <-stop:
+	case <-ctx.Done():
+	case <-time.After(backoff):
+	}
+
+	if err := r.index.AddGap(ctx, recordingGap{
+		Start:  failedAt,
+		End:    time.Now().UTC(),
+		Reason: gapReasonFailing,
+		Screen: connectedOutput.ScreenId(),
+	}); err != nil {
+		logl.Error.Printf("index: %v", err)
 	}
+
+	return nil
 }
 
 // returns next tick
-func recordOneScreen(
+func (r *recorder) recordOneScreen(
 	ctx context.Context,
 	connectedOutput randrOutput,
-	renderer string,
-	xutil *xgbutil.XUtil,
+	stop <-chan struct{},
 	logl *logex.Leveled,
-) (time.Time, error) {
+) (_ time.Time, errRet error) {
 	logl.Info.Println("starting next video interval")
 
-	root := xproto.Setup(xutil.Conn()).DefaultScreen(xutil.Conn()).Root
+	conf := r.conf // shorthand
 
-	// snap screenshot every 5 seconds and make 15-minute videos.
+	// snap screenshot every 5 seconds (by default) and make 15-minute videos.
 	// when we start this we might not be at exactly 12:15:00 though, so we start from the next
 	// even 5-second mark that is in the future
-	interval := 5 * time.Second
-	ticks := ticksBetween(time.Now().UTC(), 15, interval)
+	interval := conf.FrameInterval
+	// in the configured time zone, so are the segment's path and its time subtitles
+	ticks := ticksBetween(time.Now().In(conf.Location()), conf.SegmentMinutes, interval)
 	if len(ticks) == 0 { // can happen when we're close to the end window
 		return time.Time{}, nil
 	}
 
 	nextTick := ticks[len(ticks)-1].Add(interval)
 
-	fps := 2
+	fps := conf.Fps
 
-	// using SHM to reduce I/O
-	tempDir, err := ioutil.TempDir("/dev/shm", "workrecorder-*")
+	manifest := segmentManifest{
+		Screen:   connectedOutput.ScreenId(),
+		Interval: interval,
+		Fps:      fps,
+		Codec:    r.encoder.Codec,
+	}
+
+	// using SHM (by default) to reduce I/O
+	tempDir, unlockTempDir, err := createWorkDir(conf.WorkDir, manifest)
 	if err != nil {
 		return nextTick, err
 	}
+	defer unlockTempDir()
 
-	defer os.RemoveAll(tempDir)
+	// on failure the footage so far is left for recovery
+	defer func() {
+		if errRet == nil {
+			os.RemoveAll(tempDir)
+		}
+	}()
 
-	subtitlesPath, err := makeSubtitles(fps, ticks, tempDir)
+	journal, err := createFrameJournal(filepath.Join(tempDir, workDirJournalFile))
 	if err != nil {
 		return nextTick, err
 	}
+	defer journal.Close()
 
-	videoOutputFile := filepath.Join(
-		connectedOutput.ScreenId().ReadyPath(""),
-		ticks[0].Format("2006-01-02"),
-		fmt.Sprintf("%s.mkv", ticks[0].Format("15-04-05")))
+	videoOnlyInMemFile := filepath.Join(tempDir, workDirVideoFile)
 
-	if err := os.MkdirAll(filepath.Dir(videoOutputFile), 0770); err != nil {
+	// on shutdown the segment so far is still encoded and stored
+	segmentCtx, cancel := contextWithGracePeriod(ctx, segmentFinalizeTimeout)
+	defer cancel()
+
+	var frames []frameMetadata
+	ending := segmentEndingComplete
+
+	err = encodeFrames(segmentCtx, conf.FfmpegInput, fps, len(ticks), tempDir, func(emit frameEmitter) error {
+		var err error
+		frames, ending, err = r.captureFrames(ctx, connectedOutput, ticks, stop, emit, journal, logl)
+		return err
+	}, func(inputArgs []string) []string {
+		// frames have durations (unchanged ones were left out), so the frame rate is made constant
+		// again by repeating them
+		encoderInputArgs, encoderOutputArgs := r.encoder.Args(r.renderNode, conf.Quality, fmt.Sprintf("fps=%d", fps))
+
+		args := []string{
+			"-hide_banner",
+			"-loglevel", "error", // be less verbose
+		}
+		args = append(args, encoderInputArgs...)
+		args = append(args, inputArgs...)
+		args = append(args, encoderOutputArgs...)
+		args = append(args, crashTolerantVideoArgs()...)
+		return append(args, videoOnlyInMemFile)
+	})
+	if err != nil {
 		return nextTick, err
 	}
 
+	if ending == segmentEndingCut || ending == segmentEndingClockJump { // the next segment starts right away
+		nextTick = time.Time{}
+	}
+
+	if len(frames) == 0 { // stopped before first frame
+		return nextTick, nil
+	}
+
+	if len(frames) < len(ticks) {
+		logl.Info.Printf("segment closed early after %d/%d frames", len(frames), len(ticks))
+	}
+
+	truncated := ""
+	if ending == segmentEndingShutdown {
+		truncated = segmentTruncatedShutdown
+	}
+
+	if err := r.storeSegment(segmentCtx, tempDir, manifest, videoOnlyInMemFile, frames, truncated); err != nil {
+		return nextTick, err
+	}
+
+	return nextTick, nil
+}
+
+// muxes in the subtitles, moves the video to the output tree and records it in the index and the
+// ledger. "videoOnlyFile" has a frame for each of "frames". "truncated" is why the segment ended
+// early (empty if it didn't). intermediate files go in a directory of their own in "workDir".
+func (r *recorder) storeSegment(
+	ctx context.Context,
+	workDir string,
+	manifest segmentManifest,
+	videoOnlyFile string,
+	frames []frameMetadata,
+	truncated string,
+) error {
+	conf := r.conf // shorthand
+
+	// a previous attempt (of recovery) might have left files of its own
+	tempDir := filepath.Join(workDir, workDirStoreDir)
+	if err := os.RemoveAll(tempDir); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(tempDir, 0700); err != nil {
+		return err
+	}
+
+	videoOutputFile := segmentPath(conf.OutputDir, manifest.Screen, frames[0].Timestamp, r.recipients != nil)
+
+	if err := os.MkdirAll(filepath.Dir(videoOutputFile), 0770); err != nil {
+		return err
+	}
+
 	videoOutputInMemFile := filepath.Join(tempDir, "capture.mkv")
 
-	if err := ffmpegWithOnTheFlyInput(ctx, len(ticks), tempDir, func(ffmpegItem io.Writer, idx int) error {
-		timestamp := ticks[idx]
+	// subtitles are muxed in only after encoding, because only now we know which frames made it
+	subtitleTracks, err := makeSubtitleTracks(manifest.Fps, frames, tempDir)
+	if err != nil {
+		return err
+	}
 
-		// wait for the wall clock to reach the timestamp
-		time.Sleep(time.Until(timestamp))
+	metadata := []string{segmentUtcOffsetMetadata(frames[0].Timestamp)}
+	if truncated != "" {
+		metadata = append(metadata, segmentTruncatedMetadataKey+"="+truncated)
+	}
 
-		// logl.Debug.Println("frame")
+	if err := muxSubtitles(ctx, videoOnlyFile, subtitleTracks, metadata, videoOutputInMemFile); err != nil {
+		return err
+	}
+
+	// the file that leaves RAM. encrypting it here means plaintext never touches persistent storage.
+	storedInMemFile := videoOutputInMemFile
+	if r.recipients != nil {
+		storedInMemFile = videoOutputInMemFile + encryptedExtension
+
+		if err := encryptFile(videoOutputInMemFile, storedInMemFile, r.recipients); err != nil {
+			return fmt.Errorf("encrypt: %w", err)
+		}
+	}
 
-		// with multi-monitor setup X's root window spans multiple monitors, therefore we ask a specific
-		// rectangle inside it (whose location is specified by RANDR)
-		screenshotForScreen, err := newDrawableFromGeometry(xutil, xproto.Drawable(root), connectedOutput.XRect())
+	// hashing while the file is still in RAM
+	segment, err := segmentRecordWithFileInfo(segmentRecord{
+		Screen:     manifest.Screen,
+		Path:       segmentPathRelative(conf.OutputDir, videoOutputFile),
+		Start:      frames[0].Timestamp,
+		End:        frames[len(frames)-1].Timestamp.Add(manifest.Interval),
+		FrameCount: len(frames),
+		Codec:      manifest.Codec,
+		Tier:       segmentTierOriginal,
+		Truncated:  truncated,
+	}, storedInMemFile)
+	if err != nil {
+		return err
+	}
+
+	if r.recipients != nil { // so the decrypted recording can be proven too
+		segment.Plaintext, err = sha256File(videoOutputInMemFile)
 		if err != nil {
 			return err
 		}
+	}
 
-		// PNG uses quite a lot of CPU (it would have to get decoded back anyway), so pass it as BMP
-		// without compression
-		return bmp.Encode(ffmpegItem, screenshotForScreen)
-	}, func(concatFilename string) error {
-		ffmpeg := exec.CommandContext(
-			ctx,
-			"ffmpeg",
-			"-hide_banner",
-			"-loglevel", "error", // be less verbose
-			"-vaapi_device", renderer, // looks like "/dev/dri/renderD129"
-			"-r", fmt.Sprintf("%d/1", fps),
-			"-f", "concat",
-			"-safe", "0", // needed for file list with absolute paths
-			"-i", concatFilename,
-			"-i", subtitlesPath,
-			"-vf", "format=nv12,hwupload,scale_vaapi=",
-			"-c:v", "hevc_vaapi",
-			"-qp", "24",
-			videoOutputInMemFile,
-		)
-
-		ffmpeg.Stdout = os.Stdout
-		ffmpeg.Stderr = os.Stderr
-
-		return ffmpeg.Run()
-	}); err != nil {
-		return nextTick, err
+	// if we don't get to index it and add it to the ledger, the recovery will
+	if err := writeStoringSegment(workDir, storingSegment{Segment: segment, Frames: frames}); err != nil {
+		return err
 	}
 
-	if err := osutil.MoveFile(videoOutputInMemFile, videoOutputFile); err != nil {
-		return nextTick, err
+	if err := osutil.MoveFile(storedInMemFile, videoOutputFile); err != nil {
+		return err
 	}
 
-	return nextTick, nil
+	if err := r.index.AddSegment(ctx, segment, frames); err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+
+	if err := r.ledger.AddSegment(segment); err != nil {
+		return fmt.Errorf("ledger: %w", err)
+	}
+
+	return nil
 }
 
-type ScreenId string
+// why the capturing of a segment ended
+type segmentEnding int
+
+const (
+	segmentEndingComplete  segmentEnding = iota // all of the interval's ticks
+	segmentEndingStopped                        // output disconnected or changed
+	segmentEndingCut                            // by request
+	segmentEndingClockJump                      // resumed from suspend or the clock was stepped
+	segmentEndingShutdown
+)
+
+// captures a frame for each tick (skipping ticks during a pause) until the ticks run out, "stop"
+// is closed, the segment is cut or "ctx" is cancelled. emits only the changed frames, each with how
+// long it's on screen. returns each captured frame's metadata and why capturing ended.
+func (r *recorder) captureFrames(
+	ctx context.Context,
+	connectedOutput randrOutput,
+	ticks []time.Time,
+	stop <-chan struct{},
+	emit frameEmitter,
+	journal *frameJournal,
+	logl *logex.Leveled,
+) ([]frameMetadata, segmentEnding, error) {
+	frames := []frameMetadata{}
+	ending := segmentEndingComplete
 
-func (s ScreenId) ReadyPath(additional string) string {
-	return filepath.Join("/output", string(s), additional)
+	// frames are produced from our own cursor over the ticks, as ticks during a pause are skipped
+	nextTickIdx := 0
+	pauseMarked := false // only one marker frame per pause
+	cutGeneration := r.control.CutGeneration()
+
+	// a frame is emitted only when the next changed frame (or the end) comes, as only then we know
+	// its duration. unchanged frames extend the held frame's duration.
+	var held *heldFrame
+
+	for {
+		if ending == segmentEndingComplete && r.control.CutGeneration() != cutGeneration {
+			logl.Info.Println("cutting segment")
+			ending = segmentEndingCut
+		}
+
+		if ending != segmentEndingComplete || nextTickIdx >= len(ticks) {
+			break
+		}
+
+		timestamp := ticks[nextTickIdx]
+
+		// wait for the wall clock to reach the timestamp
+		select {
+		case <-stop:
+			ending = segmentEndingStopped
+			continue
+		case <-ctx.Done():
+			logl.Info.Println("shutting down, finishing segment")
+			ending = segmentEndingShutdown
+			continue
+		case <-r.control.Changed(): // paused, resumed or cut
+			continue
+		case <-time.After(time.Until(timestamp)):
+		}
+
+		if now := time.Now().UTC(); tickStale(timestamp, now, r.conf.FrameInterval) {
+			logl.Info.Printf("tick %s is %s late (resumed from suspend or clock jumped?), closing segment", timestamp.Format(time.RFC3339), now.Sub(timestamp).Round(time.Second))
+			ending = segmentEndingClockJump
+			continue
+		}
+
+		nextTickIdx++
+
+		var frameImage *xgraphics.Image
+		var frameHash uint64
+
+		if r.control.Paused() {
+			if pauseMarked {
+				continue
+			}
+
+			pauseMarked = true
+
+			// makes the pause visible in the video and its subtitles
+			frameImage = xgraphics.New(r.xutil, image.Rect(0, 0, connectedOutput.Rect().Dx(), connectedOutput.Rect().Dy()))
+
+			frames = append(frames, frameMetadata{
+				Timestamp: timestamp,
+				UserIdle:  userIdleUnknown,
+				Paused:    true,
+			})
+		} else {
+			pauseMarked = false
+
+			screenshot, frame, err := r.captureFrame(connectedOutput, timestamp, logl)
+			if err != nil {
+				return frames, ending, err
+			}
+
+			frames = append(frames, frame)
+
+			frameHash = hashPixels(screenshot.Pix)
+			if held != nil && !held.Marker && held.Hash == frameHash {
+				held.Ticks++
+			} else {
+				frameImage = screenshot
+			}
+		}
+
+		r.control.ReportScreen(screenStatus{
+			Screen:       connectedOutput.ScreenId(),
+			SegmentStart: frames[0].Timestamp,
+			Frames:       len(frames),
+		})
+
+		if err := journal.Append(frames[len(frames)-1]); err != nil {
+			return frames, ending, fmt.Errorf("journal: %w", err)
+		}
+
+		if frameImage == nil { // unchanged
+			continue
+		}
+
+		previous := held
+		held = &heldFrame{
+			capturedFrame: capturedFrame{Image: frameImage, Ticks: 1},
+			Hash:          frameHash,
+			Marker:        pauseMarked,
+		}
+
+		if previous != nil {
+			if err := emit(previous.capturedFrame); err != nil {
+				return frames, ending, err
+			}
+		}
+	}
+
+	if held != nil {
+		// the fps filter shows the last frame only once, so its last tick is emitted on its own
+		// (same image) for the video to last until the end
+		if held.Ticks > 1 {
+			if err := emit(capturedFrame{Image: held.Image, Ticks: held.Ticks - 1}); err != nil {
+				return frames, ending, err
+			}
+		}
+
+		if err := emit(capturedFrame{Image: held.Image, Ticks: 1}); err != nil {
+			return frames, ending, err
+		}
+	}
+
+	return frames, ending, nil
 }
 
-func connectX11AndGetConnectedOutputs() (*xgbutil.XUtil, []randrOutput, error) {
-	xutil, err := xgbutil.NewConn()
+// screenshot of the output (sensitive windows redacted) and what we know about it
+func (r *recorder) captureFrame(
+	connectedOutput randrOutput,
+	timestamp time.Time,
+	logl *logex.Leveled,
+) (*xgraphics.Image, frameMetadata, error) {
+	xutil := r.xutil
+
+	redactRects := r.windowsToRedact(connectedOutput, logl)
+
+	screenshotForScreen, err := r.capturer.Capture(connectedOutput)
 	if err != nil {
-		return nil, nil, err
+		return nil, frameMetadata{}, err
 	}
 
-	X := xutil.Conn()
+	// metadata is not worth failing the recording for
+	activeWindow, err := getActiveWindow(xutil)
+	if err != nil {
+		logl.Debug.Printf("getActiveWindow: %v", err)
+	}
 
-	if err := randr.Init(X); err != nil {
-		return nil, nil, err
+	redactedWindows := 0
+	if r.redactor != nil {
+		// windows are looked up both before and after the screenshot, so ones that appeared or
+		// moved while taking it are covered too
+		redactRects = append(redactRects, r.windowsToRedact(connectedOutput, logl)...)
+
+		redactedWindows = r.redactor.Redact(screenshotForScreen, connectedOutput.Rect(), redactRects)
+
+		if r.redactor.Matches(activeWindow) {
+			activeWindow.Title = redactedTitle
+		}
+	}
+
+	userIdle := userIdleUnknown
+	if r.screensaverAvailable {
+		userIdle, err = getUserIdle(xutil)
+		if err != nil {
+			logl.Debug.Printf("getUserIdle: %v", err)
+		}
+	}
+
+	return screenshotForScreen, frameMetadata{
+		Timestamp:       timestamp,
+		ActiveWindow:    activeWindow,
+		UserIdle:        userIdle,
+		RedactedWindows: redactedWindows,
+	}, nil
+}
+
+// saves a PNG of each connected output. returns the written files.
+func (r *recorder) SnapshotConnectedOutputs(logl *logex.Leveled) ([]string, error) {
+	xutil := r.xutil
+
+	outputs, err := getConnectedOutputs(xutil.Conn(), xproto.Setup(xutil.Conn()).DefaultScreen(xutil.Conn()).Root)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().In(r.conf.Location())
+
+	written := []string{}
+	for _, output := range outputs {
+		screenshot, _, err := r.captureFrame(output, now, logl)
+		if err != nil {
+			return written, fmt.Errorf("%s: %w", output.ScreenId(), err)
+		}
+
+		snapshotFile := snapshotPath(r.conf.OutputDir, output.ScreenId(), now, r.recipients != nil)
+
+		if err := r.storeSnapshot(screenshot, snapshotFile); err != nil {
+			return written, fmt.Errorf("%s: %w", output.ScreenId(), err)
+		}
+
+		written = append(written, snapshotFile)
+	}
+
+	return written, nil
+}
+
+// like segments, encrypted in the work dir if encryption is on
+func (r *recorder) storeSnapshot(screenshot image.Image, snapshotFile string) error {
+	if err := os.MkdirAll(filepath.Dir(snapshotFile), 0770); err != nil {
+		return err
+	}
+
+	tempDir, err := ioutil.TempDir(r.conf.WorkDir, "workrecorder-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	pngInMemFile := filepath.Join(tempDir, "snapshot.png")
+
+	if err := func() error {
+		pngFile, err := os.OpenFile(pngInMemFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, osutil.FileMode(osutil.OwnerRW, osutil.GroupNone, osutil.OtherNone))
+		if err != nil {
+			return err
+		}
+		defer pngFile.Close() // double close intentional
+
+		if err := png.Encode(pngFile, screenshot); err != nil {
+			return err
+		}
+
+		return pngFile.Close()
+	}(); err != nil {
+		return err
+	}
+
+	if r.recipients != nil {
+		return encryptFile(pngInMemFile, snapshotFile, r.recipients)
 	}
 
-	connectedOutputs, err := getConnectedOutputs(X, xproto.Setup(X).DefaultScreen(X).Root)
+	return osutil.MoveFile(pngInMemFile, snapshotFile)
+}
+
+// rectangles (root window coordinates) to redact from the screenshot. nil if redaction is off.
+func (r *recorder) windowsToRedact(connectedOutput randrOutput, logl *logex.Leveled) []image.Rectangle {
+	if r.redactor == nil {
+		return nil
+	}
+
+	rects, err := r.redactor.MatchingWindowRects(r.xutil)
 	if err != nil {
-		return nil, nil, err
+		// we can't know what's sensitive, so redact the whole screen instead of failing the recording
+		logl.Error.Printf("redaction: %v (redacting whole screen)", err)
+
+		return []image.Rectangle{connectedOutput.Rect()}
+	}
+
+	return rects
+}
+
+// what we know about a captured frame
+type frameMetadata struct {
+	Timestamp       time.Time
+	ActiveWindow    activeWindow
+	UserIdle        time.Duration // userIdleUnknown if unknown
+	RedactedWindows int           // how many windows were blacked out / pixelated
+	Paused          bool          // marker frame (black) for when recording was paused
+}
+
+func makeSubtitleTracks(fps int, frames []frameMetadata, dir string) ([]subtitleTrack, error) {
+	timeCaptions := []string{}
+	windowCaptions := []string{}
+	for _, frame := range frames {
+		timeCaptions = append(timeCaptions, frame.Timestamp.Format("15:04:05"))
+		if frame.Paused {
+			windowCaptions = append(windowCaptions, pausedCaption)
+		} else {
+			windowCaptions = append(windowCaptions, frame.ActiveWindow.Caption())
+		}
+	}
+
+	tracks := []subtitleTrack{
+		{Title: "Time", Path: filepath.Join(dir, "time.srt")},
+		{Title: "Active window", Path: filepath.Join(dir, "activewindow.srt")},
+	}
+
+	for idx, captions := range [][]string{timeCaptions, windowCaptions} {
+		if err := makeSubtitles(fps, captions, tracks[idx].Path); err != nil {
+			return nil, err
+		}
+	}
+
+	return tracks, nil
+}
+
+type ScreenId string
+
+func (s ScreenId) ReadyPath(outputDir string, additional string) string {
+	return filepath.Join(outputDir, string(s), additional)
+}
+
+func connectX11() (*xgbutil.XUtil, error) {
+	xutil, err := xgbutil.NewConn()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := randr.Init(xutil.Conn()); err != nil {
+		return nil, err
 	}
 
-	return xutil, connectedOutputs, nil
+	return xutil, nil
 }
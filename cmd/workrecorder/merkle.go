@@ -0,0 +1,98 @@
+package main
+
+// Merkle tree hashing as in RFC 6962 (Certificate Transparency), section 2.1. Leaf and interior
+// node hashes have different prefixes so a leaf can't pose as an interior node.
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+func merkleLeafHash(leaf []byte) []byte {
+	hash := sha256.Sum256(append([]byte{0x00}, leaf...))
+	return hash[:]
+}
+
+func merkleNodeHash(left []byte, right []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{0x01}, left...), right...))
+	return hash[:]
+}
+
+// MTH() of RFC 6962. root of zero leaves is hash of empty string.
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	case 1:
+		return merkleLeafHash(leaves[0])
+	default:
+		split := merkleSplit(len(leaves))
+
+		return merkleNodeHash(merkleRoot(leaves[:split]), merkleRoot(leaves[split:]))
+	}
+}
+
+// largest power of two smaller than n (n > 1)
+func merkleSplit(n int) int {
+	split := 1
+	for split*2 < n {
+		split *= 2
+	}
+
+	return split
+}
+
+// PATH() of RFC 6962: the sibling hashes from leaf at "index" up to the root. lets one check that
+// the leaf is in the tree without knowing the other leaves.
+func merkleInclusionProof(leaves [][]byte, index int) [][]byte {
+	if len(leaves) <= 1 {
+		return [][]byte{}
+	}
+
+	split := merkleSplit(len(leaves))
+
+	if index < split {
+		return append(merkleInclusionProof(leaves[:split], index), merkleRoot(leaves[split:]))
+	}
+
+	return append(merkleInclusionProof(leaves[split:], index-split), merkleRoot(leaves[:split]))
+}
+
+// computes the root from an inclusion proof. algorithm from RFC 9162 section 2.1.3.2.
+func merkleRootFromInclusionProof(leaf []byte, index int, treeSize int, proof [][]byte) ([]byte, error) {
+	if index < 0 || index >= treeSize {
+		return nil, fmt.Errorf("leaf index %d out of range for tree size %d", index, treeSize)
+	}
+
+	fn := index
+	sn := treeSize - 1
+	hash := merkleLeafHash(leaf)
+
+	for _, sibling := range proof {
+		if sn == 0 {
+			return nil, errors.New("inclusion proof too long")
+		}
+
+		if fn%2 == 1 || fn == sn {
+			hash = merkleNodeHash(sibling, hash)
+
+			for fn%2 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			hash = merkleNodeHash(hash, sibling)
+		}
+
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return nil, errors.New("inclusion proof too short")
+	}
+
+	return hash, nil
+}
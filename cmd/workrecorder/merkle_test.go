@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+// test vectors from Certificate Transparency's reference implementation
+func TestMerkleRoot(t *testing.T) {
+	leaves := [][]byte{}
+	for _, leafHex := range []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f"} {
+		leaf, err := hex.DecodeString(leafHex)
+		assert.Ok(t, err)
+
+		leaves = append(leaves, leaf)
+	}
+
+	root := func(n int) string {
+		return hex.EncodeToString(merkleRoot(leaves[:n]))
+	}
+
+	assert.EqualString(t, root(0), "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	assert.EqualString(t, root(1), "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d")
+	assert.EqualString(t, root(2), "fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125")
+	assert.EqualString(t, root(3), "aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77")
+	assert.EqualString(t, root(4), "d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7")
+	assert.EqualString(t, root(5), "4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4")
+	assert.EqualString(t, root(6), "76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef")
+	assert.EqualString(t, root(7), "ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c")
+	assert.EqualString(t, root(8), "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328")
+}
+
+func TestMerkleInclusionProof(t *testing.T) {
+	for treeSize := 1; treeSize <= 9; treeSize++ {
+		leaves := [][]byte{}
+		for i := 0; i < treeSize; i++ {
+			leaves = append(leaves, []byte{byte(i)})
+		}
+
+		root := merkleRoot(leaves)
+
+		for index := 0; index < treeSize; index++ {
+			proof := merkleInclusionProof(leaves, index)
+
+			computed, err := merkleRootFromInclusionProof(leaves[index], index, treeSize, proof)
+			assert.Ok(t, err)
+			assert.EqualString(t, hex.EncodeToString(computed), hex.EncodeToString(root))
+
+			// proof for the wrong leaf or position doesn't compute to the root
+			wrongLeaf, err := merkleRootFromInclusionProof([]byte("other"), index, treeSize, proof)
+			assert.Ok(t, err)
+			assert.Assert(t, hex.EncodeToString(wrongLeaf) != hex.EncodeToString(root))
+
+			if treeSize > 1 {
+				wrongIndex, err := merkleRootFromInclusionProof(leaves[index], (index+1)%treeSize, treeSize, proof)
+				if err == nil {
+					assert.Assert(t, hex.EncodeToString(wrongIndex) != hex.EncodeToString(root))
+				}
+			}
+		}
+	}
+
+	// test vector from Certificate Transparency's reference implementation (leaf 0 of 8 leaves)
+	proof := [][]byte{}
+	for _, hashHex := range []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	} {
+		hash, err := hex.DecodeString(hashHex)
+		assert.Ok(t, err)
+
+		proof = append(proof, hash)
+	}
+
+	computed, err := merkleRootFromInclusionProof([]byte{}, 0, 8, proof)
+	assert.Ok(t, err)
+	assert.EqualString(t, hex.EncodeToString(computed), "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328")
+
+	_, err = merkleRootFromInclusionProof([]byte{}, 0, 8, proof[:2])
+	assert.EqualString(t, err.Error(), "inclusion proof too short")
+}
@@ -0,0 +1,171 @@
+package main
+
+// Minimal Matroska muxer for streaming raw BGRA frames to FFmpeg. Unlike plain rawvideo, each
+// frame has an explicit timestamp, so a frame that stays on screen for many ticks is sent once.
+// Only what FFmpeg's demuxer needs is written: one track, and a cluster per frame.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Matroska element IDs (their length markers included)
+const (
+	mkvIdEbml               = 0x1A45DFA3
+	mkvIdEbmlVersion        = 0x4286
+	mkvIdEbmlReadVersion    = 0x42F7
+	mkvIdEbmlMaxIdLength    = 0x42F2
+	mkvIdEbmlMaxSizeLength  = 0x42F3
+	mkvIdDocType            = 0x4282
+	mkvIdDocTypeVersion     = 0x4287
+	mkvIdDocTypeReadVersion = 0x4285
+	mkvIdSegment            = 0x18538067
+	mkvIdInfo               = 0x1549A966
+	mkvIdTimestampScale     = 0x2AD7B1
+	mkvIdMuxingApp          = 0x4D80
+	mkvIdWritingApp         = 0x5741
+	mkvIdTracks             = 0x1654AE6B
+	mkvIdTrackEntry         = 0xAE
+	mkvIdTrackNumber        = 0xD7
+	mkvIdTrackUid           = 0x73C5
+	mkvIdTrackType          = 0x83
+	mkvIdFlagLacing         = 0x9C
+	mkvIdCodecId            = 0x86
+	mkvIdVideo              = 0xE0
+	mkvIdPixelWidth         = 0xB0
+	mkvIdPixelHeight        = 0xBA
+	mkvIdColourSpace        = 0x2EB524
+	mkvIdCluster            = 0x1F43B675
+	mkvIdTimestamp          = 0xE7
+	mkvIdSimpleBlock        = 0xA3
+)
+
+// size of an element whose end isn't known when it's started (the segment, as we're streaming)
+var mkvUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+type mkvRawVideoWriter struct {
+	output    io.Writer
+	frameSize int // bytes
+}
+
+// writes the headers. frames are BGRA with no padding between rows.
+func newMkvRawVideoWriter(output io.Writer, width int, height int) (*mkvRawVideoWriter, error) {
+	header := mkvElement(mkvIdEbml,
+		mkvUint(mkvIdEbmlVersion, 1),
+		mkvUint(mkvIdEbmlReadVersion, 1),
+		mkvUint(mkvIdEbmlMaxIdLength, 4),
+		mkvUint(mkvIdEbmlMaxSizeLength, 8),
+		mkvString(mkvIdDocType, "matroska"),
+		mkvUint(mkvIdDocTypeVersion, 4),
+		mkvUint(mkvIdDocTypeReadVersion, 2))
+
+	header = append(header, mkvId(mkvIdSegment)...)
+	header = append(header, mkvUnknownSize...)
+
+	header = append(header, mkvElement(mkvIdInfo,
+		mkvUint(mkvIdTimestampScale, uint64(time.Millisecond)), // timestamps are in milliseconds
+		mkvString(mkvIdMuxingApp, "workrecorder"),
+		mkvString(mkvIdWritingApp, "workrecorder"))...)
+
+	header = append(header, mkvElement(mkvIdTracks,
+		mkvElement(mkvIdTrackEntry,
+			mkvUint(mkvIdTrackNumber, 1),
+			mkvUint(mkvIdTrackUid, 1),
+			mkvUint(mkvIdTrackType, 1), // video
+			mkvUint(mkvIdFlagLacing, 0),
+			mkvString(mkvIdCodecId, "V_UNCOMPRESSED"),
+			mkvElement(mkvIdVideo,
+				mkvUint(mkvIdPixelWidth, uint64(width)),
+				mkvUint(mkvIdPixelHeight, uint64(height)),
+				mkvElement(mkvIdColourSpace, []byte("BGRA")))))...) // FourCC of the pixel format
+
+	if _, err := output.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &mkvRawVideoWriter{
+		output:    output,
+		frameSize: width * height * 4,
+	}, nil
+}
+
+// "timestamp" is from the start of the video
+func (m *mkvRawVideoWriter) WriteFrame(timestamp time.Duration, pixels []byte) error {
+	if len(pixels) != m.frameSize {
+		return fmt.Errorf("frame is %d bytes; expected %d (resolution changed?)", len(pixels), m.frameSize)
+	}
+
+	// the block's own timestamp is relative to the cluster's, and we have one block per cluster
+	blockHeader := []byte{
+		0x81,       // track number 1 (as EBML variable-length integer)
+		0x00, 0x00, // relative timestamp
+		0x80, // keyframe
+	}
+
+	simpleBlockHeader := append(mkvId(mkvIdSimpleBlock), mkvSize(len(blockHeader)+len(pixels))...)
+	simpleBlockHeader = append(simpleBlockHeader, blockHeader...)
+
+	clusterTimestamp := mkvUint(mkvIdTimestamp, uint64(timestamp.Milliseconds()))
+
+	clusterHeader := append(mkvId(mkvIdCluster), mkvSize(len(clusterTimestamp)+len(simpleBlockHeader)+len(pixels))...)
+	clusterHeader = append(clusterHeader, clusterTimestamp...)
+	clusterHeader = append(clusterHeader, simpleBlockHeader...)
+
+	if _, err := m.output.Write(clusterHeader); err != nil {
+		return err
+	}
+
+	_, err := m.output.Write(pixels)
+	return err
+}
+
+func mkvElement(id uint32, children ...[]byte) []byte {
+	data := []byte{}
+	for _, child := range children {
+		data = append(data, child...)
+	}
+
+	element := append(mkvId(id), mkvSize(len(data))...)
+	return append(element, data...)
+}
+
+func mkvUint(id uint32, value uint64) []byte {
+	encoded := binary.BigEndian.AppendUint64(nil, value)
+
+	// shortest representation, but at least one byte
+	for len(encoded) > 1 && encoded[0] == 0 {
+		encoded = encoded[1:]
+	}
+
+	return mkvElement(id, encoded)
+}
+
+func mkvString(id uint32, value string) []byte {
+	return mkvElement(id, []byte(value))
+}
+
+// IDs are stored as-is (they include their length marker)
+func mkvId(id uint32) []byte {
+	encoded := binary.BigEndian.AppendUint32(nil, id)
+
+	for len(encoded) > 1 && encoded[0] == 0 {
+		encoded = encoded[1:]
+	}
+
+	return encoded
+}
+
+// EBML variable-length integer: the number of leading zero bits tells the length
+func mkvSize(size int) []byte {
+	length := 1
+	// all ones is reserved for "unknown size"
+	for uint64(size) >= (uint64(1)<<(7*length))-1 {
+		length++
+	}
+
+	encoded := binary.BigEndian.AppendUint64(nil, uint64(size)|uint64(1)<<(7*length))
+
+	return encoded[8-length:]
+}
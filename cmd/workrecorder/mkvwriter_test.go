@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestMkvSize(t *testing.T) {
+	for _, tc := range []struct {
+		size     int
+		expected string
+	}{
+		{0, "80"},
+		{126, "fe"},
+		{127, "407f"}, // 0xff would mean unknown size
+		{16382, "7ffe"},
+		{16383, "203fff"},
+		{3840 * 2160 * 4, "11fa4000"},
+	} {
+		assert.EqualString(t, hex.EncodeToString(mkvSize(tc.size)), tc.expected)
+	}
+}
+
+func TestMkvRawVideoWriter(t *testing.T) {
+	output := &bytes.Buffer{}
+
+	video, err := newMkvRawVideoWriter(output, 1, 1)
+	assert.Ok(t, err)
+
+	assert.Assert(t, bytes.HasPrefix(output.Bytes(), []byte{0x1a, 0x45, 0xdf, 0xa3}))
+	assert.Assert(t, bytes.Contains(output.Bytes(), []byte("V_UNCOMPRESSED")))
+
+	output.Reset()
+
+	assert.Ok(t, video.WriteFrame(500*time.Millisecond, []byte{0x10, 0x20, 0x30, 0xff}))
+
+	assert.EqualString(t, hex.EncodeToString(output.Bytes()), "1f43b675"+ // cluster
+		"8e"+ // of 14 bytes
+		"e78201f4"+ // timestamp 500
+		"a388"+ // simple block of 8 bytes
+		"81000080"+ // track 1, relative timestamp 0, keyframe
+		"102030ff") // the pixel
+
+	assert.EqualString(t, video.WriteFrame(time.Second, []byte{0x10}).Error(), "frame is 1 bytes; expected 4 (resolution changed?)")
+}
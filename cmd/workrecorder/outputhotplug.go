@@ -0,0 +1,201 @@
+package main
+
+// Keeps one recorder running per connected output. RandR notifies us of changes (monitor
+// plugged/unplugged, rotated, resolution changed, laptop docked/undocked, ...) upon which we
+// re-enumerate the outputs and start/stop/restart recorders as needed.
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/BurntSushi/xgb/randr"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgbutil"
+	"github.com/function61/gokit/log/logex"
+)
+
+// (un)docking produces a burst of notifications with transient states in-between
+const outputChangesDebounce = 500 * time.Millisecond
+
+// recorder must return (nil) soon after "stop" is closed, but it can first finish its current segment
+type outputRecorderFn func(ctx context.Context, output randrOutput, stop <-chan struct{}) error
+
+type outputRecorder struct {
+	output randrOutput
+	stop   chan struct{}
+	done   chan struct{} // closed when recorder exits
+	err    error         // valid after "done" closed
+}
+
+func recordConnectedOutputs(
+	ctx context.Context,
+	xutil *xgbutil.XUtil,
+	record outputRecorderFn,
+	logl *logex.Leveled,
+) error {
+	X := xutil.Conn()
+	root := xproto.Setup(X).DefaultScreen(X).Root
+
+	if err := randr.SelectInputChecked(
+		X,
+		root,
+		randr.NotifyMaskScreenChange|randr.NotifyMaskCrtcChange|randr.NotifyMaskOutputChange,
+	).Check(); err != nil {
+		return err
+	}
+
+	outputsChanged := make(chan struct{}, 1)
+
+	// WaitForEvent() can't be cancelled, so this lives until the connection is closed (at shutdown,
+	// after the recorders that share the connection are done)
+	go func() {
+		for {
+			ev, xErr := X.WaitForEvent()
+			if ev == nil && xErr == nil { // connection closed
+				return
+			}
+
+			switch ev.(type) {
+			case randr.ScreenChangeNotifyEvent, randr.NotifyEvent:
+				select {
+				case outputsChanged <- struct{}{}:
+				default: // already pending
+				}
+			}
+		}
+	}()
+
+	supervisorDone := make(chan struct{})
+	defer close(supervisorDone)
+
+	recorderExited := make(chan *outputRecorder)
+
+	recorders := map[ScreenId]*outputRecorder{}
+
+	start := func(output randrOutput) {
+		recorder := &outputRecorder{
+			output: output,
+			stop:   make(chan struct{}),
+			done:   make(chan struct{}),
+		}
+
+		recorders[output.ScreenId()] = recorder
+
+		go func() {
+			recorder.err = record(ctx, recorder.output, recorder.stop)
+			close(recorder.done)
+
+			select {
+			case recorderExited <- recorder:
+			case <-supervisorDone:
+			}
+		}()
+	}
+
+	// waits for the recorder to finish its current segment
+	stop := func(recorder *outputRecorder) error {
+		delete(recorders, recorder.output.ScreenId())
+
+		close(recorder.stop)
+		<-recorder.done
+
+		return recorder.err
+	}
+
+	stopAll := func() error {
+		var firstErr error
+		for _, recorder := range recorders {
+			if err := stop(recorder); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		return firstErr
+	}
+
+	syncRecordersWithOutputs := func() error {
+		outputs, err := getConnectedOutputs(X, root)
+		if err != nil {
+			return err
+		}
+
+		stillConnected := map[ScreenId]bool{}
+
+		for _, output := range outputs {
+			stillConnected[output.ScreenId()] = true
+
+			recorder, running := recorders[output.ScreenId()]
+			switch {
+			case !running:
+				logl.Info.Printf("output %s connected at %v", output.ScreenId(), output.Rect())
+
+				start(output)
+			case recorder.output.Rect() != output.Rect():
+				logl.Info.Printf(
+					"output %s geometry changed %v -> %v; closing current segment",
+					output.ScreenId(),
+					recorder.output.Rect(),
+					output.Rect())
+
+				if err := stop(recorder); err != nil {
+					return err
+				}
+
+				start(output)
+			}
+		}
+
+		for screenId, recorder := range recorders {
+			if !stillConnected[screenId] {
+				logl.Info.Printf("output %s disconnected", screenId)
+
+				if err := stop(recorder); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if err := syncRecordersWithOutputs(); err != nil {
+		return coalesce(err, stopAll())
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return stopAll()
+		case <-outputsChanged:
+			select {
+			case <-ctx.Done():
+				return stopAll()
+			case <-time.After(outputChangesDebounce):
+			}
+
+			select { // we're about to sync, so any notifications received during debounce are stale
+			case <-outputsChanged:
+			default:
+			}
+
+			if err := syncRecordersWithOutputs(); err != nil {
+				return coalesce(err, stopAll())
+			}
+		case recorder := <-recorderExited:
+			if recorders[recorder.output.ScreenId()] != recorder { // we asked it to stop
+				continue
+			}
+
+			delete(recorders, recorder.output.ScreenId())
+
+			if recorder.err == nil {
+				recorder.err = errors.New("recorder exited unexpectedly")
+			}
+
+			logl.Error.Printf("output %s: %v", recorder.output.ScreenId(), recorder.err)
+
+			return coalesce(recorder.err, stopAll())
+		}
+	}
+}
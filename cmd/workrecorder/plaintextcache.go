@@ -0,0 +1,135 @@
+package main
+
+// The web UI asks for the same segment over and over (each seek is a range request, and hovering
+// the timeline asks for thumbnails), so decrypted segments are shared and kept for a while instead
+// of decrypting the whole segment for each request.
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// how many decrypted segments the web UI keeps around when they're not in use
+const servePlaintextsCached = 4
+
+// safe for concurrent use
+type plaintextCache struct {
+	conf    Config
+	max     int                             // entries kept when not in use
+	entries map[string]*plaintextCacheEntry // keyed by segment's path and modification time
+	mu      sync.Mutex
+}
+
+type plaintextCacheEntry struct {
+	ready    chan struct{} // closed when decrypting finished. the fields below are set by then.
+	path     string
+	cleanup  func()
+	err      error
+	users    int // guarded by cache's mutex, as is "lastUsed"
+	lastUsed time.Time
+}
+
+func newPlaintextCache(conf Config, max int) *plaintextCache {
+	return &plaintextCache{
+		conf:    conf,
+		max:     max,
+		entries: map[string]*plaintextCacheEntry{},
+	}
+}
+
+// like plaintextSegment(), but concurrent requests for a segment share one decryption and the
+// result outlives the request. call the returned release func when done with the file.
+func (c *plaintextCache) Get(segment segmentFile) (string, func(), error) {
+	if !segment.Encrypted {
+		return segment.Path, func() {}, nil
+	}
+
+	// compaction replaces segments in place
+	stat, err := os.Stat(segment.Path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := fmt.Sprintf("%s@%d", segment.Path, stat.ModTime().UnixNano())
+
+	c.mu.Lock()
+	entry, found := c.entries[key]
+	if !found {
+		entry = &plaintextCacheEntry{ready: make(chan struct{})}
+		c.entries[key] = entry
+	}
+	entry.users++
+	c.mu.Unlock()
+
+	if found {
+		<-entry.ready
+	} else {
+		entry.path, entry.cleanup, entry.err = plaintextSegment(c.conf, segment)
+		close(entry.ready)
+	}
+
+	release := func() {
+		c.release(key, entry)
+	}
+
+	if entry.err != nil {
+		release()
+		return "", nil, entry.err
+	}
+
+	return entry.path, release, nil
+}
+
+// removes the decrypted files once they're not in use
+func (c *plaintextCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.max = 0
+	c.evict()
+}
+
+func (c *plaintextCache) release(key string, entry *plaintextCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.users--
+	entry.lastUsed = time.Now()
+
+	if entry.err != nil { // so the next request tries again
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+
+		return
+	}
+
+	c.evict()
+}
+
+// removes the least recently used entries that aren't in use, until at most "max" are left.
+// must hold the mutex.
+func (c *plaintextCache) evict() {
+	for len(c.entries) > c.max {
+		oldestKey := ""
+		var oldest *plaintextCacheEntry
+		for key, entry := range c.entries {
+			if entry.users == 0 && (oldest == nil || entry.lastUsed.Before(oldest.lastUsed)) {
+				oldestKey = key
+				oldest = entry
+			}
+		}
+
+		if oldest == nil { // all in use. they're evicted when released.
+			return
+		}
+
+		delete(c.entries, oldestKey)
+
+		if oldest.err == nil {
+			oldest.cleanup()
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestPlaintextCache(t *testing.T) {
+	dir := t.TempDir()
+
+	identity, err := age.GenerateX25519Identity()
+	assert.Ok(t, err)
+
+	conf := defaultConfig()
+	conf.EncryptionIdentityFile = filepath.Join(dir, "identity.txt")
+	assert.Ok(t, os.WriteFile(conf.EncryptionIdentityFile, []byte(identity.String()+"\n"), 0600))
+
+	encryptedSegment := func(name string, content string) segmentFile {
+		plaintextPath := filepath.Join(dir, name)
+		assert.Ok(t, os.WriteFile(plaintextPath, []byte(content), 0600))
+
+		segment := segmentFile{Path: plaintextPath + encryptedExtension, Encrypted: true}
+		assert.Ok(t, encryptFile(plaintextPath, segment.Path, []age.Recipient{identity.Recipient()}))
+
+		return segment
+	}
+
+	first := encryptedSegment("12-00-00.mkv", "first")
+	second := encryptedSegment("12-15-00.mkv", "second")
+
+	cache := newPlaintextCache(conf, 1)
+
+	readPlaintext := func(path string) string {
+		content, err := os.ReadFile(path)
+		assert.Ok(t, err)
+		return string(content)
+	}
+
+	firstPath, releaseFirst, err := cache.Get(first)
+	assert.Ok(t, err)
+	assert.EqualString(t, readPlaintext(firstPath), "first")
+
+	// shared while in use
+	firstPathAgain, releaseFirstAgain, err := cache.Get(first)
+	assert.Ok(t, err)
+	assert.EqualString(t, firstPathAgain, firstPath)
+
+	releaseFirst()
+	releaseFirstAgain()
+
+	// .. and kept after
+	firstPathAgain, releaseFirstAgain, err = cache.Get(first)
+	assert.Ok(t, err)
+	assert.EqualString(t, firstPathAgain, firstPath)
+	releaseFirstAgain()
+
+	// only one is kept, so the least recently used one goes
+	secondPath, releaseSecond, err := cache.Get(second)
+	assert.Ok(t, err)
+	assert.EqualString(t, readPlaintext(secondPath), "second")
+	releaseSecond()
+
+	_, err = os.Stat(firstPath)
+	assert.Assert(t, os.IsNotExist(err))
+
+	cache.Close()
+
+	_, err = os.Stat(secondPath)
+	assert.Assert(t, os.IsNotExist(err))
+}
@@ -0,0 +1,358 @@
+package main
+
+// A proof lets you disclose a single segment to a third party, who can check (offline) that it's
+// part of the day's signed digest without seeing the day's other segments. The proof carries the
+// Merkle inclusion path from the segment's leaf to the digest's root, and the signed digest minus
+// its segment list. Encrypted segments are exported decrypted, as their leaf also commits to the
+// plaintext's hash.
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/function61/gokit/os/osutil"
+	"github.com/spf13/cobra"
+)
+
+const proofExtension = ".proof.json"
+
+type segmentProof struct {
+	Segment   digestSegment `json:"segment"`
+	LeafIndex int           `json:"leaf_index"`
+	TreeSize  int           `json:"tree_size"`
+	AuditPath []string      `json:"audit_path"`          // hex. from the leaf's sibling up to the root
+	Digest    dailyDigest   `json:"digest"`              // without segments
+	Timestamp []byte        `json:"timestamp,omitempty"` // RFC 3161 token over the digest (if it was timestamped)
+}
+
+func proveEntrypoint() *cobra.Command {
+	outputDir := "."
+	ciphertext := false
+
+	cmd := &cobra.Command{
+		Use:   "prove <segment>",
+		Short: "Exports a segment with a proof that it's in its day's signed digest",
+		Long: `Exports a segment with a proof that it's in its day's signed digest.
+
+Segment is a path to the file, or relative to the output dir ("DP-1/2021-06-28/12-15-00.mkv").
+
+Writes the segment and its proof ("DP-1_2021-06-28_12-15-00.mkv.proof.json") to the output dir.
+Encrypted segments are decrypted (unless --ciphertext). Whoever you give them to can check them
+without access to the rest of the recordings:
+
+    $ workrecorder verify --public-key digest-signing.pub --proof DP-1_2021-06-28_12-15-00.mkv.proof.json
+
+The daily digest is made after the day is over, so today's segments can't be proven yet.`,
+		Args: cobra.ExactArgs(1),
+	}
+
+	resolveConfig := registerConfigFlags(cmd.Flags())
+
+	cmd.Flags().StringVarP(&outputDir, "output-dir", "o", outputDir, "Directory to export the segment and proof to")
+	cmd.Flags().BoolVar(&ciphertext, "ciphertext", ciphertext, "Export an encrypted segment as is, without decrypting it")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		osutil.ExitIfError(func() error {
+			conf, err := resolveConfig()
+			if err != nil {
+				return err
+			}
+
+			return exportSegmentWithProof(*conf, resolveSegmentArg(conf.OutputDir, args[0]), outputDir, ciphertext, os.Stdout)
+		}())
+	}
+
+	return cmd
+}
+
+// "ciphertext" exports an encrypted segment as is, instead of decrypting it
+func exportSegmentWithProof(conf Config, segmentFilePath string, exportDir string, ciphertext bool, output io.Writer) error {
+	proof, err := makeSegmentProof(conf, segmentFilePath)
+	if err != nil {
+		return err
+	}
+
+	// segments encrypted before the plaintext hashes were recorded can only be proven as ciphertext
+	decrypt := proof.Segment.Plaintext != "" && !ciphertext
+
+	// "DP-1/2021-06-28/12-15-00.mkv" => "DP-1_2021-06-28_12-15-00.mkv"
+	exportName := strings.ReplaceAll(filepath.ToSlash(proof.Segment.Path), "/", "_")
+	if decrypt {
+		exportName = strings.TrimSuffix(exportName, encryptedExtension)
+	}
+
+	exportPath := filepath.Join(exportDir, exportName)
+
+	proofSerialized, err := json.MarshalIndent(proof, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if decrypt {
+		if err := decryptFileExclusive(conf, segmentFilePath, exportPath, proof.Segment.Plaintext); err != nil {
+			return err
+		}
+	} else {
+		if err := copyFileExclusive(segmentFilePath, exportPath); err != nil {
+			return err
+		}
+	}
+
+	if err := writeFileExclusive(exportPath+proofExtension, append(proofSerialized, '\n')); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "%s\n%s\n", exportPath, exportPath+proofExtension)
+
+	return nil
+}
+
+func makeSegmentProof(conf Config, segmentFilePath string) (*segmentProof, error) {
+	segment, err := parseSegmentPath(conf.OutputDir, segmentFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	relativePath := segmentPathRelative(conf.OutputDir, segmentFilePath)
+	day := segment.Start.Format(segmentDateLayout)
+
+	digest, err := readDailyDigest(digestPath(conf.OutputDir, segment.Screen, day))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: no daily digest for %s yet (it's made after the day is over)", relativePath, day)
+		}
+
+		return nil, err
+	}
+
+	leafIndex := -1
+	leaves := [][]byte{}
+	for idx, digestSegment := range digest.Segments {
+		if digestSegment.Path == relativePath {
+			leafIndex = idx
+		}
+
+		leaves = append(leaves, digestSegment.Leaf())
+	}
+
+	if leafIndex == -1 {
+		return nil, fmt.Errorf("%s: not in daily digest %s (only original recordings are, not compacted ones)", relativePath, day)
+	}
+
+	if hex.EncodeToString(merkleRoot(leaves)) != digest.Root {
+		return nil, fmt.Errorf("daily digest %s: root doesn't match its segments", day)
+	}
+
+	// no use exporting a proof that doesn't hold
+	hash, err := sha256File(segmentFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if hash != digest.Segments[leafIndex].Sha256 {
+		return nil, fmt.Errorf("%s: modified after daily digest %s was made (SHA-256 %s, digest says %s)", relativePath, day, hash, digest.Segments[leafIndex].Sha256)
+	}
+
+	auditPath := []string{}
+	for _, hash := range merkleInclusionProof(leaves, leafIndex) {
+		auditPath = append(auditPath, hex.EncodeToString(hash))
+	}
+
+	proof := &segmentProof{
+		Segment:   digest.Segments[leafIndex],
+		LeafIndex: leafIndex,
+		TreeSize:  len(leaves),
+		AuditPath: auditPath,
+		Digest:    *digest,
+	}
+	proof.Digest.Segments = nil // the point is to not disclose the others
+
+	token, err := os.ReadFile(timestampTokenPath(conf.OutputDir, segment.Screen, day))
+	switch {
+	case err == nil:
+		proof.Timestamp = token
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	return proof, nil
+}
+
+// needs nothing but the proof, the segment and the public key (no config or other recordings).
+// "timestampRoots" is optional.
+func verifySegmentProof(proofPath string, publicKey ed25519.PublicKey, timestampRoots *x509.CertPool, output io.Writer) error {
+	if publicKey == nil {
+		return errors.New("checking a proof needs the digest signing public key (--public-key)")
+	}
+
+	content, err := os.ReadFile(proofPath)
+	if err != nil {
+		return err
+	}
+
+	proof := segmentProof{}
+	if err := json.Unmarshal(content, &proof); err != nil {
+		return fmt.Errorf("%s: %w", proofPath, err)
+	}
+
+	segmentFilePath := strings.TrimSuffix(proofPath, proofExtension)
+
+	if err := checkSegmentProof(proof, segmentFilePath, publicKey); err != nil {
+		return fmt.Errorf("%w: %s: %v", errVerificationFailed, segmentFilePath, err)
+	}
+
+	var timestamp *timestampInfo
+	if proof.Timestamp != nil {
+		timestamp, err = verifyDigestTimestamp(proof.Digest, proof.Segment.Path, proof.Timestamp, timestampRoots)
+		if err != nil {
+			return fmt.Errorf("%w: %s: timestamp: %v", errVerificationFailed, segmentFilePath, err)
+		}
+	}
+
+	fmt.Fprintf(output, "%s: OK (%s is in signed daily digest %s of %s, root %s)\n",
+		segmentFilePath,
+		proof.Segment.Path,
+		proof.Digest.Day,
+		proof.Digest.Screen,
+		proof.Digest.Root)
+
+	if timestamp != nil {
+		fmt.Fprintf(output, "%s: digest timestamped at %s by %s\n", segmentFilePath, timestamp.Time.Format(time.RFC3339), timestamp.TSA)
+
+		if timestampRoots == nil {
+			fmt.Fprintf(output, "%s: note TSA certificate not checked (no timestamp_ca_file)\n", segmentFilePath)
+		}
+	}
+
+	return nil
+}
+
+func checkSegmentProof(proof segmentProof, segmentFilePath string, publicKey ed25519.PublicKey) error {
+	// the leaf's path says which screen and when. it has to be of the digest's screen and day.
+	if !strings.HasPrefix(proof.Segment.Path, string(proof.Digest.Screen)+"/"+proof.Digest.Day+"/") {
+		return fmt.Errorf("segment %s isn't of digest's screen %s and day %s", proof.Segment.Path, proof.Digest.Screen, proof.Digest.Day)
+	}
+
+	hash, err := sha256File(segmentFilePath)
+	if err != nil {
+		return err
+	}
+
+	// the segment is either as stored or (if encrypted) decrypted
+	if hash != proof.Segment.Sha256 && (proof.Segment.Plaintext == "" || hash != proof.Segment.Plaintext) {
+		if proof.Segment.Plaintext != "" {
+			return fmt.Errorf("modified (SHA-256 %s, proof says %s or decrypted %s)", hash, proof.Segment.Sha256, proof.Segment.Plaintext)
+		}
+
+		return fmt.Errorf("modified (SHA-256 %s, proof says %s)", hash, proof.Segment.Sha256)
+	}
+
+	auditPath := [][]byte{}
+	for _, hashHex := range proof.AuditPath {
+		hash, err := hex.DecodeString(hashHex)
+		if err != nil {
+			return fmt.Errorf("audit path: %w", err)
+		}
+
+		auditPath = append(auditPath, hash)
+	}
+
+	root, err := merkleRootFromInclusionProof(proof.Segment.Leaf(), proof.LeafIndex, proof.TreeSize, auditPath)
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(root) != proof.Digest.Root {
+		return fmt.Errorf("inclusion proof leads to root %s, digest's root is %s", hex.EncodeToString(root), proof.Digest.Root)
+	}
+
+	if proof.Digest.Signature == "" {
+		return errors.New("digest is unsigned")
+	}
+
+	// signature covers the root, so transitively the segment
+	return proof.Digest.VerifySignature(publicKey)
+}
+
+func copyFileExclusive(sourcePath string, destinationPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.OpenFile(destinationPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, osutil.FileMode(osutil.OwnerRW, osutil.GroupR, osutil.OtherNone))
+	if err != nil {
+		return err
+	}
+	defer destination.Close() // double close intentional
+
+	if _, err := io.Copy(destination, source); err != nil {
+		return err
+	}
+
+	return destination.Close()
+}
+
+// decrypts an encrypted segment to "destinationPath", which must then hash to "plaintextSha256"
+func decryptFileExclusive(conf Config, sourcePath string, destinationPath string, plaintextSha256 string) error {
+	if conf.EncryptionIdentityFile == "" {
+		return fmt.Errorf("%s: %w (or use --ciphertext)", sourcePath, errNoEncryptionIdentity)
+	}
+
+	identities, err := loadEncryptionIdentities(conf.EncryptionIdentityFile)
+	if err != nil {
+		return err
+	}
+
+	destination, err := os.OpenFile(destinationPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, osutil.FileMode(osutil.OwnerRW, osutil.GroupR, osutil.OtherNone))
+	if err != nil {
+		return err
+	}
+	defer destination.Close() // double close intentional
+
+	if err := decryptSegment(segmentFile{Path: sourcePath, Encrypted: true}, identities, destination); err != nil {
+		os.Remove(destinationPath)
+		return err
+	}
+
+	if err := destination.Close(); err != nil {
+		return err
+	}
+
+	// no use exporting a proof that doesn't hold
+	hash, err := sha256File(destinationPath)
+	if err != nil {
+		return err
+	}
+
+	if hash != plaintextSha256 {
+		os.Remove(destinationPath)
+		return fmt.Errorf("%s: decrypted SHA-256 %s doesn't match ledger's %s", sourcePath, hash, plaintextSha256)
+	}
+
+	return nil
+}
+
+func writeFileExclusive(path string, content []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, osutil.FileMode(osutil.OwnerRW, osutil.GroupR, osutil.OtherNone))
+	if err != nil {
+		return err
+	}
+	defer file.Close() // double close intentional
+
+	if _, err := file.Write(content); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestSegmentProof(t *testing.T) {
+	conf := defaultConfig()
+	conf.OutputDir = t.TempDir()
+	exportDir := t.TempDir()
+
+	publicKey, signingKey, err := ed25519.GenerateKey(nil)
+	assert.Ok(t, err)
+
+	ledger := newSegmentLedger(conf.OutputDir)
+
+	paths := []string{}
+	for idx, start := range []string{"2021-06-28T12:00:00Z", "2021-06-28T12:15:00Z", "2021-06-28T12:30:00Z"} {
+		startTime, err := time.Parse(time.RFC3339, start)
+		assert.Ok(t, err)
+
+		path := segmentPath(conf.OutputDir, "DP-1", startTime, false)
+		assert.Ok(t, os.MkdirAll(filepath.Dir(path), 0700))
+		assert.Ok(t, os.WriteFile(path, []byte{byte(idx)}, 0600))
+
+		segment, err := segmentRecordWithFileInfo(segmentRecord{
+			Screen: "DP-1",
+			Path:   segmentPathRelative(conf.OutputDir, path),
+			Start:  startTime,
+			End:    startTime.Add(15 * time.Minute),
+			Tier:   segmentTierOriginal,
+		}, path)
+		assert.Ok(t, err)
+
+		assert.Ok(t, ledger.AddSegment(segment))
+
+		paths = append(paths, path)
+	}
+
+	// no digest yet
+	assert.EqualString(t, exportSegmentWithProof(conf, paths[1], exportDir, false, io.Discard).Error(), "DP-1/2021-06-28/12-15-00.mkv: no daily digest for 2021-06-28 yet (it's made after the day is over)")
+
+	now := time.Date(2021, 6, 29, 1, 0, 0, 0, time.UTC)
+	assert.Ok(t, writeMissingDailyDigests(conf, ledger, signingKey, now, logex.Levels(logex.Discard)))
+
+	assert.Ok(t, exportSegmentWithProof(conf, paths[1], exportDir, false, io.Discard))
+
+	exported := filepath.Join(exportDir, "DP-1_2021-06-28_12-15-00.mkv")
+	proofPath := exported + proofExtension
+
+	assert.Ok(t, verifySegmentProof(proofPath, publicKey, nil, io.Discard))
+
+	otherPublicKey, _, err := ed25519.GenerateKey(nil)
+	assert.Ok(t, err)
+
+	assert.EqualString(t, verifySegmentProof(proofPath, otherPublicKey, nil, io.Discard).Error(), "verification failed: "+exported+": invalid signature")
+
+	// the other segments aren't disclosed
+	proofContent, err := os.ReadFile(proofPath)
+	assert.Ok(t, err)
+	assert.Assert(t, !strings.Contains(string(proofContent), "12-00-00"))
+
+	assert.Ok(t, os.WriteFile(exported, []byte("tampered"), 0600))
+
+	assert.EqualString(t, verifySegmentProof(proofPath, publicKey, nil, io.Discard).Error(), "verification failed: "+exported+": modified (SHA-256 d121be3103007b41edf96f8262925f8c7d61894afe9a041843b631f69445bc57, proof says 4bf5122f344554c53bde2ebb8cd2b7e3d1600ad631c385a5d7cce23c7785459a)")
+}
+
+func TestEncryptedSegmentProof(t *testing.T) {
+	conf := defaultConfig()
+	conf.OutputDir = t.TempDir()
+	exportDir := t.TempDir()
+	workDir := t.TempDir()
+
+	publicKey, signingKey, err := ed25519.GenerateKey(nil)
+	assert.Ok(t, err)
+
+	identity, err := age.GenerateX25519Identity()
+	assert.Ok(t, err)
+
+	conf.EncryptionIdentityFile = filepath.Join(workDir, "identity.txt")
+	assert.Ok(t, os.WriteFile(conf.EncryptionIdentityFile, []byte(identity.String()+"\n"), 0600))
+
+	startTime := time.Date(2021, 6, 28, 12, 15, 0, 0, time.UTC)
+
+	plaintextPath := filepath.Join(workDir, "capture.mkv")
+	assert.Ok(t, os.WriteFile(plaintextPath, []byte("video"), 0600))
+
+	path := segmentPath(conf.OutputDir, "DP-1", startTime, true)
+	assert.Ok(t, os.MkdirAll(filepath.Dir(path), 0700))
+	assert.Ok(t, encryptFile(plaintextPath, path, []age.Recipient{identity.Recipient()}))
+
+	segment, err := segmentRecordWithFileInfo(segmentRecord{
+		Screen: "DP-1",
+		Path:   segmentPathRelative(conf.OutputDir, path),
+		Start:  startTime,
+		End:    startTime.Add(15 * time.Minute),
+		Tier:   segmentTierOriginal,
+	}, path)
+	assert.Ok(t, err)
+
+	segment.Plaintext, err = sha256File(plaintextPath)
+	assert.Ok(t, err)
+
+	ledger := newSegmentLedger(conf.OutputDir)
+	assert.Ok(t, ledger.AddSegment(segment))
+
+	now := time.Date(2021, 6, 29, 1, 0, 0, 0, time.UTC)
+	assert.Ok(t, writeMissingDailyDigests(conf, ledger, signingKey, now, logex.Levels(logex.Discard)))
+
+	// decrypted by default
+	assert.Ok(t, exportSegmentWithProof(conf, path, exportDir, false, io.Discard))
+
+	exported := filepath.Join(exportDir, "DP-1_2021-06-28_12-15-00.mkv")
+
+	exportedContent, err := os.ReadFile(exported)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(exportedContent), "video")
+
+	assert.Ok(t, verifySegmentProof(exported+proofExtension, publicKey, nil, io.Discard))
+
+	// .. or as stored
+	ciphertextDir := t.TempDir()
+	assert.Ok(t, exportSegmentWithProof(conf, path, ciphertextDir, true, io.Discard))
+	assert.Ok(t, verifySegmentProof(filepath.Join(ciphertextDir, "DP-1_2021-06-28_12-15-00.mkv.age"+proofExtension), publicKey, nil, io.Discard))
+
+	assert.Ok(t, os.WriteFile(exported, []byte("tampered"), 0600))
+
+	assert.EqualString(t, verifySegmentProof(exported+proofExtension, publicKey, nil, io.Discard).Error(), "verification failed: "+exported+": modified (SHA-256 d121be3103007b41edf96f8262925f8c7d61894afe9a041843b631f69445bc57, proof says "+segment.Sha256+" or decrypted "+segment.Plaintext+")")
+}
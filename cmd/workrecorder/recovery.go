@@ -0,0 +1,378 @@
+package main
+
+// A segment is recorded in a work dir until it's finished. If the recorder crashes (or is killed, or
+// the power goes), the work dir is left behind. At startup the leftovers are salvaged into the output
+// tree: FFmpeg writes the video in small Matroska clusters that it flushes as it goes, and each
+// frame's metadata is journaled, so a cut-off video is readable up to its last complete cluster.
+//
+// Storing a finished segment takes a few steps (moving it into the output tree, indexing it and
+// adding it to the ledger), so what's being stored is written down first. If storing is
+// interrupted after the move, the recovery redoes the rest.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/os/osutil"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	workDirPrefix = "workrecorder-" // matches other temp dirs too, but only ones with a lock file are ours
+
+	workDirLockFile     = "recording.lock" // held while recording
+	workDirManifestFile = "segment.json"
+	workDirJournalFile  = "frames.jsonl"
+	workDirVideoFile    = "capture-video.mkv" // video without subtitles, as FFmpeg writes it
+	workDirStoringFile  = "storing.json"      // written just before the segment is moved to the output tree
+	workDirStoreDir     = "store"             // intermediate files of storing the segment
+)
+
+// how often FFmpeg finishes a cluster (ms). at most this much encoded video is lost in a crash, in
+// addition to what the encoder was still holding on to.
+const videoClusterTimeLimitMs = 5000
+
+// what a recovery needs to know of the segment that isn't in the frames themselves
+type segmentManifest struct {
+	Screen   ScreenId      `json:"screen"`
+	Interval time.Duration `json:"interval"` // between frames
+	Fps      int           `json:"fps"`
+	Codec    string        `json:"codec"`
+}
+
+// output args for a video that's readable even if FFmpeg never got to finish it
+func crashTolerantVideoArgs() []string {
+	return []string{
+		"-f", "matroska",
+		"-cluster_time_limit", strconv.Itoa(videoClusterTimeLimitMs),
+		"-flush_packets", "1", // write clusters out as they're done instead of buffering them
+	}
+}
+
+// a segment that's being stored
+type storingSegment struct {
+	Segment segmentRecord   `json:"segment"`
+	Frames  []frameMetadata `json:"frames"`
+}
+
+func writeStoringSegment(workDir string, storing storingSegment) error {
+	content, err := json.Marshal(storing)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(filepath.Join(workDir, workDirStoringFile))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(content); err != nil {
+		return err
+	}
+
+	// must hit the disk before the segment is moved
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// creates the work dir, locked until the returned unlock is called
+func createWorkDir(parentDir string, manifest segmentManifest) (string, func(), error) {
+	workDir, err := os.MkdirTemp(parentDir, workDirPrefix+"*")
+	if err != nil {
+		return "", nil, err
+	}
+
+	lock, err := lockWorkDir(workDir, true)
+	if err != nil {
+		os.RemoveAll(workDir)
+		return "", nil, err
+	}
+
+	manifestJson, err := json.Marshal(manifest)
+	if err != nil {
+		lock.Close()
+		os.RemoveAll(workDir)
+		return "", nil, err
+	}
+
+	if err := os.WriteFile(filepath.Join(workDir, workDirManifestFile), manifestJson, osutil.FileMode(osutil.OwnerRW, osutil.GroupNone, osutil.OtherNone)); err != nil {
+		lock.Close()
+		os.RemoveAll(workDir)
+		return "", nil, err
+	}
+
+	return workDir, func() { lock.Close() }, nil
+}
+
+// the lock goes away with the process, so a locked work dir belongs to a recorder that's running.
+// returns errWorkDirLocked if so.
+func lockWorkDir(workDir string, create bool) (*os.File, error) {
+	flags := os.O_RDONLY
+	if create {
+		flags |= os.O_CREATE
+	}
+
+	lock, err := os.OpenFile(filepath.Join(workDir, workDirLockFile), flags, osutil.FileMode(osutil.OwnerRW, osutil.GroupNone, osutil.OtherNone))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		lock.Close()
+
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, errWorkDirLocked
+		}
+
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+var errWorkDirLocked = errors.New("work dir in use")
+
+// frames' metadata as JSON lines, appended to as the frames are captured
+type frameJournal struct {
+	file *os.File
+}
+
+func createFrameJournal(path string) (*frameJournal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, osutil.FileMode(osutil.OwnerRW, osutil.GroupNone, osutil.OtherNone))
+	if err != nil {
+		return nil, err
+	}
+
+	return &frameJournal{file}, nil
+}
+
+func (j *frameJournal) Append(frame frameMetadata) error {
+	line, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	// a no-op on tmpfs, but on disk this is what survives a power loss
+	return j.file.Sync()
+}
+
+func (j *frameJournal) Close() error {
+	return j.file.Close()
+}
+
+// a crash can leave the last line half-written, in which case it's ignored
+func readFrameJournal(path string) ([]frameMetadata, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	frames := []frameMetadata{}
+
+	lines := strings.Split(string(content), "\n")
+	for idx, line := range lines {
+		if line == "" {
+			continue
+		}
+
+		frame := frameMetadata{}
+		if err := json.Unmarshal([]byte(line), &frame); err != nil {
+			if idx == len(lines)-1 { // complete lines end in a newline
+				break
+			}
+
+			return nil, err
+		}
+
+		frames = append(frames, frame)
+	}
+
+	return frames, nil
+}
+
+// salvages segments of work dirs left behind by a previous run. a work dir that can't be salvaged
+// is left in place, so the footage isn't lost.
+func (r *recorder) recoverInterruptedSegments(ctx context.Context, logl *logex.Leveled) error {
+	workDirs, err := filepath.Glob(filepath.Join(r.conf.WorkDir, workDirPrefix+"*"))
+	if err != nil {
+		return err
+	}
+
+	for _, workDir := range workDirs {
+		if err := r.recoverInterruptedSegment(ctx, workDir, logl); err != nil {
+			logl.Error.Printf("recovering %s: %v (left in place)", workDir, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *recorder) recoverInterruptedSegment(ctx context.Context, workDir string, logl *logex.Leveled) error {
+	lock, err := lockWorkDir(workDir, false)
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, errWorkDirLocked) { // not ours, or in use
+			return nil
+		}
+
+		return err
+	}
+	defer lock.Close()
+
+	if finished, err := r.finishStoringSegment(ctx, workDir, logl); err != nil || finished {
+		return err
+	}
+
+	manifestJson, err := os.ReadFile(filepath.Join(workDir, workDirManifestFile))
+	if err != nil {
+		if os.IsNotExist(err) { // crashed before recording anything, or the segment was stored already
+			return os.RemoveAll(workDir)
+		}
+
+		return err
+	}
+
+	manifest := segmentManifest{}
+	if err := json.Unmarshal(manifestJson, &manifest); err != nil {
+		return fmt.Errorf("%s: %w", workDirManifestFile, err)
+	}
+
+	frames, err := readFrameJournal(filepath.Join(workDir, workDirJournalFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", workDirJournalFile, err)
+	}
+
+	videoFile := filepath.Join(workDir, workDirVideoFile)
+
+	if videoInfo, err := os.Stat(videoFile); err != nil || videoInfo.Size() == 0 || len(frames) == 0 {
+		logl.Info.Printf("%s: nothing to recover", workDir)
+		return os.RemoveAll(workDir)
+	}
+
+	// a previous attempt might have left files of its own
+	salvageDir := filepath.Join(workDir, "salvage")
+	if err := os.RemoveAll(salvageDir); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(salvageDir, 0700); err != nil {
+		return err
+	}
+
+	// copying the streams leaves out whatever was cut off, and gives the video its index
+	salvagedVideoFile := filepath.Join(salvageDir, "salvaged-video.mkv")
+
+	remux := exec.CommandContext(ctx, "ffmpeg",
+		"-hide_banner",
+		"-loglevel", "error", // be less verbose
+		"-i", videoFile,
+		"-c", "copy",
+		salvagedVideoFile)
+	remux.Stdout = os.Stdout
+	remux.Stderr = os.Stderr
+	if err := remux.Run(); err != nil {
+		return fmt.Errorf("remux: %w", err)
+	}
+
+	videoFrameCount, err := probeVideoFrameCount(ctx, salvagedVideoFile)
+	if err != nil {
+		return err
+	}
+
+	// the video has a frame for each frame in the journal, up to where it was cut off
+	if videoFrameCount < len(frames) {
+		frames = frames[:videoFrameCount]
+	}
+
+	if len(frames) == 0 {
+		logl.Info.Printf("%s: nothing to recover", workDir)
+		return os.RemoveAll(workDir)
+	}
+
+	if err := r.storeSegment(ctx, workDir, manifest, salvagedVideoFile, frames, segmentTruncatedSalvaged); err != nil {
+		return err
+	}
+
+	logl.Info.Printf("recovered %d frame(s) of %s starting %s", len(frames), manifest.Screen, frames[0].Timestamp.Format(time.RFC3339))
+
+	return os.RemoveAll(workDir)
+}
+
+// if storing the work dir's segment was interrupted after it got to the output tree, indexes it
+// and adds it to the ledger (unless they already have it). returns false if the segment didn't get
+// to the output tree intact, in which case it's salvaged as usual.
+func (r *recorder) finishStoringSegment(ctx context.Context, workDir string, logl *logex.Leveled) (bool, error) {
+	storingJson, err := os.ReadFile(filepath.Join(workDir, workDirStoringFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	storing := storingSegment{}
+	if err := json.Unmarshal(storingJson, &storing); err != nil {
+		// written before the move and synced, so the move can't have happened
+		logl.Info.Printf("%s: %v (salvaging instead)", workDirStoringFile, err)
+		return false, nil
+	}
+
+	segment := storing.Segment
+
+	stored, err := segmentRecordWithFileInfo(segment, filepath.Join(r.conf.OutputDir, segment.Path))
+	if err != nil || stored.Sha256 != segment.Sha256 { // not moved (or not completely)
+		return false, nil
+	}
+
+	if err := r.index.AddSegment(ctx, segment, storing.Frames); err != nil { // replaces if it's there
+		return false, fmt.Errorf("index: %w", err)
+	}
+
+	if err := r.ledger.AddSegmentIfMissing(segment); err != nil {
+		return false, fmt.Errorf("ledger: %w", err)
+	}
+
+	logl.Info.Printf("finished storing %s", segment.Path)
+
+	return true, os.RemoveAll(workDir)
+}
+
+func probeVideoFrameCount(ctx context.Context, videoPath string) (int, error) {
+	output, err := exec.CommandContext(
+		ctx,
+		"ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-count_packets",
+		"-show_entries", "stream=nb_read_packets",
+		"-of", "csv=p=0",
+		videoPath,
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe: %w", err)
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe frame count: %w", err)
+	}
+
+	return count, nil
+}
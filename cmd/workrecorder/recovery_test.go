@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestFrameJournal(t *testing.T) {
+	journalPath := filepath.Join(t.TempDir(), workDirJournalFile)
+
+	journal, err := createFrameJournal(journalPath)
+	assert.Ok(t, err)
+
+	start := time.Date(2021, 6, 28, 12, 0, 0, 0, time.UTC)
+
+	assert.Ok(t, journal.Append(frameMetadata{
+		Timestamp:    start,
+		ActiveWindow: activeWindow{Title: "main.go - Visual Studio Code", Class: "Code"},
+		UserIdle:     3 * time.Second,
+	}))
+	assert.Ok(t, journal.Append(frameMetadata{
+		Timestamp: start.Add(5 * time.Second),
+		UserIdle:  userIdleUnknown,
+		Paused:    true,
+	}))
+	assert.Ok(t, journal.Close())
+
+	// crash while writing the third frame
+	file, err := os.OpenFile(journalPath, os.O_APPEND|os.O_WRONLY, 0)
+	assert.Ok(t, err)
+	_, err = file.WriteString(`{"Timestamp":"2021-06-28T12:00:1`)
+	assert.Ok(t, err)
+	assert.Ok(t, file.Close())
+
+	frames, err := readFrameJournal(journalPath)
+	assert.Ok(t, err)
+
+	assert.EqualInt(t, len(frames), 2)
+	assert.EqualString(t, frames[0].ActiveWindow.Class, "Code")
+	assert.Assert(t, frames[0].UserIdle == 3*time.Second)
+	assert.Assert(t, frames[1].Paused)
+	assert.Assert(t, frames[1].Timestamp.Equal(start.Add(5*time.Second)))
+}
+
+func TestWorkDirLock(t *testing.T) {
+	workDir, unlock, err := createWorkDir(t.TempDir(), segmentManifest{Screen: "DP-1", Interval: 5 * time.Second, Fps: 2, Codec: "hevc"})
+	assert.Ok(t, err)
+
+	// recovery leaves work dirs of a running recorder alone
+	_, err = lockWorkDir(workDir, false)
+	assert.Assert(t, err == errWorkDirLocked)
+
+	unlock()
+
+	lock, err := lockWorkDir(workDir, false)
+	assert.Ok(t, err)
+	assert.Ok(t, lock.Close())
+}
+
+func TestFinishStoringSegment(t *testing.T) {
+	conf := defaultConfig()
+	conf.OutputDir = t.TempDir()
+
+	index, err := openSegmentIndex(filepath.Join(t.TempDir(), "index.db"), true)
+	assert.Ok(t, err)
+	defer index.Close()
+
+	rec := &recorder{conf: conf, index: index, ledger: newSegmentLedger(conf.OutputDir)}
+
+	start := time.Date(2021, 6, 28, 12, 0, 0, 0, time.UTC)
+	path := segmentPath(conf.OutputDir, "DP-1", start, false)
+	assert.Ok(t, os.MkdirAll(filepath.Dir(path), 0700))
+	assert.Ok(t, os.WriteFile(path, []byte("video"), 0600))
+
+	segment, err := segmentRecordWithFileInfo(segmentRecord{
+		Screen:     "DP-1",
+		Path:       segmentPathRelative(conf.OutputDir, path),
+		Start:      start,
+		End:        start.Add(5 * time.Second),
+		FrameCount: 1,
+		Tier:       segmentTierOriginal,
+	}, path)
+	assert.Ok(t, err)
+
+	// interrupted after the move (twice, the second time after the ledger was written)
+	finish := func(segment segmentRecord) bool {
+		workDir := t.TempDir()
+		assert.Ok(t, writeStoringSegment(workDir, storingSegment{
+			Segment: segment,
+			Frames:  []frameMetadata{{Timestamp: start, UserIdle: userIdleUnknown}},
+		}))
+
+		finished, err := rec.finishStoringSegment(context.Background(), workDir, logex.Levels(logex.Discard))
+		assert.Ok(t, err)
+
+		return finished
+	}
+
+	assert.Assert(t, finish(segment))
+	assert.Assert(t, finish(segment))
+
+	lines, err := rec.ledger.Lines("DP-1")
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(lines), 1)
+
+	indexed, err := index.Segments(context.Background(), "DP-1", start, start.Add(time.Hour))
+	assert.Ok(t, err)
+	assert.EqualInt(t, indexed[segment.Path].FrameCount, 1)
+
+	// interrupted before the move completed => salvaged as usual
+	segment.Sha256 = "0000"
+	assert.Assert(t, !finish(segment))
+}
@@ -0,0 +1,193 @@
+package main
+
+// Redaction of sensitive windows (password managers, banking, private chats) from the screenshots
+// before they're encoded, so they never end up in the recordings.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgbutil"
+	"github.com/BurntSushi/xgbutil/ewmh"
+	"github.com/BurntSushi/xgbutil/xwindow"
+)
+
+const (
+	redactModeBlack    = "black"
+	redactModePixelate = "pixelate"
+)
+
+// large enough that text can't be made out
+const redactPixelateBlockSize = 24
+
+// replaces the title of a redacted active window in captions and the index
+const redactedTitle = "[redacted]"
+
+var redactModes = []string{redactModeBlack, redactModePixelate}
+
+type redactionRule struct {
+	Field   string // "class" | "title"
+	Pattern *regexp.Regexp
+}
+
+// "class=^KeePassXC$" | "title=(?i)bank"
+func parseRedactionRule(serialized string) (*redactionRule, error) {
+	field, pattern, found := strings.Cut(serialized, "=")
+	if !found || (field != "class" && field != "title") {
+		return nil, fmt.Errorf("redaction rule must be class=<regex> or title=<regex>; got %s", serialized)
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("redaction rule %s: %w", serialized, err)
+	}
+
+	return &redactionRule{Field: field, Pattern: compiled}, nil
+}
+
+func (r redactionRule) Matches(window activeWindow) bool {
+	if r.Field == "class" {
+		return r.Pattern.MatchString(window.Class)
+	}
+
+	return r.Pattern.MatchString(window.Title)
+}
+
+type redactor struct {
+	rules []redactionRule
+	mode  string
+}
+
+// nil if there are no rules
+func newRedactor(rules []string, mode string) (*redactor, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	parsed := []redactionRule{}
+	for _, rule := range rules {
+		rule, err := parseRedactionRule(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed = append(parsed, *rule)
+	}
+
+	return &redactor{rules: parsed, mode: mode}, nil
+}
+
+func (r *redactor) Matches(window activeWindow) bool {
+	for _, rule := range r.rules {
+		if rule.Matches(window) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// on-screen rectangles (in root window coordinates, including decorations) of visible windows
+// that match the rules
+func (r *redactor) MatchingWindowRects(xutil *xgbutil.XUtil) ([]image.Rectangle, error) {
+	windows, err := ewmh.ClientListStackingGet(xutil)
+	if err != nil { // no EWMH-compliant window manager. top-level windows then.
+		tree, errTree := xproto.QueryTree(xutil.Conn(), xutil.RootWin()).Reply()
+		if errTree != nil {
+			return nil, fmt.Errorf("_NET_CLIENT_LIST_STACKING: %v; QueryTree: %w", err, errTree)
+		}
+
+		windows = tree.Children
+	}
+
+	rects := []image.Rectangle{}
+
+	for _, win := range windows {
+		if !r.Matches(getWindowInfo(xutil, win)) {
+			continue
+		}
+
+		attributes, err := xproto.GetWindowAttributes(xutil.Conn(), win).Reply()
+		if err != nil { // window went away
+			continue
+		}
+
+		if attributes.MapState != xproto.MapStateViewable { // minimized or on another desktop
+			continue
+		}
+
+		geometry, err := xwindow.New(xutil, win).DecorGeometry()
+		if err != nil {
+			continue
+		}
+
+		rects = append(rects, image.Rect(
+			geometry.X(),
+			geometry.Y(),
+			geometry.X()+geometry.Width(),
+			geometry.Y()+geometry.Height()))
+	}
+
+	return rects, nil
+}
+
+// redacts the parts of "windowRects" (root window coordinates) that are visible in "screenshot"
+// which is of "outputRect" of the root window. returns how many windows were redacted.
+func (r *redactor) Redact(screenshot draw.Image, outputRect image.Rectangle, windowRects []image.Rectangle) int {
+	redacted := 0
+
+	for _, windowRect := range windowRects {
+		visible := windowRect.Intersect(outputRect)
+		if visible.Empty() { // on another screen
+			continue
+		}
+
+		// to screenshot's coordinates
+		rect := visible.Sub(outputRect.Min).Add(screenshot.Bounds().Min)
+
+		switch r.mode {
+		case redactModePixelate:
+			pixelate(screenshot, rect, redactPixelateBlockSize)
+		default:
+			draw.Draw(screenshot, rect, image.NewUniform(color.Black), image.Point{}, draw.Src)
+		}
+
+		redacted++
+	}
+
+	return redacted
+}
+
+// replaces each block with its average color
+func pixelate(img draw.Image, rect image.Rectangle, blockSize int) {
+	for blockY := rect.Min.Y; blockY < rect.Max.Y; blockY += blockSize {
+		for blockX := rect.Min.X; blockX < rect.Max.X; blockX += blockSize {
+			block := image.Rect(blockX, blockY, blockX+blockSize, blockY+blockSize).Intersect(rect)
+
+			var sumR, sumG, sumB, count uint64
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				for x := block.Min.X; x < block.Max.X; x++ {
+					r, g, b, _ := img.At(x, y).RGBA()
+					sumR += uint64(r)
+					sumG += uint64(g)
+					sumB += uint64(b)
+					count++
+				}
+			}
+
+			average := color.RGBA64{
+				R: uint16(sumR / count),
+				G: uint16(sumG / count),
+				B: uint16(sumB / count),
+				A: 0xffff,
+			}
+
+			draw.Draw(img, block, image.NewUniform(average), image.Point{}, draw.Src)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestRedactionRules(t *testing.T) {
+	redactor, err := newRedactor([]string{"class=^KeePassXC$", "title=(?i)bank"}, redactModeBlack)
+	assert.Ok(t, err)
+
+	assert.Assert(t, redactor.Matches(activeWindow{Class: "KeePassXC", Title: "Passwords.kdbx"}))
+	assert.Assert(t, redactor.Matches(activeWindow{Class: "Firefox", Title: "Online Banking - Mozilla Firefox"}))
+	assert.Assert(t, !redactor.Matches(activeWindow{Class: "Firefox", Title: "GitHub - Mozilla Firefox"}))
+
+	_, err = newRedactor([]string{"role=browser"}, redactModeBlack)
+	assert.EqualString(t, err.Error(), "redaction rule must be class=<regex> or title=<regex>; got role=browser")
+
+	noRedactor, err := newRedactor(nil, redactModeBlack)
+	assert.Ok(t, err)
+	assert.Assert(t, noRedactor == nil)
+}
+
+func TestRedact(t *testing.T) {
+	// screenshot of the right-hand screen of two side-by-side 100x50 screens
+	outputRect := image.Rect(100, 0, 200, 50)
+
+	white := func() *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+		for y := 0; y < 50; y++ {
+			for x := 0; x < 100; x++ {
+				img.Set(x, y, color.White)
+			}
+		}
+		return img
+	}
+
+	blackRedactor := &redactor{mode: redactModeBlack}
+
+	screenshot := white()
+	assert.EqualInt(t, blackRedactor.Redact(screenshot, outputRect, []image.Rectangle{
+		image.Rect(80, 10, 120, 20), // straddles both screens
+		image.Rect(0, 0, 50, 50),    // only on the left screen
+	}), 1)
+
+	isBlack := func(x, y int) bool {
+		return screenshot.RGBAAt(x, y) == color.RGBA{A: 0xff}
+	}
+
+	assert.Assert(t, isBlack(0, 10))
+	assert.Assert(t, isBlack(19, 19))
+	assert.Assert(t, !isBlack(20, 19))
+	assert.Assert(t, !isBlack(0, 20))
+	assert.Assert(t, !isBlack(50, 30))
+
+	// pixelation averages each block
+	screenshot = white()
+	for x := 0; x < 24; x++ {
+		screenshot.Set(x, 0, color.Black) // one of the block's 24 rows
+	}
+
+	pixelateRedactor := &redactor{mode: redactModePixelate}
+	assert.EqualInt(t, pixelateRedactor.Redact(screenshot, outputRect, []image.Rectangle{image.Rect(100, 0, 148, 24)}), 1)
+
+	assert.Assert(t, screenshot.RGBAAt(0, 0) == screenshot.RGBAAt(23, 23))
+	assert.EqualInt(t, int(screenshot.RGBAAt(0, 0).R), 245) // 23/24 white
+	assert.EqualInt(t, int(screenshot.RGBAAt(24, 0).R), 255)
+	assert.EqualInt(t, int(screenshot.RGBAAt(0, 24).R), 255) // outside the window
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/os/osutil"
+	"github.com/spf13/cobra"
+)
+
+func reindexEntrypoint() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "reindex",
+		Short: "Rebuilds the index database from the recorded videos",
+		Args:  cobra.NoArgs,
+	}
+
+	resolveConfig := registerConfigFlags(cmd.Flags())
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		rootLogger := logex.StandardLogger()
+
+		osutil.ExitIfError(func() error {
+			conf, err := resolveConfig()
+			if err != nil {
+				return err
+			}
+
+			return reindex(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				*conf,
+				logex.Levels(rootLogger))
+		}())
+	}
+
+	return cmd
+}
+
+// frames' user idle times and redaction counts can't be recovered, since they're only stored in the index
+func reindex(ctx context.Context, conf Config, logl *logex.Leveled) error {
+	segments, err := listSegments(conf.OutputDir)
+	if err != nil {
+		return err
+	}
+
+	index, err := openSegmentIndex(indexPath(conf.OutputDir), conf.IndexWindows)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	if err := index.Clear(ctx); err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		if err := reindexSegment(ctx, segment, conf, index); err != nil {
+			return fmt.Errorf("%s: %w", segment.Path, err)
+		}
+	}
+
+	logl.Info.Printf("reindexed %d segment(s)", len(segments))
+
+	return nil
+}
+
+func reindexSegment(ctx context.Context, segment segmentFile, conf Config, index *segmentIndex) error {
+	plaintextPath, cleanup, err := plaintextSegment(conf, segment)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	codec, err := probeVideoCodec(ctx, plaintextPath)
+	if err != nil {
+		return err
+	}
+
+	tier, err := probeSegmentTier(ctx, plaintextPath)
+	if err != nil {
+		return err
+	}
+
+	truncated, err := probeFormatTag(ctx, plaintextPath, segmentTruncatedMetadataKey)
+	if err != nil {
+		return err
+	}
+
+	timeTrack, err := extractSubtitleTrack(ctx, plaintextPath, 0)
+	if err != nil {
+		return fmt.Errorf("time subtitles: %w", err)
+	}
+
+	// older recordings don't have this track
+	windowTrack, err := extractSubtitleTrack(ctx, plaintextPath, 1)
+	if err != nil {
+		windowTrack = nil
+	}
+
+	frames, err := framesFromSubtitles(segment.Start, timeTrack, windowTrack)
+	if err != nil {
+		return err
+	}
+
+	end := segment.Start
+	if len(frames) > 0 {
+		end = frames[len(frames)-1].Timestamp.Add(conf.FrameInterval)
+	}
+
+	record, err := segmentRecordWithFileInfo(segmentRecord{
+		Screen:     segment.Screen,
+		Path:       segmentPathRelative(conf.OutputDir, segment.Path),
+		Start:      segment.Start,
+		End:        end,
+		FrameCount: len(frames),
+		Codec:      codec,
+		Tier:       tier,
+		Truncated:  truncated,
+	}, segment.Path)
+	if err != nil {
+		return err
+	}
+
+	return index.AddSegment(ctx, record, frames)
+}
+
+// the time track has one caption per frame, since each frame has a different timestamp
+func framesFromSubtitles(segmentStart time.Time, timeTrack []srtItem, windowTrack []srtItem) ([]frameMetadata, error) {
+	windowCaptionAt := func(offset time.Duration) string {
+		for _, item := range windowTrack {
+			if offset >= item.Start && offset < item.End {
+				return item.Caption
+			}
+		}
+
+		return ""
+	}
+
+	frames := []frameMetadata{}
+
+	for _, item := range timeTrack {
+		// captions only have time-of-day, date comes from the segment (segments don't span midnight, see below for the exception)
+		timeOfDay, err := time.Parse("15:04:05", item.Caption)
+		if err != nil {
+			return nil, err
+		}
+
+		window := activeWindow{}
+		paused := false
+		switch caption := windowCaptionAt(item.Start); caption {
+		case pausedCaption:
+			paused = true
+		case "":
+		default:
+			window = parseActiveWindowCaption(caption)
+		}
+
+		timestamp := time.Date(
+			segmentStart.Year(),
+			segmentStart.Month(),
+			segmentStart.Day(),
+			timeOfDay.Hour(),
+			timeOfDay.Minute(),
+			timeOfDay.Second(),
+			0,
+			segmentStart.Location())
+
+		// the captions are in the segment's starting UTC offset. in a time-lapse of the day DST
+		// ended the last hour's captions are past midnight in that offset.
+		if len(frames) > 0 && timestamp.Before(frames[len(frames)-1].Timestamp) {
+			timestamp = timestamp.AddDate(0, 0, 1)
+		}
+
+		frames = append(frames, frameMetadata{
+			Timestamp:    timestamp,
+			ActiveWindow: window,
+			UserIdle:     userIdleUnknown,
+			Paused:       paused,
+		})
+	}
+
+	return frames, nil
+}
+
+func probeVideoCodec(ctx context.Context, videoPath string) (string, error) {
+	output, err := exec.CommandContext(
+		ctx,
+		"ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=codec_name",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		videoPath,
+	).Output()
+	if err != nil {
+		return "", fmt.Errorf("ffprobe: %w", err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+func extractSubtitleTrack(ctx context.Context, videoPath string, trackIdx int) ([]srtItem, error) {
+	output, err := exec.CommandContext(
+		ctx,
+		"ffmpeg",
+		"-hide_banner",
+		"-loglevel", "error", // be less verbose
+		"-i", videoPath,
+		"-map", fmt.Sprintf("0:s:%d", trackIdx),
+		"-f", "srt",
+		"-",
+	).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w", err)
+	}
+
+	return parseSrt(string(output))
+}
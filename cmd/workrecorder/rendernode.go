@@ -0,0 +1,159 @@
+package main
+
+// Render nodes are the DRM devices (/dev/dri/renderD*) that allow unprivileged GPU access.
+// /dev/dri also contains "card*" nodes, which we don't want. Hybrid-graphics laptops have
+// multiple render nodes, so we need a way to choose between them.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/function61/gokit/log/logex"
+)
+
+const (
+	renderNodesDir = "/dev/dri"
+	drmSysfsDir    = "/sys/class/drm"
+)
+
+type renderNode struct {
+	Path   string // looks like "/dev/dri/renderD128"
+	Vendor string // PCI vendor ID (like "0x1002"). empty if unknown
+	Driver string // kernel driver (like "amdgpu"). empty if unknown
+}
+
+func (r renderNode) String() string {
+	return fmt.Sprintf("%s (vendor=%s driver=%s)", r.Path, orUnknown(r.Vendor), orUnknown(r.Driver))
+}
+
+// "amd" is easier to remember than "0x1002"
+var pciVendorAliases = map[string]string{
+	"amd":    "0x1002",
+	"intel":  "0x8086",
+	"nvidia": "0x10de",
+}
+
+// matches either PCI vendor ID (or its alias) or driver name
+func (r renderNode) Matches(vendorOrDriver string) bool {
+	vendorOrDriver = strings.ToLower(vendorOrDriver)
+
+	if vendorID, isAlias := pciVendorAliases[vendorOrDriver]; isAlias {
+		vendorOrDriver = vendorID
+	}
+
+	return (r.Vendor != "" && r.Vendor == vendorOrDriver) || (r.Driver != "" && r.Driver == vendorOrDriver)
+}
+
+// resolves the render node to use. explicit path wins, otherwise we auto-discover.
+func resolveRenderNode(explicitPath string, match string, logl *logex.Leveled) (*renderNode, error) {
+	if explicitPath != "" {
+		if _, err := os.Stat(explicitPath); err != nil {
+			return nil, fmt.Errorf("render node: %w", err)
+		}
+
+		node := renderNodeWithSysfsInfo(explicitPath, drmSysfsDir)
+
+		logl.Info.Printf("using explicitly configured render node %s", node.String())
+
+		return &node, nil
+	}
+
+	candidates, err := discoverRenderNodes(renderNodesDir, drmSysfsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, candidate := range candidates {
+		logl.Debug.Printf("render node candidate: %s", candidate.String())
+	}
+
+	node, err := selectRenderNode(candidates, match)
+	if err != nil {
+		return nil, err
+	}
+
+	logl.Info.Printf("auto-discovered render node %s", node.String())
+
+	return node, nil
+}
+
+// in absence of a match, picks the first one
+func selectRenderNode(candidates []renderNode, match string) (*renderNode, error) {
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no render nodes found in %s", renderNodesDir)
+	}
+
+	if match == "" {
+		return &candidates[0], nil
+	}
+
+	for _, candidate := range candidates {
+		if candidate.Matches(match) {
+			candidate := candidate // pin
+			return &candidate, nil
+		}
+	}
+
+	return nil, fmt.Errorf("none of the %d render node(s) match vendor/driver '%s'", len(candidates), match)
+}
+
+// returns render nodes sorted by path
+func discoverRenderNodes(devDir string, sysDir string) ([]renderNode, error) {
+	entries, err := os.ReadDir(devDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no render nodes: %w", err)
+		}
+
+		return nil, err
+	}
+
+	nodes := []renderNode{}
+
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "renderD") { // skip "card0" etc.
+			continue
+		}
+
+		nodes = append(nodes, renderNodeWithSysfsInfo(filepath.Join(devDir, entry.Name()), sysDir))
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Path < nodes[j].Path })
+
+	return nodes, nil
+}
+
+// sysfs info is best-effort, since inside a container /sys might not be available
+func renderNodeWithSysfsInfo(path string, sysDir string) renderNode {
+	// "/sys/class/drm/renderD128/device"
+	deviceDir := filepath.Join(sysDir, filepath.Base(path), "device")
+
+	vendor := ""
+	if vendorID, err := os.ReadFile(filepath.Join(deviceDir, "vendor")); err == nil {
+		vendor = strings.ToLower(strings.TrimSpace(string(vendorID)))
+	}
+
+	driver := ""
+	// symlink to like "../../../../bus/pci/drivers/amdgpu"
+	if driverLink, err := os.Readlink(filepath.Join(deviceDir, "driver")); err == nil {
+		driver = filepath.Base(driverLink)
+	}
+
+	return renderNode{
+		Path:   path,
+		Vendor: vendor,
+		Driver: driver,
+	}
+}
+
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+
+	return value
+}
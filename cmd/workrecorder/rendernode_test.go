@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestDiscoverAndSelectRenderNode(t *testing.T) {
+	root := t.TempDir()
+	devDir := filepath.Join(root, "dev/dri")
+	sysDir := filepath.Join(root, "sys/class/drm")
+
+	fakeDevice := func(name string, vendor string, driver string) {
+		assert.Ok(t, os.MkdirAll(devDir, 0700))
+		assert.Ok(t, os.WriteFile(filepath.Join(devDir, name), nil, 0600))
+
+		if vendor == "" { // no sysfs info
+			return
+		}
+
+		deviceDir := filepath.Join(sysDir, name, "device")
+		assert.Ok(t, os.MkdirAll(deviceDir, 0700))
+		assert.Ok(t, os.WriteFile(filepath.Join(deviceDir, "vendor"), []byte(vendor+"\n"), 0600))
+		assert.Ok(t, os.Symlink("../../../bus/pci/drivers/"+driver, filepath.Join(deviceDir, "driver")))
+	}
+
+	fakeDevice("card0", "0x8086", "i915")
+	fakeDevice("card1", "0x1002", "amdgpu")
+	fakeDevice("renderD129", "0x1002", "amdgpu")
+	fakeDevice("renderD128", "0x8086", "i915")
+	fakeDevice("renderD130", "", "")
+
+	candidates, err := discoverRenderNodes(devDir, sysDir)
+	assert.Ok(t, err)
+
+	candidatesSerialized := []string{}
+	for _, candidate := range candidates {
+		candidatesSerialized = append(candidatesSerialized, strings.TrimPrefix(candidate.String(), devDir+"/"))
+	}
+
+	assert.EqualString(t, strings.Join(candidatesSerialized, "\n"), `renderD128 (vendor=0x8086 driver=i915)
+renderD129 (vendor=0x1002 driver=amdgpu)
+renderD130 (vendor=unknown driver=unknown)`)
+
+	selectedName := func(match string) string {
+		node, err := selectRenderNode(candidates, match)
+		if err != nil {
+			return err.Error()
+		}
+
+		return filepath.Base(node.Path)
+	}
+
+	assert.EqualString(t, selectedName(""), "renderD128")
+	assert.EqualString(t, selectedName("amdgpu"), "renderD129")
+	assert.EqualString(t, selectedName("AMD"), "renderD129")
+	assert.EqualString(t, selectedName("0x8086"), "renderD128")
+	assert.EqualString(t, selectedName("nvidia"), "none of the 3 render node(s) match vendor/driver 'nvidia'")
+}
@@ -0,0 +1,208 @@
+package main
+
+// Recording 24/7 fills disks, so we periodically prune the oldest segments according to the
+// retention rules (max age, max bytes per screen and a free space floor).
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"golang.org/x/sys/unix"
+)
+
+type retentionRules struct {
+	MaxAge            time.Duration // 0 = disabled
+	MaxBytesPerScreen int64         // 0 = disabled
+	MinFreeBytes      int64         // 0 = disabled
+}
+
+func (r retentionRules) Enabled() bool {
+	return r.MaxAge != 0 || r.MaxBytesPerScreen != 0 || r.MinFreeBytes != 0
+}
+
+func retentionRulesFromConfig(conf Config) retentionRules {
+	return retentionRules{
+		MaxAge:            conf.RetentionMaxAge,
+		MaxBytesPerScreen: conf.RetentionMaxBytesPerScreen,
+		MinFreeBytes:      conf.RetentionMinFreeBytes,
+	}
+}
+
+type segmentWithSize struct {
+	segmentFile
+	Size int64
+}
+
+type pruneDecision struct {
+	Segment segmentWithSize
+	Reason  string
+}
+
+// runs forever (until ctx canceled)
+func enforceRetentionContinuously(ctx context.Context, conf Config, index *segmentIndex, ledger *segmentLedger, logl *logex.Leveled) error {
+	rules := retentionRulesFromConfig(conf)
+
+	if !rules.Enabled() {
+		logl.Debug.Println("retention disabled")
+		<-ctx.Done()
+		return nil
+	}
+
+	for {
+		// a failed round must not stop the recording, which shares our task runner
+		if err := enforceRetention(ctx, conf, rules, index, ledger, logl); err != nil && ctx.Err() == nil {
+			logl.Error.Printf("enforcing retention failed, retrying in %s: %v", conf.RetentionCheckInterval, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(conf.RetentionCheckInterval):
+		}
+	}
+}
+
+func enforceRetention(ctx context.Context, conf Config, rules retentionRules, index *segmentIndex, ledger *segmentLedger, logl *logex.Leveled) error {
+	segmentFiles, err := listSegments(conf.OutputDir)
+	if err != nil {
+		return err
+	}
+
+	segments := []segmentWithSize{}
+	for _, segment := range segmentFiles {
+		stat, err := os.Stat(segment.Path)
+		if err != nil {
+			if !os.IsNotExist(err) { // compaction removes segments concurrently
+				logl.Error.Printf("%s: %v", segmentPathRelative(conf.OutputDir, segment.Path), err)
+			}
+			continue
+		}
+
+		segments = append(segments, segmentWithSize{segment, stat.Size()})
+	}
+
+	freeBytes, err := filesystemFreeBytes(conf.OutputDir)
+	if err != nil {
+		return err
+	}
+
+	for _, decision := range planPruning(segments, rules, time.Now(), freeBytes) {
+		relativePath := segmentPathRelative(conf.OutputDir, decision.Segment.Path)
+
+		if conf.RetentionDryRun {
+			logl.Info.Printf("would prune %s (%s) [dry run]", relativePath, decision.Reason)
+			continue
+		}
+
+		if err := pruneSegment(ctx, conf, decision, index, ledger); err != nil {
+			if os.IsNotExist(err) { // compaction got to it first, and recorded the removal itself
+				logl.Debug.Printf("%s already pruned", relativePath)
+				continue
+			}
+
+			// the others might still be prunable
+			logl.Error.Printf("pruning %s: %v", relativePath, err)
+			continue
+		}
+
+		logl.Info.Printf("pruned %s (%s)", relativePath, decision.Reason)
+	}
+
+	return nil
+}
+
+func pruneSegment(ctx context.Context, conf Config, decision pruneDecision, index *segmentIndex, ledger *segmentLedger) error {
+	relativePath := segmentPathRelative(conf.OutputDir, decision.Segment.Path)
+
+	if err := os.Remove(decision.Segment.Path); err != nil {
+		return err
+	}
+
+	// the day directory might now be empty. Remove() fails if it's not, which is what we want.
+	_ = os.Remove(filepath.Dir(decision.Segment.Path))
+
+	if err := index.RemoveSegment(ctx, relativePath); err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+
+	if err := ledger.RemoveSegment(decision.Segment.Screen, relativePath, "retention: "+decision.Reason); err != nil {
+		return fmt.Errorf("ledger: %w", err)
+	}
+
+	return nil
+}
+
+// decides which segments to prune, oldest first. "segments" must be sorted by screen and start time.
+func planPruning(segments []segmentWithSize, rules retentionRules, now time.Time, freeBytes int64) []pruneDecision {
+	decisions := []pruneDecision{}
+	pruned := map[string]bool{}
+
+	prune := func(segment segmentWithSize, reason string) {
+		if pruned[segment.Path] {
+			return
+		}
+
+		pruned[segment.Path] = true
+		freeBytes += segment.Size
+
+		decisions = append(decisions, pruneDecision{segment, reason})
+	}
+
+	if rules.MaxAge != 0 {
+		for _, segment := range segments {
+			if now.Sub(segment.Start) > rules.MaxAge {
+				prune(segment, fmt.Sprintf("older than %s", rules.MaxAge))
+			}
+		}
+	}
+
+	if rules.MaxBytesPerScreen != 0 {
+		bytesPerScreen := map[ScreenId]int64{}
+		for _, segment := range segments {
+			if !pruned[segment.Path] {
+				bytesPerScreen[segment.Screen] += segment.Size
+			}
+		}
+
+		for _, segment := range segments { // oldest first within each screen
+			if pruned[segment.Path] || bytesPerScreen[segment.Screen] <= rules.MaxBytesPerScreen {
+				continue
+			}
+
+			bytesPerScreen[segment.Screen] -= segment.Size
+
+			prune(segment, fmt.Sprintf("screen over %d bytes", rules.MaxBytesPerScreen))
+		}
+	}
+
+	if rules.MinFreeBytes != 0 && freeBytes < rules.MinFreeBytes {
+		oldestFirst := append([]segmentWithSize{}, segments...)
+		sort.SliceStable(oldestFirst, func(i, j int) bool {
+			return oldestFirst[i].Start.Before(oldestFirst[j].Start)
+		})
+
+		for _, segment := range oldestFirst {
+			if freeBytes >= rules.MinFreeBytes {
+				break
+			}
+
+			prune(segment, fmt.Sprintf("free space under %d bytes", rules.MinFreeBytes))
+		}
+	}
+
+	return decisions
+}
+
+func filesystemFreeBytes(path string) (int64, error) {
+	stat := unix.Statfs_t{}
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("statfs: %w", err)
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestPlanPruning(t *testing.T) {
+	now := time.Date(2021, 6, 28, 12, 0, 0, 0, time.UTC)
+
+	segment := func(screen ScreenId, hoursAgo int, size int64) segmentWithSize {
+		return segmentWithSize{
+			segmentFile: segmentFile{
+				Screen: screen,
+				Path:   fmt.Sprintf("%s/%dh", screen, hoursAgo),
+				Start:  now.Add(-time.Duration(hoursAgo) * time.Hour),
+			},
+			Size: size,
+		}
+	}
+
+	// sorted by screen and start time
+	segments := []segmentWithSize{
+		segment("DP-1", 50, 100),
+		segment("DP-1", 30, 100),
+		segment("DP-1", 10, 100),
+		segment("DP-1", 1, 100),
+		segment("HDMI-1", 40, 100),
+		segment("HDMI-1", 2, 100),
+	}
+
+	plan := func(rules retentionRules, freeBytes int64) string {
+		lines := []string{}
+		for _, decision := range planPruning(segments, rules, now, freeBytes) {
+			lines = append(lines, decision.Segment.Path+": "+decision.Reason)
+		}
+
+		return strings.Join(lines, "\n")
+	}
+
+	assert.EqualString(t, plan(retentionRules{}, 0), "")
+
+	assert.EqualString(t, plan(retentionRules{MaxAge: 36 * time.Hour}, 0), `DP-1/50h: older than 36h0m0s
+HDMI-1/40h: older than 36h0m0s`)
+
+	assert.EqualString(t, plan(retentionRules{MaxBytesPerScreen: 200}, 0), `DP-1/50h: screen over 200 bytes
+DP-1/30h: screen over 200 bytes`)
+
+	// age rule already freed 200 bytes, so floor needs 100 bytes more from the oldest remaining segment
+	assert.EqualString(t, plan(retentionRules{MaxAge: 36 * time.Hour, MinFreeBytes: 1000}, 700), `DP-1/50h: older than 36h0m0s
+HDMI-1/40h: older than 36h0m0s
+DP-1/30h: free space under 1000 bytes`)
+}
@@ -0,0 +1,169 @@
+package main
+
+// Recording a lock screen or a powered-off monitor is pure waste, so recording is paused while the
+// screensaver is on, the displays are off (DPMS) or a screen locker is up.
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/BurntSushi/xgb/dpms"
+	"github.com/BurntSushi/xgb/screensaver"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgbutil"
+	"github.com/function61/gokit/log/logex"
+)
+
+// reasons for the screens being inactive. also recorded as the reasons of the gaps in the index.
+const (
+	screenInactiveLocked      = "locked"
+	screenInactiveDisplayOff  = "display off"
+	screenInactiveScreensaver = "screensaver"
+)
+
+// short enough that hardly any frames of the lock screen end up in the recording
+const screenStateCheckInterval = time.Second
+
+type screenStateDetector struct {
+	xutil                *xgbutil.XUtil
+	dpmsAvailable        bool
+	screensaverAvailable bool
+	lockerClass          *regexp.Regexp // nil = don't look for a locker window
+}
+
+// "lockerClass" is a regex (empty = don't look for a locker window)
+func newScreenStateDetector(xutil *xgbutil.XUtil, screensaverAvailable bool, lockerClass string, logl *logex.Leveled) (*screenStateDetector, error) {
+	detector := &screenStateDetector{xutil: xutil, screensaverAvailable: screensaverAvailable}
+
+	if lockerClass != "" {
+		var err error
+		detector.lockerClass, err = regexp.Compile(lockerClass)
+		if err != nil {
+			return nil, fmt.Errorf("locker_window_class: %w", err)
+		}
+	}
+
+	// not all X servers have it (e.g. Xvfb without +extension DPMS)
+	if err := dpms.Init(xutil.Conn()); err != nil {
+		logl.Info.Printf("DPMS not available: %v", err)
+	} else {
+		detector.dpmsAvailable = true
+	}
+
+	return detector, nil
+}
+
+// why the screens aren't worth recording. empty if they are.
+func (d *screenStateDetector) InactiveReason() (string, error) {
+	if d.lockerClass != nil {
+		locked, err := d.lockerWindowVisible()
+		if err != nil {
+			return "", err
+		}
+
+		if locked {
+			return screenInactiveLocked, nil
+		}
+	}
+
+	if d.dpmsAvailable {
+		info, err := dpms.Info(d.xutil.Conn()).Reply()
+		if err != nil {
+			return "", fmt.Errorf("DPMS: %w", err)
+		}
+
+		// "State" = whether DPMS is enabled at all
+		if info.State && info.PowerLevel != dpms.DPMSModeOn {
+			return screenInactiveDisplayOff, nil
+		}
+	}
+
+	if !d.screensaverAvailable {
+		return "", nil
+	}
+
+	info, err := screensaver.QueryInfo(d.xutil.Conn(), xproto.Drawable(d.xutil.RootWin())).Reply()
+	if err != nil {
+		return "", fmt.Errorf("MIT-SCREEN-SAVER: %w", err)
+	}
+
+	if info.State == screensaver.StateOn || info.State == screensaver.StateCycle {
+		return screenInactiveScreensaver, nil
+	}
+
+	return "", nil
+}
+
+// lockers usually use override-redirect windows that the window manager doesn't know about, so we
+// look at all top-level windows instead of asking the window manager
+func (d *screenStateDetector) lockerWindowVisible() (bool, error) {
+	tree, err := xproto.QueryTree(d.xutil.Conn(), d.xutil.RootWin()).Reply()
+	if err != nil {
+		return false, fmt.Errorf("QueryTree: %w", err)
+	}
+
+	for _, win := range tree.Children {
+		if !d.lockerClass.MatchString(getWindowInfo(d.xutil, win).Class) {
+			continue
+		}
+
+		attributes, err := xproto.GetWindowAttributes(d.xutil.Conn(), win).Reply()
+		if err != nil { // window went away
+			continue
+		}
+
+		if attributes.MapState == xproto.MapStateViewable {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// keeps "control"'s auto-pause in sync with the screens' state
+func pauseWhileScreensInactive(
+	ctx context.Context,
+	detector *screenStateDetector,
+	control *recordingControl,
+	logl *logex.Leveled,
+) error {
+	current := ""
+	previousErr := ""
+
+	for {
+		reason, err := detector.InactiveReason()
+		if err != nil { // rather record too much than miss something
+			if err.Error() != previousErr { // not every second
+				logl.Error.Printf("screen state: %v", err)
+			}
+
+			previousErr = err.Error()
+			reason = ""
+		} else {
+			previousErr = ""
+		}
+
+		if reason != current {
+			switch {
+			case current == "":
+				logl.Info.Printf("screens inactive (%s), pausing", reason)
+			case reason == "":
+				logl.Info.Printf("screens active again (was %s), resuming", current)
+			default:
+				logl.Info.Printf("screens inactive (%s, was %s)", reason, current)
+			}
+
+			control.SetAutoPause(reason, time.Now().UTC())
+
+			current = reason
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(screenStateCheckInterval):
+		}
+	}
+}
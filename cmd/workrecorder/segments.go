@@ -0,0 +1,198 @@
+package main
+
+// Finished segments are stored as <output dir>/<screen>/<YYYY-MM-DD>/<HH-MM-SS>.mkv, the
+// timestamp being that of the segment's first frame. Encrypted segments have ".mkv.age" extension.
+//
+// The date and time are in the configured time zone. Unless that's UTC, the filename also has the
+// UTC offset (<HH-MM-SS>+0300.mkv), so the files can be placed in time without knowing the zone,
+// and the hour that repeats when DST ends doesn't produce clashing filenames.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	segmentDateLayout     = "2006-01-02"
+	segmentFilenameLayout = "15-04-05"
+	segmentOffsetLayout   = "-0700"
+	segmentExtension      = ".mkv"
+	encryptedExtension    = ".age"
+)
+
+// UTC offset of the segment's start ("+03:00"), which is also the offset of its time subtitles
+const segmentUtcOffsetMetadataKey = "WORKRECORDER_UTC_OFFSET"
+
+type segmentFile struct {
+	Screen    ScreenId
+	Path      string    // absolute
+	Start     time.Time // first frame's timestamp
+	Encrypted bool
+}
+
+// "/output/DP-1/2021-06-28/12-15-00.mkv" (or "12-15-00.mkv.age" if encrypted). the layout is in
+// "start"'s location.
+func segmentPath(outputDir string, screen ScreenId, start time.Time, encrypted bool) string {
+	filename := segmentTimeOfDay(start) + segmentExtension
+	if encrypted {
+		filename += encryptedExtension
+	}
+
+	return screen.ReadyPath(outputDir, filepath.Join(start.Format(segmentDateLayout), filename))
+}
+
+// "/output/DP-1/snapshots/2021-06-28/12-07-35.png" (or "12-07-35.png.age" if encrypted)
+func snapshotPath(outputDir string, screen ScreenId, at time.Time, encrypted bool) string {
+	filename := segmentTimeOfDay(at) + ".png"
+	if encrypted {
+		filename += encryptedExtension
+	}
+
+	return screen.ReadyPath(outputDir, filepath.Join("snapshots", at.Format(segmentDateLayout), filename))
+}
+
+// "WORKRECORDER_UTC_OFFSET=+03:00"
+func segmentUtcOffsetMetadata(start time.Time) string {
+	return segmentUtcOffsetMetadataKey + "=" + start.Format("-07:00")
+}
+
+// "12-15-00" (UTC) or "12-15-00+0300"
+func segmentTimeOfDay(ts time.Time) string {
+	if ts.Location() == time.UTC {
+		return ts.Format(segmentFilenameLayout)
+	}
+
+	return ts.Format(segmentFilenameLayout + segmentOffsetLayout)
+}
+
+// segment given on command line: path to the file, or relative to the output dir
+func resolveSegmentArg(outputDir string, arg string) string {
+	if _, err := os.Stat(arg); os.IsNotExist(err) && !filepath.IsAbs(arg) {
+		return filepath.Join(outputDir, arg)
+	}
+
+	if absolute, err := filepath.Abs(arg); err == nil {
+		return absolute
+	}
+
+	return arg
+}
+
+// returns segments sorted by screen and start time. files not matching the layout are ignored.
+func listSegments(outputDir string) ([]segmentFile, error) {
+	return globSegments(outputDir, filepath.Join(outputDir, "*", "*", "*"+segmentExtension+"*"))
+}
+
+// segments of a screen for a given day
+func listSegmentsOfDay(outputDir string, screen ScreenId, day time.Time) ([]segmentFile, error) {
+	return globSegments(outputDir, screen.ReadyPath(outputDir, filepath.Join(day.Format(segmentDateLayout), "*"+segmentExtension+"*")))
+}
+
+// screens that have recordings. dot-directories (like the control socket's temporary ones left
+// behind by a crash) aren't screens.
+func listScreens(outputDir string) ([]ScreenId, error) {
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	screens := []ScreenId{}
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			screens = append(screens, ScreenId(entry.Name()))
+		}
+	}
+
+	return screens, nil
+}
+
+func globSegments(outputDir string, pattern string) ([]segmentFile, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []segmentFile{}
+
+	for _, match := range matches {
+		segment, err := parseSegmentPath(outputDir, match)
+		if err != nil {
+			continue // not ours
+		}
+
+		segments = append(segments, *segment)
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].Screen != segments[j].Screen {
+			return segments[i].Screen < segments[j].Screen
+		}
+
+		return segments[i].Start.Before(segments[j].Start)
+	})
+
+	return segments, nil
+}
+
+func parseSegmentPath(outputDir string, path string) (*segmentFile, error) {
+	// "DP-1/2021-06-28/12-15-00.mkv"
+	parts := strings.Split(filepath.ToSlash(segmentPathRelative(outputDir, path)), "/")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("unexpected segment path: %s", path)
+	}
+
+	filename := parts[2]
+	encrypted := strings.HasSuffix(filename, encryptedExtension)
+
+	start, err := parseSegmentStart(parts[1], strings.TrimSuffix(filename, encryptedExtension))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected segment path: %s: %w", path, err)
+	}
+
+	return &segmentFile{
+		Screen:    ScreenId(parts[0]),
+		Path:      path,
+		Start:     start,
+		Encrypted: encrypted,
+	}, nil
+}
+
+// ("2021-06-28", "12-15-00+0300.mkv") => 2021-06-28T12:15:00+03:00. without an offset the time is UTC.
+func parseSegmentStart(day string, filename string) (time.Time, error) {
+	layout := segmentDateLayout + " " + segmentFilenameLayout
+	if len(strings.TrimSuffix(filename, segmentExtension)) > len(segmentFilenameLayout) {
+		layout += segmentOffsetLayout
+	}
+
+	return time.ParseInLocation(layout+segmentExtension, day+" "+filename, time.UTC)
+}
+
+// day folder of a segment path relative to the output dir ("DP-1/2021-06-28/12-15-00.mkv" => "2021-06-28")
+func segmentPathDay(relativePath string) string {
+	parts := strings.Split(filepath.ToSlash(relativePath), "/")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// midnight at the end of a segment's day, in the time zone it was recorded in. "relativePath" as in
+// segmentPathRelative().
+func segmentDayEnd(relativePath string) (time.Time, error) {
+	start, err := parseSegmentStart(segmentPathDay(relativePath), strings.TrimSuffix(filepath.Base(relativePath), encryptedExtension))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return nextMidnight(start), nil
+}
+
+// the midnight after "ts", in "ts"'s location
+func nextMidnight(ts time.Time) time.Time {
+	return time.Date(ts.Year(), ts.Month(), ts.Day()+1, 0, 0, 0, 0, ts.Location())
+}
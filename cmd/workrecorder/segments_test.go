@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestSegmentPath(t *testing.T) {
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	assert.Ok(t, err)
+
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	assert.Ok(t, err)
+
+	roundTrip := func(start time.Time, encrypted bool) string {
+		path := segmentPath("/output", "DP-1", start, encrypted)
+
+		segment, err := parseSegmentPath("/output", path)
+		assert.Ok(t, err)
+		assert.Assert(t, segment.Start.Equal(start))
+		assert.Assert(t, segment.Encrypted == encrypted)
+
+		return segmentPathRelative("/output", path)
+	}
+
+	start := time.Date(2021, 6, 28, 21, 15, 0, 0, time.UTC)
+
+	// UTC keeps the original layout
+	assert.EqualString(t, roundTrip(start, false), "DP-1/2021-06-28/21-15-00.mkv")
+	assert.EqualString(t, roundTrip(start.In(helsinki), false), "DP-1/2021-06-29/00-15-00+0300.mkv")
+	assert.EqualString(t, roundTrip(start.In(kolkata), true), "DP-1/2021-06-29/02-45-00+0530.mkv.age")
+
+	// the hour that repeats when DST ends
+	firstPass := time.Date(2021, 10, 31, 0, 15, 0, 0, time.UTC).In(helsinki)
+	assert.EqualString(t, roundTrip(firstPass, false), "DP-1/2021-10-31/03-15-00+0300.mkv")
+	assert.EqualString(t, roundTrip(firstPass.Add(time.Hour), false), "DP-1/2021-10-31/03-15-00+0200.mkv")
+
+	dayEnd, err := segmentDayEnd("DP-1/2021-06-29/00-15-00+0300.mkv")
+	assert.Ok(t, err)
+	assert.EqualString(t, dayEnd.UTC().Format(time.RFC3339), "2021-06-29T21:00:00Z")
+
+	_, err = parseSegmentPath("/output", "/output/DP-1/2021-06-28/notes.txt")
+	assert.Assert(t, err != nil)
+}
+
+func TestListScreens(t *testing.T) {
+	outputDir := t.TempDir()
+
+	assert.Ok(t, os.Mkdir(filepath.Join(outputDir, "DP-1"), 0700))
+	assert.Ok(t, os.Mkdir(filepath.Join(outputDir, "HDMI-1"), 0700))
+	assert.Ok(t, os.WriteFile(filepath.Join(outputDir, "index.db"), nil, 0600))
+	// left behind by a crash while the control socket was being created
+	assert.Ok(t, os.Mkdir(filepath.Join(outputDir, ".control-123456"), 0700))
+
+	screens, err := listScreens(outputDir)
+	assert.Ok(t, err)
+	assert.EqualString(t, fmt.Sprintf("%v", screens), "[DP-1 HDMI-1]")
+}
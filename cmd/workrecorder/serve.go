@@ -0,0 +1,563 @@
+package main
+
+// Local web UI for browsing recordings. Binds only to loopback, since the recordings are as
+// sensitive as it gets. For the same reason requests must be addressed to us by the Host header, so
+// a web page can't reach us through a domain of theirs that resolves to loopback (DNS rebinding).
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/os/osutil"
+	"github.com/spf13/cobra"
+)
+
+func serveEntrypoint() *cobra.Command {
+	addr := ""
+
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serves a web UI for browsing the recordings",
+		Args:  cobra.NoArgs,
+	}
+
+	resolveConfig := registerConfigFlags(cmd.Flags())
+
+	cmd.Flags().StringVar(&addr, "addr", "127.0.0.1:8080", "Address to listen on (must be loopback)")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		rootLogger := logex.StandardLogger()
+
+		osutil.ExitIfError(func() error {
+			conf, err := resolveConfig()
+			if err != nil {
+				return err
+			}
+
+			return serve(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				*conf,
+				addr,
+				rootLogger)
+		}())
+	}
+
+	return cmd
+}
+
+func serve(ctx context.Context, conf Config, addr string, logger *log.Logger) error {
+	logl := logex.Levels(logger)
+
+	if err := requireLoopbackAddr(addr); err != nil {
+		return err
+	}
+
+	// index is optional (only used for segment end times), as the directory layout is the source of truth
+	var index *segmentIndex
+	if exists, err := osutil.Exists(indexPath(conf.OutputDir)); err == nil && exists {
+		index, err = openSegmentIndex(indexPath(conf.OutputDir), conf.IndexWindows)
+		if err != nil {
+			return err
+		}
+		defer index.Close()
+	}
+
+	plaintexts := newPlaintextCache(conf, servePlaintextsCached)
+	defer plaintexts.Close()
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: requireLocalHost(addr, newBrowseHandler(conf, index, plaintexts, logl)),
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	logl.Info.Printf("listening on http://%s", addr)
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func newBrowseHandler(conf Config, index *segmentIndex, plaintexts *plaintextCache, logl *logex.Leveled) http.Handler {
+	mux := http.NewServeMux()
+
+	handleErrors := func(fn func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if err := fn(w, r); err != nil {
+				logl.Error.Printf("%s: %v", r.URL.Path, err)
+
+				if errors.Is(err, os.ErrNotExist) {
+					http.NotFound(w, r)
+				} else {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+			}
+		}
+	}
+
+	mux.HandleFunc("/", handleErrors(func(w http.ResponseWriter, r *http.Request) error {
+		if r.URL.Path != "/" {
+			return os.ErrNotExist
+		}
+
+		screens, err := listScreens(conf.OutputDir)
+		if err != nil {
+			return err
+		}
+
+		type screenWithDays struct {
+			Screen ScreenId
+			Days   []string
+		}
+
+		screensWithDays := []screenWithDays{}
+		for _, screen := range screens {
+			days, err := listDays(conf.OutputDir, screen)
+			if err != nil {
+				return err
+			}
+
+			screensWithDays = append(screensWithDays, screenWithDays{screen, days})
+		}
+
+		return browseTemplates.ExecuteTemplate(w, "screens", screensWithDays)
+	}))
+
+	// "/day/DP-1/2021-06-28"
+	mux.HandleFunc("/day/", handleErrors(func(w http.ResponseWriter, r *http.Request) error {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/day/"), "/")
+		if len(parts) != 2 || !validPathComponent(parts[0]) {
+			return os.ErrNotExist
+		}
+
+		day, err := time.ParseInLocation(segmentDateLayout, parts[1], conf.Location())
+		if err != nil {
+			return os.ErrNotExist
+		}
+
+		timeline, err := makeDayTimeline(r.Context(), conf, index, ScreenId(parts[0]), day)
+		if err != nil {
+			return err
+		}
+
+		return browseTemplates.ExecuteTemplate(w, "day", timeline)
+	}))
+
+	// "/video/DP-1/2021-06-28/12-15-00.mkv"
+	mux.HandleFunc("/video/", handleErrors(func(w http.ResponseWriter, r *http.Request) error {
+		segment, err := segmentFromUrlPath(conf, strings.TrimPrefix(r.URL.Path, "/video/"))
+		if err != nil {
+			return err
+		}
+
+		plaintextPath, release, err := plaintexts.Get(*segment)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		file, err := os.Open(plaintextPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		stat, err := file.Stat()
+		if err != nil {
+			return err
+		}
+
+		w.Header().Set("Content-Type", "video/x-matroska")
+
+		// handles range requests so the browser can seek
+		http.ServeContent(w, r, "", stat.ModTime(), file)
+		return nil
+	}))
+
+	// "/thumbnail/DP-1/2021-06-28/12-15-00.mkv?at=<Unix seconds>"
+	mux.HandleFunc("/thumbnail/", handleErrors(func(w http.ResponseWriter, r *http.Request) error {
+		segment, err := segmentFromUrlPath(conf, strings.TrimPrefix(r.URL.Path, "/thumbnail/"))
+		if err != nil {
+			return err
+		}
+
+		atUnix, err := strconv.ParseInt(r.URL.Query().Get("at"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad 'at'", http.StatusBadRequest)
+			return nil
+		}
+
+		frameTimestamps := []time.Time{}
+		if index != nil {
+			frames, err := index.SegmentFrames(r.Context(), segmentPathRelative(conf.OutputDir, segment.Path))
+			if err != nil {
+				return err
+			}
+
+			for _, frame := range frames {
+				frameTimestamps = append(frameTimestamps, frame.Timestamp)
+			}
+		}
+
+		plaintextPath, release, err := plaintexts.Get(*segment)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		thumbnail, err := makeThumbnail(r.Context(), plaintextPath, videoOffsetOf(conf, segment.Start, frameTimestamps, time.Unix(atUnix, 0)))
+		if err != nil {
+			return err
+		}
+
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "max-age=86400") // segments don't change
+		_, err = w.Write(thumbnail)
+		return err
+	}))
+
+	return mux
+}
+
+type timelineBlock struct {
+	Start    time.Time
+	End      time.Time
+	LeftPct  float64 // position in the day
+	WidthPct float64
+	Url      string // "DP-1/2021-06-28/12-15-00.mkv" (only for segments)
+	// average time between frames (only for segments). compacted segments have sparser frames.
+	IntervalSeconds float64
+}
+
+type dayTimeline struct {
+	Screen   ScreenId
+	Day      string
+	Segments []timelineBlock
+	Gaps     []timelineBlock
+	Fps      int
+}
+
+func makeDayTimeline(ctx context.Context, conf Config, index *segmentIndex, screen ScreenId, day time.Time) (*dayTimeline, error) {
+	segments, err := listSegmentsOfDay(conf.OutputDir, screen, day)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(segments) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	indexed := map[string]segmentRecord{}
+	if index != nil {
+		indexed, err = index.Segments(ctx, screen, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dayLength := nextMidnight(day).Sub(day) // 23 or 25 hours on DST transition days
+
+	block := func(start time.Time, end time.Time) timelineBlock {
+		return timelineBlock{
+			Start:    start.In(day.Location()),
+			End:      end.In(day.Location()),
+			LeftPct:  100 * float64(start.Sub(day)) / float64(dayLength),
+			WidthPct: 100 * float64(end.Sub(start)) / float64(dayLength),
+		}
+	}
+
+	timeline := &dayTimeline{
+		Screen:   screen,
+		Day:      day.Format(segmentDateLayout),
+		Segments: []timelineBlock{},
+		Gaps:     []timelineBlock{},
+		Fps:      conf.Fps,
+	}
+
+	for _, segment := range segments {
+		relativePath := segmentPathRelative(conf.OutputDir, segment.Path)
+
+		end := timeFloorMinutesAddNPeriod(segment.Start, conf.SegmentMinutes, 1) // not indexed => assume it lasted the whole period
+		interval := conf.FrameInterval
+		if record, found := indexed[relativePath]; found {
+			end = record.End
+
+			if record.FrameCount > 0 {
+				interval = record.End.Sub(record.Start) / time.Duration(record.FrameCount)
+			}
+		}
+
+		if len(timeline.Segments) > 0 {
+			previousEnd := timeline.Segments[len(timeline.Segments)-1].End
+
+			if segment.Start.Sub(previousEnd) >= conf.FrameInterval {
+				timeline.Gaps = append(timeline.Gaps, block(previousEnd, segment.Start))
+			}
+		}
+
+		segmentBlock := block(segment.Start, end)
+		segmentBlock.Url = relativePath
+		segmentBlock.IntervalSeconds = interval.Seconds()
+
+		timeline.Segments = append(timeline.Segments, segmentBlock)
+	}
+
+	return timeline, nil
+}
+
+// wall clock time => offset in the video. "frameTimestamps" (from the index) are needed for
+// compacted segments whose frames are sparser. without them we assume frames are frame interval apart.
+func videoOffsetOf(conf Config, segmentStart time.Time, frameTimestamps []time.Time, at time.Time) time.Duration {
+	frameIdx := int(at.Sub(segmentStart) / conf.FrameInterval)
+	if len(frameTimestamps) > 0 {
+		frameIdx = nearestTickIndex(frameTimestamps, at)
+	}
+	if frameIdx < 0 {
+		frameIdx = 0
+	}
+
+	// middle of the frame's display time so we're not at the mercy of rounding
+	return (time.Second*time.Duration(frameIdx) + time.Second/2) / time.Duration(conf.Fps)
+}
+
+func makeThumbnail(ctx context.Context, videoPath string, offset time.Duration) ([]byte, error) {
+	thumbnail, err := exec.CommandContext(
+		ctx,
+		"ffmpeg",
+		"-hide_banner",
+		"-loglevel", "error", // be less verbose
+		"-ss", fmt.Sprintf("%.3f", offset.Seconds()),
+		"-i", videoPath,
+		"-frames:v", "1",
+		"-vf", "scale=320:-2",
+		"-f", "image2pipe",
+		"-c:v", "mjpeg",
+		"-",
+	).Output()
+	if err != nil {
+		return nil, fmt.Errorf("makeThumbnail: %w", err)
+	}
+
+	return thumbnail, nil
+}
+
+// "DP-1/2021-06-28/12-15-00.mkv" => segment (after validating there's no path traversal)
+func segmentFromUrlPath(conf Config, urlPath string) (*segmentFile, error) {
+	parts := strings.Split(urlPath, "/")
+	if len(parts) != 3 {
+		return nil, os.ErrNotExist
+	}
+
+	for _, part := range parts {
+		if !validPathComponent(part) {
+			return nil, os.ErrNotExist
+		}
+	}
+
+	segment, err := parseSegmentPath(conf.OutputDir, ScreenId(parts[0]).ReadyPath(conf.OutputDir, path.Join(parts[1], parts[2])))
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	return segment, nil
+}
+
+func validPathComponent(component string) bool {
+	return component != "" && component != "." && component != ".." && !strings.ContainsAny(component, `/\`)
+}
+
+// newest first
+func listDays(outputDir string, screen ScreenId) ([]string, error) {
+	entries, err := os.ReadDir(screen.ReadyPath(outputDir, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	days := []string{}
+	for _, entry := range entries {
+		if _, err := time.Parse(segmentDateLayout, entry.Name()); err == nil && entry.IsDir() {
+			days = append(days, entry.Name())
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(days)))
+
+	return days, nil
+}
+
+// rejects requests whose Host isn't our listen address, localhost or a loopback IP
+func requireLocalHost(addr string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLocalHost(addr, r.Host) {
+			http.Error(w, "bad Host header", http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func isLocalHost(addr string, requestHost string) bool {
+	listenHost, listenPort, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	host, port, err := net.SplitHostPort(requestHost)
+	if err != nil { // no port (= the scheme's default)
+		host, port = strings.TrimSuffix(strings.TrimPrefix(requestHost, "["), "]"), "80"
+	}
+
+	if port != listenPort {
+		return false
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+
+	return host == listenHost || strings.EqualFold(host, "localhost")
+}
+
+func requireLoopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("refusing to listen on non-loopback address: %s", addr)
+	}
+
+	return nil
+}
+
+var browseTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"hms": func(ts time.Time) string { return ts.Format("15:04:05") },
+}).Parse(`
+{{define "header"}}<!doctype html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Workrecorder</title>
+	<style>
+		body { font-family: sans-serif; margin: 2em; }
+		.timeline { position: relative; height: 40px; background: #eee; margin: 1em 0; }
+		.timeline .segment { position: absolute; top: 0; height: 100%; background: #4a8; cursor: pointer; }
+		.timeline .gap { position: absolute; top: 0; height: 100%; background: #d44; }
+		#thumbnail { position: fixed; pointer-events: none; display: none; border: 1px solid #000; }
+		video { max-width: 100%; }
+	</style>
+</head>
+<body>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "screens"}}{{template "header"}}
+	<h1>Workrecorder</h1>
+
+	{{range .}}
+	<h2>{{.Screen}}</h2>
+	<ul>
+		{{$screen := .Screen}}
+		{{range .Days}}<li><a href="/day/{{$screen}}/{{.}}">{{.}}</a></li>{{end}}
+	</ul>
+	{{else}}
+	<p>No recordings.</p>
+	{{end}}
+{{template "footer"}}{{end}}
+
+{{define "day"}}{{template "header"}}
+	<h1><a href="/">Workrecorder</a> / {{.Screen}} / {{.Day}}</h1>
+
+	<div class="timeline" data-fps="{{.Fps}}">
+		{{range .Segments}}
+		<div class="segment"
+			style="left: {{.LeftPct}}%; width: {{.WidthPct}}%"
+			data-url="{{.Url}}"
+			data-start="{{.Start.Unix}}"
+			data-end="{{.End.Unix}}"
+			data-interval="{{.IntervalSeconds}}"
+			title="{{hms .Start}} - {{hms .End}}"></div>
+		{{end}}
+		{{range .Gaps}}
+		<div class="gap" style="left: {{.LeftPct}}%; width: {{.WidthPct}}%" title="Gap {{hms .Start}} - {{hms .End}}"></div>
+		{{end}}
+	</div>
+
+	<img id="thumbnail" />
+
+	<video id="player" controls></video>
+
+	{{if .Gaps}}
+	<h2>Gaps</h2>
+	<ul>
+		{{range .Gaps}}<li>{{hms .Start}} - {{hms .End}}</li>{{end}}
+	</ul>
+	{{end}}
+
+	<script>
+	const timeline = document.querySelector('.timeline');
+	const fps = parseFloat(timeline.dataset.fps);
+	const thumbnail = document.getElementById('thumbnail');
+	const player = document.getElementById('player');
+
+	// mouse position => wall clock time (Unix seconds)
+	function timeAt(segment, ev) {
+		const rect = segment.getBoundingClientRect();
+		const start = parseInt(segment.dataset.start, 10);
+		const end = parseInt(segment.dataset.end, 10);
+		return Math.floor(start + (end - start) * (ev.clientX - rect.left) / rect.width);
+	}
+
+	document.querySelectorAll('.segment').forEach((segment) => {
+		segment.addEventListener('mousemove', (ev) => {
+			thumbnail.src = '/thumbnail/' + segment.dataset.url + '?at=' + timeAt(segment, ev);
+			thumbnail.style.left = ev.clientX + 'px';
+			thumbnail.style.top = (ev.clientY + 20) + 'px';
+			thumbnail.style.display = 'block';
+		});
+		segment.addEventListener('mouseleave', () => { thumbnail.style.display = 'none'; });
+		segment.addEventListener('click', (ev) => {
+			const framesIn = Math.floor((timeAt(segment, ev) - parseInt(segment.dataset.start, 10)) / parseFloat(segment.dataset.interval));
+			const src = '/video/' + segment.dataset.url;
+			if (player.getAttribute('src') !== src) {
+				player.src = src;
+			}
+			player.currentTime = framesIn / fps;
+			player.play();
+		});
+	});
+	</script>
+{{template "footer"}}{{end}}
+`))
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestIsLocalHost(t *testing.T) {
+	for _, tc := range []struct {
+		addr        string
+		requestHost string
+		expected    bool
+	}{
+		{"127.0.0.1:8080", "127.0.0.1:8080", true},
+		{"127.0.0.1:8080", "localhost:8080", true},
+		{"127.0.0.1:8080", "LOCALHOST:8080", true},
+		{"127.0.0.1:8080", "[::1]:8080", true},
+		{"localhost:8080", "localhost:8080", true},
+		{"127.0.0.1:80", "localhost", true},
+		{"127.0.0.1:8080", "localhost", false},
+		{"127.0.0.1:8080", "localhost:8081", false},
+		// DNS rebinding
+		{"127.0.0.1:8080", "evil.example.com:8080", false},
+		{"127.0.0.1:8080", "localhost.evil.example.com:8080", false},
+		{"127.0.0.1:8080", "192.168.1.2:8080", false},
+		{"127.0.0.1:8080", "", false},
+	} {
+		// the host in there to tell which failed
+		assert.EqualString(t, fmt.Sprintf("%s %v", tc.requestHost, isLocalHost(tc.addr, tc.requestHost)), fmt.Sprintf("%s %v", tc.requestHost, tc.expected))
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+// Shutting down mid-segment doesn't throw the segment away: capturing stops right away, but FFmpeg
+// gets to finalize what it has, and the segment is stored like any other (marked as truncated).
+
+import (
+	"context"
+	"time"
+)
+
+// how long a segment in progress gets to be finalized and stored after shutdown is requested
+const segmentFinalizeTimeout = 30 * time.Second
+
+// why a segment ended early. stored in the index, the ledger and the video's tags.
+const (
+	segmentTruncatedShutdown = "shutdown" // the recorder was shut down
+	segmentTruncatedSalvaged = "salvaged" // salvaged after a crash or a failure
+)
+
+const segmentTruncatedMetadataKey = "WORKRECORDER_TRUNCATED"
+
+// cancelled "grace" after "parent" is, so work can be wrapped up in an orderly manner
+func contextWithGracePeriod(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+
+	go func() {
+		select {
+		case <-parent.Done():
+			select {
+			case <-time.After(grace):
+				cancel()
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
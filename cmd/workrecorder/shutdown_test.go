@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestContextWithGracePeriod(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+
+	ctx, cancel := contextWithGracePeriod(parent, 50*time.Millisecond)
+	defer cancel()
+
+	cancelParent()
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Assert(t, ctx.Err() == nil)
+
+	<-ctx.Done() // would hang if not cancelled after the grace period
+
+	assert.Assert(t, ctx.Err() == context.Canceled)
+}
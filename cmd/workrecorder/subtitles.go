@@ -1,37 +1,75 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"path/filepath"
+	"os"
+	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/function61/gokit/os/osutil"
 )
 
-func makeSubtitles(fps int, timestamps []time.Time, dir string) (string, error) {
+// one caption per frame
+func makeSubtitles(fps int, frameCaptions []string, subtitlesPath string) error {
 	srt := newSrtSubs()
 	frame, last := srt.FrameChangeCaptioner(fps)
-	defer last()
 
-	for _, ts := range timestamps {
-		frame(ts.Format("15:04:05"))
+	for _, caption := range frameCaptions {
+		frame(caption)
 	}
 
 	last()
 
-	subtitlesPath := filepath.Join(dir, "subtitles.srt")
-
-	if err := ioutil.WriteFile(
+	return ioutil.WriteFile(
 		subtitlesPath,
 		[]byte(srt.Serialize()),
-		osutil.FileMode(osutil.OwnerRW, osutil.GroupNone, osutil.OtherNone),
-	); err != nil {
-		return "", err
+		osutil.FileMode(osutil.OwnerRW, osutil.GroupNone, osutil.OtherNone))
+}
+
+type subtitleTrack struct {
+	Title string
+	Path  string // .srt file
+}
+
+// adds subtitle tracks to an existing video without re-encoding the video
+// "metadata" has "key=value" items to tag the output with
+func muxSubtitles(ctx context.Context, videoPath string, tracks []subtitleTrack, metadata []string, outputPath string) error {
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error", // be less verbose
+		"-i", videoPath,
+	}
+
+	for _, track := range tracks {
+		args = append(args, "-i", track.Path)
+	}
+
+	args = append(args, "-map", "0")
+
+	for idx, track := range tracks {
+		args = append(args,
+			"-map", strconv.Itoa(idx+1),
+			fmt.Sprintf("-metadata:s:s:%d", idx), "title="+track.Title)
+	}
+
+	for _, item := range metadata {
+		args = append(args, "-metadata", item)
 	}
 
-	return subtitlesPath, nil
+	args = append(args,
+		"-c", "copy",
+		outputPath)
+
+	ffmpeg := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	ffmpeg.Stdout = os.Stdout
+	ffmpeg.Stderr = os.Stderr
+
+	return ffmpeg.Run()
 }
 
 type srtSubs struct {
@@ -120,9 +158,69 @@ func durationToSexagesimal(dur time.Duration) string {
 
 	// 00:00:00,498
 	return fmt.Sprintf(
-		"%.2d:%.2d:%.2d,%d",
+		"%.2d:%.2d:%.2d,%.3d",
 		bareHours,
 		bareMinutes,
 		bareSeconds,
 		int(dur.Milliseconds()))
 }
+
+type srtItem struct {
+	Start   time.Duration
+	End     time.Duration
+	Caption string
+}
+
+// parses what srtSubs.Serialize() produces
+func parseSrt(content string) ([]srtItem, error) {
+	items := []srtItem{}
+
+	// items are separated by empty line
+	for _, block := range strings.Split(strings.ReplaceAll(strings.TrimSpace(content), "\r\n", "\n"), "\n\n") {
+		if block == "" { // no items
+			continue
+		}
+
+		// "1", "00:00:00,498 --> 00:00:02,827", "caption line 1", ...
+		lines := strings.Split(block, "\n")
+		if len(lines) < 3 {
+			return nil, fmt.Errorf("parseSrt: malformed item: %s", block)
+		}
+
+		startStr, endStr, found := strings.Cut(lines[1], " --> ")
+		if !found {
+			return nil, fmt.Errorf("parseSrt: malformed timing: %s", lines[1])
+		}
+
+		start, err := sexagesimalToDuration(startStr)
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := sexagesimalToDuration(endStr)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, srtItem{
+			Start:   start,
+			End:     end,
+			Caption: strings.Join(lines[2:], "\n"),
+		})
+	}
+
+	return items, nil
+}
+
+// "00:00:02,827" => 2.827s
+func sexagesimalToDuration(serialized string) (time.Duration, error) {
+	var hours, minutes, seconds, millis int
+	if _, err := fmt.Sscanf(serialized, "%d:%d:%d,%d", &hours, &minutes, &seconds, &millis); err != nil {
+		return 0, fmt.Errorf("sexagesimalToDuration: %s: %w", serialized, err)
+	}
+
+	return time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute +
+		time.Duration(seconds)*time.Second +
+		time.Duration(millis)*time.Millisecond, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestSrtRoundtrip(t *testing.T) {
+	srt := newSrtSubs()
+	frame, last := srt.FrameChangeCaptioner(30)
+	frame("Firefox: GitHub")
+	frame("Firefox: GitHub")
+	frame("Code: main.go")
+	last()
+
+	serialized := srt.Serialize()
+
+	assert.EqualString(t, serialized, `1
+00:00:00,000 --> 00:00:00,066
+Firefox: GitHub
+
+2
+00:00:00,066 --> 00:00:00,100
+Code: main.go
+`)
+
+	items, err := parseSrt(serialized)
+	assert.Ok(t, err)
+
+	assert.EqualInt(t, len(items), 2)
+	assert.EqualString(t, items[1].Caption, "Code: main.go")
+	assert.Assert(t, items[1].Start == 66*time.Millisecond)
+	assert.Assert(t, items[1].End == 100*time.Millisecond)
+}
@@ -0,0 +1,86 @@
+package main
+
+// A screen's recording failing (FFmpeg exiting, GetImage failing, disk errors, ...) shouldn't take
+// the other screens down with it. Failed segments are salvaged and retried with a backoff, and only
+// a screen that keeps failing for long enough stops the whole process (so that it gets noticed, and
+// restarted by systemd).
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	recordingRetryMinBackoff = 2 * time.Second
+	recordingRetryMaxBackoff = 5 * time.Minute
+
+	// a screen is given up on after this many failures in a row, if they've kept on for this long
+	// (so a quick burst of failures doesn't count as persistent)
+	recordingGiveUpFailures = 8
+	recordingGiveUpAfter    = 30 * time.Minute
+)
+
+const gapReasonFailing = "failing"
+
+// errors that retrying won't fix
+func isFatalRecordingError(err error) bool {
+	switch {
+	case errors.Is(err, exec.ErrNotFound): // FFmpeg not installed
+		return true
+	case errors.Is(err, os.ErrPermission):
+		return true
+	case errors.Is(err, unix.EROFS):
+		return true
+	default: // worth retrying, e.g. FFmpeg crashing, X errors or disk full (retention frees space)
+		return false
+	}
+}
+
+// consecutive failures of a screen's recording
+type recordingFailures struct {
+	count        int
+	firstFailure time.Time // of the current streak
+}
+
+// returns how long to wait before retrying, or an error if it's time to give up
+func (f *recordingFailures) Failed(err error, now time.Time) (time.Duration, error) {
+	if isFatalRecordingError(err) {
+		return 0, err
+	}
+
+	if f.count == 0 {
+		f.firstFailure = now
+	}
+
+	f.count++
+
+	if f.count >= recordingGiveUpFailures && now.Sub(f.firstFailure) >= recordingGiveUpAfter {
+		return 0, fmt.Errorf("giving up after %d failures in a row since %s: %w", f.count, f.firstFailure.Format(time.RFC3339), err)
+	}
+
+	backoff := recordingRetryMinBackoff
+	for i := 1; i < f.count && backoff < recordingRetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > recordingRetryMaxBackoff {
+		backoff = recordingRetryMaxBackoff
+	}
+
+	return backoff, nil
+}
+
+func (f *recordingFailures) Succeeded() {
+	f.count = 0
+	f.firstFailure = time.Time{}
+}
+
+// how many failures in a row so far
+func (f *recordingFailures) Count() int {
+	return f.count
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestRecordingFailures(t *testing.T) {
+	failures := recordingFailures{}
+
+	now := time.Date(2021, 6, 28, 12, 0, 0, 0, time.UTC)
+	errFfmpeg := errors.New("exit status 1")
+
+	backoffs := []string{}
+	for i := 0; i < 10; i++ {
+		backoff, err := failures.Failed(errFfmpeg, now)
+		assert.Ok(t, err)
+
+		backoffs = append(backoffs, backoff.String())
+	}
+
+	assert.EqualString(t, strings.Join(backoffs, " "), "2s 4s 8s 16s 32s 1m4s 2m8s 4m16s 5m0s 5m0s")
+
+	// many failures, but not for long enough
+	_, err := failures.Failed(errFfmpeg, now.Add(29*time.Minute))
+	assert.Ok(t, err)
+
+	_, err = failures.Failed(errFfmpeg, now.Add(30*time.Minute))
+	assert.EqualString(t, err.Error(), "giving up after 12 failures in a row since 2021-06-28T12:00:00Z: exit status 1")
+
+	// a success starts over
+	failures.Succeeded()
+
+	backoff, err := failures.Failed(errFfmpeg, now.Add(2*time.Hour))
+	assert.Ok(t, err)
+	assert.EqualString(t, backoff.String(), "2s")
+}
+
+func TestRecordingFailuresFatal(t *testing.T) {
+	failures := recordingFailures{}
+
+	_, err := failures.Failed(fmt.Errorf("start: %w", exec.ErrNotFound), time.Now())
+	assert.Assert(t, errors.Is(err, exec.ErrNotFound))
+
+	assert.Assert(t, isFatalRecordingError(&os.PathError{Op: "open", Path: "/output/DP-1", Err: unix.EACCES}))
+	assert.Assert(t, isFatalRecordingError(&os.PathError{Op: "open", Path: "/output/DP-1", Err: unix.EROFS}))
+	assert.Assert(t, !isFatalRecordingError(&os.PathError{Op: "write", Path: "/output/DP-1", Err: unix.ENOSPC}))
+
+	assert.Assert(t, !isFatalRecordingError(errors.New("signal: killed")))
+}
@@ -29,28 +29,22 @@ func timeFloorMinutes(t time.Time, minutes int) time.Time {
 	return timeFloorMinutesAddNPeriod(t, minutes, 0)
 }
 
+// aligns to the wall clock of "t"'s location, so with a +05:30 zone the periods start at :00 local
+// time and not at :30. the arithmetic is done on absolute time instead of rebuilding a wall clock
+// time with time.Date(), which around DST transitions would be ambiguous (the hour repeated in the
+// autumn) or not exist (the hour skipped in the spring). the periods are then always "minutes"
+// long and the next one starts where the previous ended.
 func timeFloorMinutesAddNPeriod(t time.Time, minutes int, n int) time.Time {
-	return time.Date(
-		t.Year(),
-		t.Month(),
-		t.Day(),
-		t.Hour(),
-		t.Minute()/minutes*minutes+n*minutes,
-		0,
-		0,
-		time.UTC)
+	sinceFloor := time.Duration(t.Minute()%minutes)*time.Minute +
+		time.Duration(t.Second())*time.Second +
+		time.Duration(t.Nanosecond())
+
+	// without the monotonic reading, like time.Date() would give
+	return t.Round(0).Add(-sinceFloor + time.Duration(n*minutes)*time.Minute)
 }
 
 func floorSecond(input time.Time) time.Time {
-	return time.Date(
-		input.Year(),
-		input.Month(),
-		input.Day(),
-		input.Hour(),
-		input.Minute(),
-		input.Second(),
-		0,
-		input.Location())
+	return input.Round(0).Add(-time.Duration(input.Nanosecond()))
 }
 
 // timestamps >= perspective
@@ -68,3 +68,77 @@ func TestFlooring(t *testing.T) {
 	assert.EqualString(t, str(timeFloorMinutesAddNPeriod(t13(24), 5, 1)), "13:25")
 	assert.EqualString(t, str(timeFloorMinutesAddNPeriod(t13(25), 5, 1)), "13:30")
 }
+
+func TestFlooringNonHourAlignedOffset(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata") // +05:30
+	assert.Ok(t, err)
+
+	str := func(t time.Time) string {
+		return t.Format("15:04 -07:00")
+	}
+
+	now := time.Date(2021, 6, 28, 12, 44, 10, 0, kolkata)
+
+	assert.EqualString(t, str(timeFloorMinutes(now, 15)), "12:30 +05:30")
+	assert.EqualString(t, str(timeFloorMinutes(now, 60)), "12:00 +05:30")
+	assert.EqualString(t, str(timeFloorMinutesAddNPeriod(now, 60, 1)), "13:00 +05:30")
+	assert.EqualString(t, timeFloorMinutes(now, 60).UTC().Format("15:04"), "06:30")
+
+	// midnight is a period boundary in local time
+	assert.EqualString(t, timeFloorMinutesAddNPeriod(time.Date(2021, 6, 28, 23, 59, 59, 0, kolkata), 15, 1).Format("2006-01-02 15:04"), "2021-06-29 00:00")
+}
+
+func TestFlooringAcrossDstTransitions(t *testing.T) {
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	assert.Ok(t, err)
+
+	str := func(t time.Time) string {
+		return t.Format("15:04:05 -07:00")
+	}
+
+	// spring: 03:00 +02:00 => 04:00 +03:00
+	springLastPeriod := time.Date(2021, 3, 28, 0, 50, 0, 0, time.UTC).In(helsinki)
+	assert.EqualString(t, str(springLastPeriod), "02:50:00 +02:00")
+	assert.EqualString(t, str(timeFloorMinutes(springLastPeriod, 15)), "02:45:00 +02:00")
+	assert.EqualString(t, str(timeFloorMinutesAddNPeriod(springLastPeriod, 15, 1)), "04:00:00 +03:00")
+	assert.EqualString(t, str(timeFloorMinutes(springLastPeriod.Add(15*time.Minute), 15)), "04:00:00 +03:00")
+
+	// autumn: 04:00 +03:00 => 03:00 +02:00, so 03:00-04:00 happens twice
+	firstPass := time.Date(2021, 10, 31, 0, 10, 0, 0, time.UTC).In(helsinki)
+	secondPass := firstPass.Add(time.Hour)
+	assert.EqualString(t, str(firstPass), "03:10:00 +03:00")
+	assert.EqualString(t, str(secondPass), "03:10:00 +02:00")
+
+	assert.EqualString(t, str(timeFloorMinutes(firstPass, 15)), "03:00:00 +03:00")
+	assert.EqualString(t, str(timeFloorMinutes(secondPass, 15)), "03:00:00 +02:00")
+	assert.EqualString(t, str(timeFloorMinutesAddNPeriod(firstPass.Add(45*time.Minute), 15, 1)), "03:00:00 +02:00")
+
+	// the floor is never after the input and the period is always the same length, even with
+	// hour-long segments
+	for _, now := range []time.Time{springLastPeriod, firstPass, secondPass} {
+		for _, minutes := range []int{1, 5, 15, 60} {
+			floor := timeFloorMinutes(now, minutes)
+
+			assert.Assert(t, !floor.After(now))
+			assert.EqualString(t, timeFloorMinutesAddNPeriod(now, minutes, 1).Sub(floor).String(), (time.Duration(minutes) * time.Minute).String())
+		}
+	}
+}
+
+func TestTicksBetweenAcrossDst(t *testing.T) {
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	assert.Ok(t, err)
+
+	// the second 03:55 of the autumn night. the ticks can't go back to the first one.
+	now := time.Date(2021, 10, 31, 1, 55, 0, 0, time.UTC).In(helsinki)
+
+	items := []string{""}
+	for _, tick := range ticksBetween(now, 15, 2*time.Minute) {
+		items = append(items, tick.Format("15:04:05 -07:00"))
+	}
+
+	assert.EqualString(t, strings.Join(items, "\n"), `
+03:55:00 +02:00
+03:57:00 +02:00
+03:59:00 +02:00`)
+}
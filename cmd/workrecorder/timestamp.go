@@ -0,0 +1,564 @@
+package main
+
+// Trusted timestamps (RFC 3161) for the daily digests. A signature proves what we claim, a
+// timestamp from a third party proves that the digest existed at a given time (= we didn't make it
+// up later). The timestamped message is the digest's signed message, so the token covers the root.
+//
+// The token is a CMS (RFC 5652) SignedData over a TSTInfo structure. We only need a small subset of
+// CMS, so it's parsed here instead of pulling in a dependency.
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	_ "crypto/sha512" // for crypto.SHA384 and SHA512
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+)
+
+var (
+	oidSha256                  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSha384                  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSha512                  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidCmsSignedData           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidCmsContentTypeTSTInfo   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidCmsAttributeContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidCmsAttributeDigest      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidEssSigningCertificate   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 12}
+	oidEssSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+)
+
+const (
+	timestampStatusGranted         = 0
+	timestampStatusGrantedWithMods = 1
+)
+
+// how soon to retry if the timestamp authority failed
+const timestampRetryInterval = time.Hour
+
+type timestampMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timestampRequest struct {
+	Version        int
+	MessageImprint timestampMessageImprint
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional"`
+}
+
+type timestampResponse struct {
+	Status         timestampStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type timestampStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type timestampTSTInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint timestampMessageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time         `asn1:"generalized"`
+	Accuracy       timestampAccuracy `asn1:"optional"`
+	Ordering       bool              `asn1:"optional"`
+	Nonce          *big.Int          `asn1:"optional"`
+	TSA            asn1.RawValue     `asn1:"optional,explicit,tag:0"`
+	Extensions     asn1.RawValue     `asn1:"optional,tag:1"`
+}
+
+type timestampAccuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapsulatedContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsEncapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue // IssuerAndSerialNumber or [0] SubjectKeyIdentifier
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsIssuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue // SET of values
+}
+
+// ESS signed attributes (RFC 2634 and RFC 5035) that bind the signer's certificate to the signature,
+// so it can't be swapped for another certificate with the same key. the first cert ID is the signer's.
+type essSigningCertificate struct {
+	Certs    []essCertId
+	Policies asn1.RawValue `asn1:"optional"`
+}
+
+type essCertId struct {
+	CertHash     []byte        // SHA-1 of the certificate
+	IssuerSerial asn1.RawValue `asn1:"optional"`
+}
+
+type essSigningCertificateV2 struct {
+	Certs    []essCertIdV2
+	Policies asn1.RawValue `asn1:"optional"`
+}
+
+type essCertIdV2 struct {
+	HashAlgorithm pkix.AlgorithmIdentifier `asn1:"optional"` // absent = SHA-256
+	CertHash      []byte
+	IssuerSerial  asn1.RawValue `asn1:"optional"`
+}
+
+// what we learned from a valid token
+type timestampInfo struct {
+	Time  time.Time
+	TSA   string // subject of the TSA's certificate
+	Nonce *big.Int
+}
+
+// "<output dir>/<screen>/digests/<day>.tst" (DER-encoded TimeStampToken)
+func timestampTokenPath(outputDir string, screen ScreenId, day string) string {
+	return screen.ReadyPath(outputDir, filepath.Join("digests", day+".tst"))
+}
+
+// asks the timestamp authority for a token over "message". the token is checked before returning it.
+func requestTimestamp(ctx context.Context, tsaURL string, message []byte) ([]byte, *timestampInfo, error) {
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hash := sha256.Sum256(message)
+
+	request, err := asn1.Marshal(timestampRequest{
+		Version: 1,
+		MessageImprint: timestampMessageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSha256, Parameters: asn1.NullRawValue},
+			HashedMessage: hash[:],
+		},
+		Nonce:   nonce,
+		CertReq: true, // so the token is verifiable on its own
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, tsaURL, bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/timestamp-query")
+
+	httpResponse, err := http.DefaultClient.Do(httpRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s: HTTP %s", tsaURL, httpResponse.Status)
+	}
+
+	responseBytes, err := io.ReadAll(io.LimitReader(httpResponse.Body, 1024*1024))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response := timestampResponse{}
+	if _, err := asn1.Unmarshal(responseBytes, &response); err != nil {
+		return nil, nil, fmt.Errorf("%s: parsing response: %w", tsaURL, err)
+	}
+
+	if status := response.Status.Status; status != timestampStatusGranted && status != timestampStatusGrantedWithMods {
+		return nil, nil, fmt.Errorf("%s: request rejected with status %d %v", tsaURL, status, response.Status.StatusString)
+	}
+
+	token := response.TimeStampToken.FullBytes
+
+	info, err := verifyTimestampToken(token, message, nil) // chain is checked by verify (if configured)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", tsaURL, err)
+	}
+
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return nil, nil, fmt.Errorf("%s: nonce mismatch (replayed response?)", tsaURL)
+	}
+
+	return token, info, nil
+}
+
+// checks that the token is a TSA's valid signature over "message". if "roots" is given, the
+// TSA's certificate must chain up to them.
+func verifyTimestampToken(token []byte, message []byte, roots *x509.CertPool) (*timestampInfo, error) {
+	contentInfo := cmsContentInfo{}
+	if _, err := asn1.Unmarshal(token, &contentInfo); err != nil {
+		return nil, fmt.Errorf("timestamp token: %w", err)
+	}
+
+	if !contentInfo.ContentType.Equal(oidCmsSignedData) {
+		return nil, fmt.Errorf("timestamp token: unexpected content type %s", contentInfo.ContentType)
+	}
+
+	signedData := cmsSignedData{}
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil { // Bytes = inside the explicit tag
+		return nil, fmt.Errorf("timestamp token: %w", err)
+	}
+
+	if !signedData.EncapContentInfo.EContentType.Equal(oidCmsContentTypeTSTInfo) {
+		return nil, fmt.Errorf("timestamp token: unexpected encapsulated content type %s", signedData.EncapContentInfo.EContentType)
+	}
+
+	tstInfo := timestampTSTInfo{}
+	if _, err := asn1.Unmarshal(signedData.EncapContentInfo.EContent, &tstInfo); err != nil {
+		return nil, fmt.Errorf("timestamp token: TSTInfo: %w", err)
+	}
+
+	// the message imprint binds the token to our message
+	imprintHash, err := hashByOid(tstInfo.MessageImprint.HashAlgorithm.Algorithm)
+	if err != nil {
+		return nil, fmt.Errorf("timestamp token: message imprint: %w", err)
+	}
+
+	if !bytes.Equal(tstInfo.MessageImprint.HashedMessage, hashBytes(imprintHash, message)) {
+		return nil, errors.New("timestamp token: message imprint doesn't match (token is for something else)")
+	}
+
+	if len(signedData.SignerInfos) != 1 {
+		return nil, fmt.Errorf("timestamp token: expected one signer; got %d", len(signedData.SignerInfos))
+	}
+	signer := signedData.SignerInfos[0]
+
+	certificates, err := x509.ParseCertificates(signedData.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("timestamp token: certificates: %w", err)
+	}
+
+	signerCertificate, err := findCmsSignerCertificate(signer, certificates)
+	if err != nil {
+		return nil, fmt.Errorf("timestamp token: %w", err)
+	}
+
+	if err := verifyCmsSignerInfo(signer, signedData.EncapContentInfo.EContent, signerCertificate); err != nil {
+		return nil, fmt.Errorf("timestamp token: %w", err)
+	}
+
+	if !certificateHasExtKeyUsage(signerCertificate, x509.ExtKeyUsageTimeStamping) {
+		return nil, errors.New("timestamp token: signer's certificate isn't for timestamping")
+	}
+
+	if roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, certificate := range certificates {
+			intermediates.AddCert(certificate)
+		}
+
+		if _, err := signerCertificate.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   tstInfo.GenTime, // certificate had to be valid when the timestamp was made
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+		}); err != nil {
+			return nil, fmt.Errorf("timestamp token: TSA certificate: %w", err)
+		}
+	}
+
+	return &timestampInfo{
+		Time:  tstInfo.GenTime,
+		TSA:   signerCertificate.Subject.String(),
+		Nonce: tstInfo.Nonce,
+	}, nil
+}
+
+func findCmsSignerCertificate(signer cmsSignerInfo, certificates []*x509.Certificate) (*x509.Certificate, error) {
+	for _, certificate := range certificates {
+		switch {
+		case signer.SID.Class == asn1.ClassUniversal && signer.SID.Tag == asn1.TagSequence:
+			issuerAndSerial := cmsIssuerAndSerialNumber{}
+			if _, err := asn1.Unmarshal(signer.SID.FullBytes, &issuerAndSerial); err != nil {
+				return nil, fmt.Errorf("signer identifier: %w", err)
+			}
+
+			if bytes.Equal(certificate.RawIssuer, issuerAndSerial.Issuer.FullBytes) && certificate.SerialNumber.Cmp(issuerAndSerial.SerialNumber) == 0 {
+				return certificate, nil
+			}
+		case signer.SID.Class == asn1.ClassContextSpecific && signer.SID.Tag == 0: // subject key identifier
+			if bytes.Equal(certificate.SubjectKeyId, signer.SID.Bytes) {
+				return certificate, nil
+			}
+		}
+	}
+
+	return nil, errors.New("signer's certificate not included")
+}
+
+// the signature is over the signed attributes, which include the content's digest and (as RFC 3161
+// requires) the signer's certificate's hash
+func verifyCmsSignerInfo(signer cmsSignerInfo, content []byte, certificate *x509.Certificate) error {
+	if len(signer.SignedAttrs.FullBytes) == 0 {
+		return errors.New("no signed attributes")
+	}
+
+	digestHash, err := hashByOid(signer.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return fmt.Errorf("digest algorithm: %w", err)
+	}
+
+	// signature is over the DER encoding with the universal SET tag instead of the implicit [0]
+	signedAttrs := append([]byte{0x31}, signer.SignedAttrs.FullBytes[1:]...)
+
+	attributes := []cmsAttribute{}
+	if _, err := asn1.UnmarshalWithParams(signedAttrs, &attributes, "set"); err != nil {
+		return fmt.Errorf("signed attributes: %w", err)
+	}
+
+	contentTypeOk := false
+	digestOk := false
+	signingCertificateFound := false
+	signingCertificateOk := false
+	for _, attribute := range attributes {
+		switch {
+		case attribute.Type.Equal(oidCmsAttributeContentType):
+			contentType := asn1.ObjectIdentifier{}
+			if _, err := asn1.Unmarshal(attribute.Values.Bytes, &contentType); err != nil {
+				return fmt.Errorf("content type attribute: %w", err)
+			}
+
+			contentTypeOk = contentType.Equal(oidCmsContentTypeTSTInfo)
+		case attribute.Type.Equal(oidCmsAttributeDigest):
+			digest := []byte{}
+			if _, err := asn1.Unmarshal(attribute.Values.Bytes, &digest); err != nil {
+				return fmt.Errorf("message digest attribute: %w", err)
+			}
+
+			digestOk = bytes.Equal(digest, hashBytes(digestHash, content))
+		case attribute.Type.Equal(oidEssSigningCertificate):
+			signingCertificate := essSigningCertificate{}
+			if _, err := asn1.Unmarshal(attribute.Values.Bytes, &signingCertificate); err != nil {
+				return fmt.Errorf("signing certificate attribute: %w", err)
+			}
+
+			if len(signingCertificate.Certs) == 0 {
+				return errors.New("signing certificate attribute: no certificates")
+			}
+
+			certificateHash := sha1.Sum(certificate.Raw)
+
+			signingCertificateFound = true
+			signingCertificateOk = bytes.Equal(signingCertificate.Certs[0].CertHash, certificateHash[:])
+		case attribute.Type.Equal(oidEssSigningCertificateV2):
+			signingCertificate := essSigningCertificateV2{}
+			if _, err := asn1.Unmarshal(attribute.Values.Bytes, &signingCertificate); err != nil {
+				return fmt.Errorf("signing certificate v2 attribute: %w", err)
+			}
+
+			if len(signingCertificate.Certs) == 0 {
+				return errors.New("signing certificate v2 attribute: no certificates")
+			}
+
+			certificateHash := crypto.SHA256
+			if algorithm := signingCertificate.Certs[0].HashAlgorithm.Algorithm; len(algorithm) > 0 {
+				certificateHash, err = hashByOid(algorithm)
+				if err != nil {
+					return fmt.Errorf("signing certificate v2 attribute: %w", err)
+				}
+			}
+
+			signingCertificateFound = true
+			signingCertificateOk = bytes.Equal(signingCertificate.Certs[0].CertHash, hashBytes(certificateHash, certificate.Raw))
+		}
+	}
+
+	if !contentTypeOk || !digestOk {
+		return errors.New("signed attributes don't match the content")
+	}
+
+	if !signingCertificateFound {
+		return errors.New("no signing certificate attribute")
+	}
+
+	if !signingCertificateOk {
+		return errors.New("signing certificate attribute doesn't match the signer's certificate")
+	}
+
+	signatureAlgorithm, err := x509SignatureAlgorithm(certificate.PublicKey, digestHash)
+	if err != nil {
+		return err
+	}
+
+	if err := certificate.CheckSignature(signatureAlgorithm, signedAttrs, signer.Signature); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	return nil
+}
+
+// CMS names the digest and key algorithms separately, x509 wants them combined
+func x509SignatureAlgorithm(publicKey crypto.PublicKey, hash crypto.Hash) (x509.SignatureAlgorithm, error) {
+	byHash := func(sha256Algo, sha384Algo, sha512Algo x509.SignatureAlgorithm) (x509.SignatureAlgorithm, error) {
+		switch hash {
+		case crypto.SHA256:
+			return sha256Algo, nil
+		case crypto.SHA384:
+			return sha384Algo, nil
+		default:
+			return sha512Algo, nil
+		}
+	}
+
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		return byHash(x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA)
+	case *ecdsa.PublicKey:
+		return byHash(x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512)
+	case ed25519.PublicKey:
+		return x509.PureEd25519, nil
+	default:
+		return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signer key type %T", publicKey)
+	}
+}
+
+func hashByOid(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSha256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSha384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSha512):
+		return crypto.SHA512, nil
+	default:
+		return 0, fmt.Errorf("unsupported hash algorithm %s", oid)
+	}
+}
+
+func hashBytes(hash crypto.Hash, data []byte) []byte {
+	hasher := hash.New()
+	hasher.Write(data)
+	return hasher.Sum(nil)
+}
+
+func certificateHasExtKeyUsage(certificate *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, certificateUsage := range certificate.ExtKeyUsage {
+		if certificateUsage == usage {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nil if "path" is empty
+func loadTimestampRoots(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+
+	return roots, nil
+}
+
+// gets tokens for digests that don't have one. returns whether some are still pending (because
+// the timestamp authority failed).
+func timestampDailyDigests(ctx context.Context, conf Config, logl *logex.Leveled) (bool, error) {
+	screens, err := listScreens(conf.OutputDir)
+	if err != nil {
+		return false, err
+	}
+
+	pending := false
+
+	for _, screen := range screens {
+		digestPaths, err := filepath.Glob(digestPath(conf.OutputDir, screen, "*"))
+		if err != nil {
+			return false, err
+		}
+
+		for _, path := range digestPaths {
+			digest, err := readDailyDigest(path)
+			if err != nil {
+				return false, err
+			}
+
+			tokenPath := timestampTokenPath(conf.OutputDir, screen, digest.Day)
+
+			if _, err := os.Stat(tokenPath); err == nil || !os.IsNotExist(err) {
+				continue // already timestamped (or stat failed)
+			}
+
+			token, info, err := requestTimestamp(ctx, conf.TimestampURL, digest.SignedMessage())
+			if err != nil {
+				// not fatal. the TSA might be down, we'll retry later.
+				logl.Error.Printf("timestamping daily digest %s/%s: %v", screen, digest.Day, err)
+				pending = true
+				continue
+			}
+
+			if err := writeFileExclusive(tokenPath, token); err != nil {
+				return false, err
+			}
+
+			logl.Info.Printf("daily digest %s/%s timestamped at %s by %s", screen, digest.Day, info.Time.Format(time.RFC3339), info.TSA)
+		}
+	}
+
+	return pending, nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestTimestampToken(t *testing.T) {
+	tsa, tsaCA := startTestTimestampAuthority(t, time.Date(2021, 6, 29, 0, 5, 0, 0, time.UTC))
+
+	token, info, err := requestTimestamp(context.Background(), tsa.URL, []byte("hello"))
+	assert.Ok(t, err)
+	assert.EqualString(t, info.Time.Format(time.RFC3339), "2021-06-29T00:05:00Z")
+	assert.EqualString(t, info.TSA, "CN=Test TSA")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tsaCA)
+
+	_, err = verifyTimestampToken(token, []byte("hello"), roots)
+	assert.Ok(t, err)
+
+	_, err = verifyTimestampToken(token, []byte("hello!"), roots)
+	assert.EqualString(t, err.Error(), "timestamp token: message imprint doesn't match (token is for something else)")
+
+	// someone else's CA
+	_, otherCA := startTestTimestampAuthority(t, time.Now())
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(otherCA)
+
+	_, err = verifyTimestampToken(token, []byte("hello"), otherRoots)
+	assert.Assert(t, err != nil && strings.HasPrefix(err.Error(), "timestamp token: TSA certificate: x509: certificate signed by unknown authority"))
+
+	// flip a bit in the signature (which is at the end)
+	tampered := append([]byte{}, token...)
+	tampered[len(tampered)-1] ^= 0x01
+
+	_, err = verifyTimestampToken(tampered, []byte("hello"), roots)
+	assert.Assert(t, err != nil && strings.HasPrefix(err.Error(), "timestamp token: invalid signature"))
+}
+
+func TestTimestampTokenSigningCertificate(t *testing.T) {
+	now := time.Date(2021, 6, 29, 0, 5, 0, 0, time.UTC)
+
+	request := func(signingCertificate testTsaSigningCertificate) error {
+		tsa, _ := startTestTimestampAuthorityWith(t, now, signingCertificate)
+
+		_, _, err := requestTimestamp(context.Background(), tsa.URL, []byte("hello"))
+		return err
+	}
+
+	assert.Ok(t, request(testTsaSigningCertificateV2))
+	assert.Ok(t, request(testTsaSigningCertificateV1))
+
+	err := request(testTsaSigningCertificateNone)
+	assert.Assert(t, err != nil && strings.HasSuffix(err.Error(), ": timestamp token: no signing certificate attribute"))
+
+	// some other certificate than the one whose key made the signature
+	err = request(testTsaSigningCertificateOfCA)
+	assert.Assert(t, err != nil && strings.HasSuffix(err.Error(), ": timestamp token: signing certificate attribute doesn't match the signer's certificate"))
+}
+
+func TestTimestampDailyDigests(t *testing.T) {
+	tsa, tsaCA := startTestTimestampAuthority(t, time.Date(2021, 6, 29, 0, 5, 0, 0, time.UTC))
+
+	conf := defaultConfig()
+	conf.OutputDir = t.TempDir()
+	conf.TimestampURL = tsa.URL
+	conf.TimestampCAFile = filepath.Join(t.TempDir(), "tsa-ca.pem")
+
+	assert.Ok(t, os.WriteFile(conf.TimestampCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tsaCA.Raw}), 0600))
+
+	ledger := newSegmentLedger(conf.OutputDir)
+
+	start := time.Date(2021, 6, 28, 12, 0, 0, 0, time.UTC)
+	path := segmentPath(conf.OutputDir, "DP-1", start, false)
+	assert.Ok(t, os.MkdirAll(filepath.Dir(path), 0700))
+	assert.Ok(t, os.WriteFile(path, []byte("video"), 0600))
+
+	segment, err := segmentRecordWithFileInfo(segmentRecord{
+		Screen: "DP-1",
+		Path:   segmentPathRelative(conf.OutputDir, path),
+		Start:  start,
+		End:    start.Add(15 * time.Minute),
+		Tier:   segmentTierOriginal,
+	}, path)
+	assert.Ok(t, err)
+	assert.Ok(t, ledger.AddSegment(segment))
+
+	now := time.Date(2021, 6, 29, 1, 0, 0, 0, time.UTC)
+	assert.Ok(t, writeMissingDailyDigests(conf, ledger, nil, now, logex.Levels(logex.Discard)))
+
+	verify := func() string {
+		problems, notes, err := verifyScreen(conf, "DP-1", nil, now)
+		assert.Ok(t, err)
+
+		return strings.Join(append(problems, notes...), "\n")
+	}
+
+	assert.EqualString(t, verify(), `digest 2021-06-28: unsigned
+digest 2021-06-28: not timestamped yet`)
+
+	pending, err := timestampDailyDigests(context.Background(), conf, logex.Levels(logex.Discard))
+	assert.Ok(t, err)
+	assert.Assert(t, !pending)
+
+	assert.EqualString(t, verify(), `digest 2021-06-28: unsigned`)
+
+	// a token for another day's digest doesn't pass for this one
+	otherToken, _, err := requestTimestamp(context.Background(), tsa.URL, []byte("some other digest"))
+	assert.Ok(t, err)
+	assert.Ok(t, os.WriteFile(timestampTokenPath(conf.OutputDir, "DP-1", "2021-06-28"), otherToken, 0600))
+
+	assert.EqualString(t, verify(), `digest 2021-06-28: timestamp token: message imprint doesn't match (token is for something else)
+digest 2021-06-28: unsigned`)
+}
+
+// which ESS signing certificate attribute the test TSA puts in its tokens
+type testTsaSigningCertificate int
+
+const (
+	testTsaSigningCertificateV2 testTsaSigningCertificate = iota
+	testTsaSigningCertificateV1
+	testTsaSigningCertificateNone
+	testTsaSigningCertificateOfCA // refers to the CA's certificate instead of the TSA's
+)
+
+// stand-in for a real timestamp authority. its certificate is issued by the returned CA.
+func startTestTimestampAuthority(t *testing.T, now time.Time) (*httptest.Server, *x509.Certificate) {
+	return startTestTimestampAuthorityWith(t, now, testTsaSigningCertificateV2)
+}
+
+func startTestTimestampAuthorityWith(t *testing.T, now time.Time, signingCertificate testTsaSigningCertificate) (*httptest.Server, *x509.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Ok(t, err)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test TSA CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	assert.Ok(t, err)
+	ca, err := x509.ParseCertificate(caDer)
+	assert.Ok(t, err)
+
+	tsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Ok(t, err)
+
+	tsaDer, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test TSA"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}, ca, tsaKey.Public(), caKey)
+	assert.Ok(t, err)
+	tsaCertificate, err := x509.ParseCertificate(tsaDer)
+	assert.Ok(t, err)
+
+	mustMarshal := func(value interface{}) []byte {
+		der, err := asn1.Marshal(value)
+		assert.Ok(t, err)
+		return der
+	}
+
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSha256, Parameters: asn1.NullRawValue}
+
+	serialNumber := int64(0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBytes, err := io.ReadAll(r.Body)
+		assert.Ok(t, err)
+
+		request := timestampRequest{}
+		_, err = asn1.Unmarshal(requestBytes, &request)
+		assert.Ok(t, err)
+
+		serialNumber++
+
+		tstInfo := mustMarshal(timestampTSTInfo{
+			Version:        1,
+			Policy:         asn1.ObjectIdentifier{1, 2, 3, 4},
+			MessageImprint: request.MessageImprint,
+			SerialNumber:   big.NewInt(serialNumber),
+			GenTime:        now,
+			Nonce:          request.Nonce,
+		})
+
+		tstInfoHash := sha256.Sum256(tstInfo)
+
+		attributes := append(
+			mustMarshal(cmsAttribute{
+				Type:   oidCmsAttributeContentType,
+				Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: mustMarshal(oidCmsContentTypeTSTInfo)},
+			}),
+			mustMarshal(cmsAttribute{
+				Type:   oidCmsAttributeDigest,
+				Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: mustMarshal(tstInfoHash[:])},
+			})...)
+
+		signingCertificateAttribute := func(oid asn1.ObjectIdentifier, value interface{}) []byte {
+			return mustMarshal(cmsAttribute{
+				Type:   oid,
+				Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: mustMarshal(value)},
+			})
+		}
+
+		switch signingCertificate {
+		case testTsaSigningCertificateV2:
+			certificateHash := sha256.Sum256(tsaCertificate.Raw)
+			attributes = append(attributes, signingCertificateAttribute(oidEssSigningCertificateV2, essSigningCertificateV2{
+				Certs: []essCertIdV2{{CertHash: certificateHash[:]}},
+			})...)
+		case testTsaSigningCertificateV1:
+			certificateHash := sha1.Sum(tsaCertificate.Raw)
+			attributes = append(attributes, signingCertificateAttribute(oidEssSigningCertificate, essSigningCertificate{
+				Certs: []essCertId{{CertHash: certificateHash[:]}},
+			})...)
+		case testTsaSigningCertificateOfCA:
+			certificateHash := sha256.Sum256(ca.Raw)
+			attributes = append(attributes, signingCertificateAttribute(oidEssSigningCertificateV2, essSigningCertificateV2{
+				Certs: []essCertIdV2{{CertHash: certificateHash[:]}},
+			})...)
+		}
+
+		signedAttrs := mustMarshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attributes})
+		signedAttrsHash := sha256.Sum256(signedAttrs)
+
+		signature, err := tsaKey.Sign(rand.Reader, signedAttrsHash[:], crypto.SHA256)
+		assert.Ok(t, err)
+
+		signedData := mustMarshal(cmsSignedData{
+			Version:          3,
+			DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+			EncapContentInfo: cmsEncapsulatedContentInfo{
+				EContentType: oidCmsContentTypeTSTInfo,
+				EContent:     tstInfo,
+			},
+			Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: tsaCertificate.Raw},
+			SignerInfos: []cmsSignerInfo{{
+				Version: 1,
+				SID: asn1.RawValue{FullBytes: mustMarshal(cmsIssuerAndSerialNumber{
+					Issuer:       asn1.RawValue{FullBytes: tsaCertificate.RawIssuer},
+					SerialNumber: tsaCertificate.SerialNumber,
+				})},
+				DigestAlgorithm:    sha256Algorithm,
+				SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attributes},
+				SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}}, // ecdsa-with-SHA256
+				Signature:          signature,
+			}},
+		})
+
+		token := mustMarshal(cmsContentInfo{
+			ContentType: oidCmsSignedData,
+			Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+		})
+
+		w.Header().Set("Content-Type", "application/timestamp-reply")
+		_, _ = w.Write(mustMarshal(timestampResponse{
+			Status:         timestampStatusInfo{Status: timestampStatusGranted},
+			TimeStampToken: asn1.RawValue{FullBytes: token},
+		}))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, ca
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"time"
+
+	"github.com/BurntSushi/xgb/screensaver"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgbutil"
+	"github.com/function61/gokit/log/logex"
+)
+
+const userIdleUnknown = time.Duration(-1)
+
+// MIT-SCREEN-SAVER only gives us best-effort metadata (idle time, screensaver state), so recording
+// goes on without it. the requests mustn't be made if this returns false.
+func initScreensaver(xutil *xgbutil.XUtil, logl *logex.Leveled) bool {
+	if err := screensaver.Init(xutil.Conn()); err != nil {
+		logl.Info.Printf("MIT-SCREEN-SAVER not available (user idle time will be unknown): %v", err)
+		return false
+	}
+
+	return true
+}
+
+// how long since the user last touched keyboard or mouse. needs MIT-SCREEN-SAVER extension.
+func getUserIdle(xutil *xgbutil.XUtil) (time.Duration, error) {
+	info, err := screensaver.QueryInfo(xutil.Conn(), xproto.Drawable(xutil.RootWin())).Reply()
+	if err != nil {
+		return userIdleUnknown, err
+	}
+
+	return time.Duration(info.MsSinceUserInput) * time.Millisecond, nil
+}
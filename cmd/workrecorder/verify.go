@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/function61/gokit/os/osutil"
+	"github.com/spf13/cobra"
+)
+
+func verifyEntrypoint() *cobra.Command {
+	publicKeyPath := ""
+	proofPath := ""
+
+	cmd := &cobra.Command{
+		Use:   "verify [screen]... | --proof <proof>",
+		Short: "Verifies the recordings against the ledgers and daily digests",
+		Long: `Verifies the recordings against the ledgers and daily digests.
+
+Detects modified, missing and unknown segments, tampering with the ledger and digests that
+don't match the ledger (or their signature).
+
+With --proof checks a segment exported with "prove" instead (offline, needs only the proof, the
+segment next to it and the public key).`,
+	}
+
+	resolveConfig := registerConfigFlags(cmd.Flags())
+
+	cmd.Flags().StringVarP(&publicKeyPath, "public-key", "k", "", "Ed25519 public key (PKIX PEM) to check digest signatures with (default: derived from signing key)")
+	cmd.Flags().StringVar(&proofPath, "proof", "", "Check a proof made with \"prove\" instead of the recordings")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		osutil.ExitIfError(func() error {
+			conf, err := resolveConfig()
+			if err != nil {
+				return err
+			}
+
+			var publicKey ed25519.PublicKey
+			switch {
+			case publicKeyPath != "":
+				publicKey, err = loadDigestPublicKey(publicKeyPath)
+				if err != nil {
+					return err
+				}
+			case conf.DigestSigningKeyFile != "":
+				signingKey, err := loadDigestSigningKey(conf.DigestSigningKeyFile)
+				if err != nil {
+					return err
+				}
+
+				publicKey = signingKey.Public().(ed25519.PublicKey)
+			}
+
+			if proofPath != "" {
+				timestampRoots, err := loadTimestampRoots(conf.TimestampCAFile)
+				if err != nil {
+					return err
+				}
+
+				return verifySegmentProof(proofPath, publicKey, timestampRoots, os.Stdout)
+			}
+
+			screens := []ScreenId{}
+			for _, arg := range args {
+				screens = append(screens, ScreenId(arg))
+			}
+
+			if len(screens) == 0 {
+				screens, err = listScreens(conf.OutputDir)
+				if err != nil {
+					return err
+				}
+			}
+
+			return verifyRecordings(*conf, screens, publicKey, os.Stdout)
+		}())
+	}
+
+	return cmd
+}
+
+var errVerificationFailed = errors.New("verification failed")
+
+// writes findings to "output". "publicKey" is optional.
+func verifyRecordings(conf Config, screens []ScreenId, publicKey ed25519.PublicKey, output io.Writer) error {
+	problemCount := 0
+
+	for _, screen := range screens {
+		problems, notes, err := verifyScreen(conf, screen, publicKey, time.Now())
+		if err != nil {
+			return fmt.Errorf("%s: %w", screen, err)
+		}
+
+		for _, problem := range problems {
+			fmt.Fprintf(output, "%s: FAIL %s\n", screen, problem)
+		}
+
+		for _, note := range notes {
+			fmt.Fprintf(output, "%s: note %s\n", screen, note)
+		}
+
+		if len(problems) == 0 {
+			fmt.Fprintf(output, "%s: OK\n", screen)
+		}
+
+		problemCount += len(problems)
+	}
+
+	if problemCount > 0 {
+		return fmt.Errorf("%w: %d problem(s)", errVerificationFailed, problemCount)
+	}
+
+	return nil
+}
+
+// "problems" fail the verification, "notes" are informational
+func verifyScreen(conf Config, screen ScreenId, publicKey ed25519.PublicKey, now time.Time) ([]string, []string, error) {
+	problems := []string{}
+	notes := []string{}
+
+	lines, err := readLedger(conf.OutputDir, screen)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	problems = append(problems, verifyLedgerChain(lines)...)
+
+	timestampRoots, err := loadTimestampRoots(conf.TimestampCAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// segments on disk vs. what the ledger says should exist
+	files, err := globSegments(conf.OutputDir, screen.ReadyPath(conf.OutputDir, filepath.Join("*", "*"+segmentExtension+"*")))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	live := liveSegmentsFromLedger(lines)
+
+	for _, file := range files {
+		relativePath := segmentPathRelative(conf.OutputDir, file.Path)
+
+		entry, found := live[relativePath]
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: not in ledger", relativePath))
+			continue
+		}
+
+		delete(live, relativePath) // whatever is left is missing
+
+		hash, err := sha256File(file.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if hash != entry.Sha256 {
+			problems = append(problems, fmt.Sprintf("%s: modified (SHA-256 %s, ledger says %s)", relativePath, hash, entry.Sha256))
+		}
+	}
+
+	missing := []string{}
+	for path := range live {
+		missing = append(missing, path)
+	}
+	sort.Strings(missing)
+
+	for _, path := range missing {
+		problems = append(problems, fmt.Sprintf("%s: missing", path))
+	}
+
+	// digests
+	ledgerHashBySeq := map[int64]string{}
+	for _, line := range lines {
+		ledgerHashBySeq[line.Entry.Seq] = line.Hash
+	}
+
+	for _, day := range completedLedgerDays(lines, now) {
+		path := digestPath(conf.OutputDir, screen, day)
+
+		digest, err := readDailyDigest(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				notes = append(notes, fmt.Sprintf("digest %s: not made yet", day))
+				continue
+			}
+
+			return nil, nil, err
+		}
+
+		// the range is checked first, as a tampered digest could otherwise match the missing head
+		if digest.LedgerSeq < 1 || digest.LedgerSeq > int64(len(lines)) || ledgerHashBySeq[digest.LedgerSeq] != digest.LedgerHead {
+			problems = append(problems, fmt.Sprintf("digest %s: refers to ledger entry %d that doesn't match the ledger", day, digest.LedgerSeq))
+			continue
+		}
+
+		// the ledger as it was when the digest was made
+		expected := makeDailyDigest(screen, day, lines[:digest.LedgerSeq], nil)
+
+		if expected.Root != digest.Root || !digestSegmentsEqual(expected.Segments, digest.Segments) {
+			problems = append(problems, fmt.Sprintf("digest %s: root %s doesn't match ledger's %s", day, digest.Root, expected.Root))
+			continue
+		}
+
+		// removals can be appended to the ledger by anyone who can write to it, so the digested
+		// segments that were removed later are listed for a human to judge
+		notes = append(notes, removalsAfterDigest(*digest, lines[digest.LedgerSeq:])...)
+
+		switch {
+		case digest.Signature == "":
+			notes = append(notes, fmt.Sprintf("digest %s: unsigned", day))
+		case publicKey == nil:
+			notes = append(notes, fmt.Sprintf("digest %s: signature not checked (no public key)", day))
+		default:
+			if err := digest.VerifySignature(publicKey); err != nil {
+				problems = append(problems, fmt.Sprintf("digest %s: %v", day, err))
+			}
+		}
+
+		token, err := os.ReadFile(timestampTokenPath(conf.OutputDir, screen, day))
+		switch {
+		case err == nil:
+			info, err := verifyDigestTimestamp(*digest, lastDigestSegmentPath(*digest), token, timestampRoots)
+			switch {
+			case err != nil:
+				problems = append(problems, fmt.Sprintf("digest %s: %v", day, err))
+			case timestampRoots == nil:
+				notes = append(notes, fmt.Sprintf("digest %s: timestamp's TSA certificate (%s) not checked (no timestamp_ca_file)", day, info.TSA))
+			}
+		case os.IsNotExist(err):
+			if conf.TimestampURL != "" {
+				notes = append(notes, fmt.Sprintf("digest %s: not timestamped yet", day))
+			}
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return problems, notes, nil
+}
+
+// checks that the token is over the digest and was made after the day was over. the day ends at
+// midnight of the UTC offset "daySegmentPath" (one of the day's segments, relative to the output
+// dir. the later the better, in case DST changed during the day) was recorded in.
+func verifyDigestTimestamp(digest dailyDigest, daySegmentPath string, token []byte, roots *x509.CertPool) (*timestampInfo, error) {
+	info, err := verifyTimestampToken(token, digest.SignedMessage(), roots)
+	if err != nil {
+		return nil, err
+	}
+
+	if segmentPathDay(daySegmentPath) != digest.Day {
+		return nil, fmt.Errorf("segment %s is not of day %s", daySegmentPath, digest.Day)
+	}
+
+	dayEnd, err := segmentDayEnd(daySegmentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Time.Before(dayEnd) {
+		return nil, fmt.Errorf("timestamped at %s, before the day was over", info.Time.Format(time.RFC3339))
+	}
+
+	return info, nil
+}
+
+func removalsAfterDigest(digest dailyDigest, laterLines []ledgerLine) []string {
+	digested := map[string]bool{}
+	for _, segment := range digest.Segments {
+		digested[segment.Path] = true
+	}
+
+	notes := []string{}
+	for _, line := range laterLines {
+		if line.Entry.Type == ledgerEntryRemove && digested[line.Entry.Path] {
+			notes = append(notes, fmt.Sprintf("digest %s: %s removed after it was digested (ledger entry %d: %s)", digest.Day, line.Entry.Path, line.Entry.Seq, line.Entry.Reason))
+		}
+	}
+
+	return notes
+}
+
+func lastDigestSegmentPath(digest dailyDigest) string {
+	if len(digest.Segments) == 0 { // doesn't happen, as digests are only made for days with segments
+		return ""
+	}
+
+	return digest.Segments[len(digest.Segments)-1].Path
+}
+
+func digestSegmentsEqual(a []digestSegment, b []digestSegment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sha256File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}